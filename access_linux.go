@@ -0,0 +1,149 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// faccessHandle checks whether the calling process can access the inode
+// referenced by handle (which may be an O_PATH handle) with mode.
+func faccessHandle(handle *os.File, mode uint32, flags int) error {
+	err := unix.Faccessat2(int(handle.Fd()), "", mode, flags|unix.AT_EMPTY_PATH)
+	if !errors.Is(err, unix.ENOSYS) {
+		if err != nil {
+			return &os.PathError{Op: "faccessat2", Path: handle.Name(), Err: err}
+		}
+		return nil
+	}
+
+	// faccessat2(2) was only added in Linux 5.8, and faccessat(2) supports
+	// neither AT_EMPTY_PATH nor any other flags. AT_EACCESS only makes a
+	// difference if the real and effective ids differ, so we can only fall
+	// back to faccessat(2) if they are the same.
+	if flags&unix.AT_EACCESS != 0 && (os.Getuid() != os.Geteuid() || os.Getgid() != os.Getegid()) {
+		return &os.PathError{Op: "faccessat2", Path: handle.Name(), Err: wrapBaseError(err, ErrUnsupported)}
+	}
+
+	// Operate on the /proc/thread-self/fd/$n magic-link instead (which always
+	// refers to the exact inode of the handle), as with fchmodHandle.
+	procRoot, err := getProcRoot()
+	if err != nil {
+		return err
+	}
+
+	procFdDir, closer, err := procThreadSelf(procRoot, "fd/")
+	if err != nil {
+		return fmt.Errorf("get safe /proc/thread-self/fd handle: %w", err)
+	}
+	defer procFdDir.Close()
+	defer closer()
+
+	fdStr := strconv.Itoa(int(handle.Fd()))
+	if err := checkSymlinkOvermount(procRoot, procFdDir, fdStr); err != nil {
+		return fmt.Errorf("check safety of /proc/thread-self/fd/%s magiclink: %w", fdStr, err)
+	}
+	if err := unix.Faccessat(int(procFdDir.Fd()), fdStr, mode, 0); err != nil {
+		return &os.PathError{Op: "faccessat", Path: handle.Name(), Err: err}
+	}
+	return nil
+}
+
+// AccessInRoot checks whether the calling process can access the inode at
+// unsafePath (resolved inside root) with mode, in the same way as
+// access(2). mode is either unix.F_OK (which only checks whether the inode
+// exists) or a combination of unix.R_OK, unix.W_OK and unix.X_OK. As with
+// access(2), the check is done using the real (rather than effective) user
+// and group ids of the process, and a trailing symlink in unsafePath is
+// followed (inside root).
+//
+// Unlike calling access(2) on the result of [SecureJoin], the check is done
+// on the inode found by resolving unsafePath inside root, so an attacker
+// cannot redirect the check outside of the root. If the access check fails,
+// the returned error wraps EACCES (or another error from the lookup of
+// unsafePath, such as ENOENT).
+func AccessInRoot(root *os.File, unsafePath string, mode uint32) error {
+	return FaccessatInRoot(root, unsafePath, mode, 0)
+}
+
+// FaccessatInRoot is equivalent to [AccessInRoot], except that flags can be
+// used to change the behaviour of the check (in the same way as
+// faccessat2(2)). The supported flags are:
+//
+//   - unix.AT_EACCESS, which causes the check to be done using the effective
+//     user and group ids of the process.
+//   - unix.AT_SYMLINK_NOFOLLOW, which causes a trailing symlink in unsafePath
+//     to not be followed (the symlink itself is checked).
+//
+// If the kernel does not support faccessat2(2) (Linux 5.8 and later),
+// unix.AT_EACCESS can only be supported if the real and effective ids of the
+// process are the same. Otherwise, an error wrapping [ErrUnsupported] is
+// returned.
+func FaccessatInRoot(root *os.File, unsafePath string, mode uint32, flags int) error {
+	if flags&^(unix.AT_EACCESS|unix.AT_SYMLINK_NOFOLLOW) != 0 {
+		return &os.PathError{Op: "securejoin.FaccessatInRoot", Path: unsafePath, Err: fmt.Errorf("unsupported flags 0x%x: %w", flags, unix.EINVAL)}
+	}
+	handle, err := OpenatInRootWithOptions(context.Background(), root, unsafePath, &ResolveOptions{
+		NoFollowTrailing: flags&unix.AT_SYMLINK_NOFOLLOW != 0,
+	})
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	if err := faccessHandle(handle, mode, flags&^unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "securejoin.FaccessatInRoot", Path: unsafePath, Err: err}
+	}
+	return nil
+}
+
+// ExistsInRoot checks whether unsafePath (resolved inside root) exists,
+// without opening the final component. The parent directory of unsafePath is
+// resolved in the same way as [OpenatInRoot], and then the final component is
+// checked with fstatat(2) (with AT_SYMLINK_NOFOLLOW, so a dangling symlink
+// exists). This means that ExistsInRoot never opens the inode being checked,
+// which avoids side-effects from opening special inodes (such as FIFOs or
+// TTYs). As with [OpenParentInRoot], trailing slashes in unsafePath are
+// ignored.
+//
+// If only the final component of unsafePath is missing, (false, nil) is
+// returned. If a parent directory of unsafePath is missing, the returned error
+// wraps ENOENT (and is a [*ResolveError] which records the missing
+// component), so that callers can tell the two cases apart. Any other failure
+// (such as EACCES, or ENOTDIR if a parent is not a directory) is returned as
+// an error.
+func ExistsInRoot(root *os.File, unsafePath string) (bool, error) {
+	parent, finalComponent, err := openParentInRoot(root, unsafePath)
+	if err != nil {
+		return false, err
+	}
+	defer parent.Close()
+
+	switch finalComponent {
+	case "", ".", "..":
+		// The parent directory exists, and so does the path (".." of an
+		// existing directory is either its parent or the root).
+		return true, nil
+	}
+
+	var st unix.Stat_t
+	err = unix.Fstatat(int(parent.Fd()), finalComponent, &st, unix.AT_SYMLINK_NOFOLLOW)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, unix.ENOENT):
+		return false, nil
+	default:
+		return false, &os.PathError{Op: "securejoin.ExistsInRoot", Path: unsafePath, Err: &os.PathError{Op: "fstatat", Path: parent.Name() + "/" + finalComponent, Err: err}}
+	}
+}
@@ -0,0 +1,128 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestAccessInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a",
+			"file a/file data ::644",
+			"file a/exec data ::755",
+			"symlink a/link exec",
+			"symlink a/escape ../../../../etc/passwd",
+			"symlink a/dangling nope",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			name, unsafePath string
+			mode             uint32
+			flags            int
+			expectedErr      error
+		}{
+			{"exists", "a/file", unix.F_OK, 0, nil},
+			{"exists-dir", "a", unix.F_OK, 0, nil},
+			{"nonexistent", "a/nope", unix.F_OK, 0, unix.ENOENT},
+			{"read", "a/file", unix.R_OK, 0, nil},
+			{"exec", "a/exec", unix.X_OK, 0, nil},
+			// Even root cannot execute a file without any execute bits set.
+			{"exec-noexec", "a/file", unix.X_OK, 0, unix.EACCES},
+			{"exec-eaccess", "a/exec", unix.X_OK, unix.AT_EACCESS, nil},
+			{"symlink", "a/link", unix.X_OK, 0, nil},
+			{"symlink-nofollow", "a/dangling", unix.F_OK, unix.AT_SYMLINK_NOFOLLOW, nil},
+			{"dangling-symlink", "a/dangling", unix.F_OK, 0, unix.ENOENT},
+			// The symlink is resolved inside the root.
+			{"escape", "a/escape", unix.F_OK, 0, unix.ENOENT},
+			{"bad-flags", "a/file", unix.F_OK, unix.AT_EMPTY_PATH, unix.EINVAL},
+		} {
+			test := test // copy iterator
+			t.Run(test.name, func(t *testing.T) {
+				if test.flags == 0 {
+					err := AccessInRoot(rootDir, test.unsafePath, test.mode)
+					if test.expectedErr != nil {
+						assert.ErrorIs(t, err, test.expectedErr, "AccessInRoot")
+					} else {
+						assert.NoError(t, err, "AccessInRoot")
+					}
+				}
+				err := FaccessatInRoot(rootDir, test.unsafePath, test.mode, test.flags)
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr, "FaccessatInRoot")
+				} else {
+					assert.NoError(t, err, "FaccessatInRoot")
+				}
+			})
+		}
+	})
+}
+
+func TestExistsInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/file",
+			"fifo a/b/fifo",
+			"symlink a/link b",
+			"symlink a/dangling nonexist",
+			"symlink escape ../../../../a",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			unsafePath  string
+			exists      bool
+			expectedErr error
+		}{
+			{"", true, nil},
+			{"/", true, nil},
+			{"a/b/file", true, nil},
+			{"a/link/file", true, nil},
+			{"escape/b/file", true, nil},
+			{"a/b/..", true, nil},
+			// FIFOs are not opened, so this does not block.
+			{"a/b/fifo", true, nil},
+			// The final component is not followed.
+			{"a/dangling", true, nil},
+			{"a/b/nonexist", false, nil},
+			{"a/b/file/", true, nil},
+			// Missing parents are reported as errors.
+			{"a/nonexist/file", false, unix.ENOENT},
+			{"a/dangling/file", false, unix.ENOENT},
+			{"a/b/file/foo", false, unix.ENOTDIR},
+		} {
+			exists, err := ExistsInRoot(rootDir, test.unsafePath)
+			if test.expectedErr != nil {
+				assert.ErrorIsf(t, err, test.expectedErr, "ExistsInRoot(%q)", test.unsafePath)
+			} else {
+				assert.NoErrorf(t, err, "ExistsInRoot(%q)", test.unsafePath)
+			}
+			assert.Equalf(t, test.exists, exists, "ExistsInRoot(%q)", test.unsafePath)
+		}
+
+		_, err = ExistsInRoot(rootDir, "a/nonexist/file")
+		var resolveErr *ResolveError
+		require.ErrorAs(t, err, &resolveErr, "missing parent should be a *ResolveError")
+		assert.Equal(t, "nonexist", resolveErr.Component, "missing parent component")
+	})
+}
@@ -0,0 +1,179 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenBeneath is a stricter variant of [OpenatInRoot], which requires
+// unsafePath to be resolvable beneath root without ever leaving it (in the
+// same way as openat2(2) with RESOLVE_BENEATH). Rather than treating root as
+// the root of the filesystem (which clamps ".." components at the root and
+// resolves absolute symlinks relative to the root), OpenBeneath returns an
+// error wrapping [ErrEscapesRoot] if unsafePath is absolute, if a ".."
+// component would go above root, or if a symlink with an absolute target is
+// found. Magic-links (such as those in /proc/self/fd) are never followed, and
+// result in an error wrapping ELOOP.
+//
+// As with [OpenatInRoot], the returned handle is an O_PATH handle and a
+// trailing symlink in unsafePath is followed. On kernels without openat2(2),
+// an equivalent emulation is used (which cannot tell magic-links apart from
+// regular symlinks on procfs, and so refuses to follow any symlink on procfs).
+func OpenBeneath(root *os.File, unsafePath string) (*os.File, error) {
+	unsafePath = filepath.ToSlash(unsafePath)
+	if unsafePath == "" {
+		unsafePath = "."
+	}
+	var (
+		handle *os.File
+		err    error
+	)
+	if hasOpenat2() {
+		handle, err = openBeneathOpenat2(root, unsafePath)
+	} else {
+		atomic.AddUint64(&statEmulatedLookups, 1)
+		handle, err = openBeneathEmulated(root, unsafePath)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.OpenBeneath", Path: unsafePath, Err: err}
+	}
+	return handle, nil
+}
+
+func openBeneathOpenat2(root *os.File, unsafePath string) (*os.File, error) {
+	how := &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	// We cannot use openat2() here, because EXDEV is not a spurious error
+	// for RESOLVE_BENEATH lookups -- it means the path tried to escape.
+	for tries := 0; tries < scopedLookupMaxRetries; tries++ {
+		fd, err := unix.Openat2(int(root.Fd()), unsafePath, how)
+		switch {
+		case err == nil:
+			fullPath := root.Name() + "/" + unsafePath
+			if actualPath, err := rawProcSelfFdReadlink(fd, nil); err == nil {
+				fullPath = actualPath
+			}
+			return os.NewFile(uintptr(fd), fullPath), nil
+		case errors.Is(err, unix.EAGAIN):
+			atomic.AddUint64(&statOpenat2Retries, 1)
+			continue
+		case errors.Is(err, unix.EXDEV):
+			return nil, ErrEscapesRoot
+		default:
+			return nil, &os.PathError{Op: "openat2", Path: root.Name() + "/" + unsafePath, Err: err}
+		}
+	}
+	return nil, ErrPossibleAttack
+}
+
+func openBeneathEmulated(root *os.File, unsafePath string) (_ *os.File, Err error) {
+	if strings.HasPrefix(unsafePath, "/") {
+		return nil, ErrEscapesRoot
+	}
+	rootHandle, err := reopenRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	// The stack of handles for each directory walked, so that ".." can be
+	// resolved without needing to do a lookup.
+	stack := []*os.File{rootHandle}
+	defer func() {
+		// On success, the final handle has been removed from the stack.
+		for _, dir := range stack {
+			_ = dir.Close()
+		}
+	}()
+
+	var (
+		linksWalked  int
+		currentIsDir = true
+	)
+	remaining := strings.Split(unsafePath, "/")
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+
+		current := stack[len(stack)-1]
+		if !currentIsDir {
+			// Any further components (including trailing slashes) require
+			// the current component to be a directory.
+			return nil, &os.PathError{Op: "openat", Path: current.Name() + "/" + part, Err: unix.ENOTDIR}
+		}
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) == 1 {
+				return nil, ErrEscapesRoot
+			}
+			_ = current.Close()
+			stack = stack[:len(stack)-1]
+			currentIsDir = true
+			// Make sure the directory was not moved outside of the root
+			// while we were walking (in which case ".." would have let us
+			// escape).
+			if _, err := rootRelativePath(root, stack[len(stack)-1]); err != nil {
+				return nil, fmt.Errorf("check walked .. component: %w", err)
+			}
+			continue
+		}
+
+		next, err := openatFile(current, part, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, err
+		}
+		st, err := fstat(next)
+		if err != nil {
+			_ = next.Close()
+			return nil, err
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFLNK {
+			stack = append(stack, next)
+			currentIsDir = st.Mode&unix.S_IFMT == unix.S_IFDIR
+			continue
+		}
+
+		// Magic-links can only exist on procfs, and we never follow them
+		// (equivalent to RESOLVE_NO_MAGICLINKS).
+		statfs, err := fstatfs(next)
+		if err != nil {
+			_ = next.Close()
+			return nil, err
+		}
+		if statfs.Type == procSuperMagic {
+			_ = next.Close()
+			return nil, fmt.Errorf("refusing to follow procfs symlink %q: %w", next.Name(), unix.ELOOP)
+		}
+		linkDest, err := readlinkatFile(next, "")
+		_ = next.Close()
+		if err != nil {
+			return nil, err
+		}
+		linksWalked++
+		if linksWalked > maxSymlinkLimit {
+			return nil, ErrTooManySymlinks
+		}
+		if strings.HasPrefix(linkDest, "/") {
+			return nil, fmt.Errorf("%w: symlink %q has absolute target %q", ErrEscapesRoot, next.Name(), linkDest)
+		}
+		remaining = append(strings.Split(linkDest, "/"), remaining...)
+	}
+
+	handle := stack[len(stack)-1]
+	stack = stack[:len(stack)-1]
+	return handle, nil
+}
@@ -0,0 +1,94 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenBeneath(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/file",
+			"symlink a/rel b",
+			"symlink a/b/up ../rel/file",
+			"symlink a/abs /a/b",
+			"symlink a/escape ../../b",
+			"symlink a/loop1 loop2",
+			"symlink a/loop2 loop1",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			unsafePath   string
+			expectedPath string
+			expectedErr  error
+		}{
+			{"", "", nil},
+			{".", "", nil},
+			{"a/b/file", "a/b/file", nil},
+			{"a/rel/file", "a/b/file", nil},
+			{"a/b/up", "a/b/file", nil},
+			{"a/b/../b/./file", "a/b/file", nil},
+			{"a/b/..", "a", nil},
+			// Escapes are errors, rather than being clamped to the root.
+			{"/a/b", "", ErrEscapesRoot},
+			{"..", "", ErrEscapesRoot},
+			{"a/../../a", "", ErrEscapesRoot},
+			{"a/abs/file", "", ErrEscapesRoot},
+			{"a/escape", "", ErrEscapesRoot},
+			// Other errors.
+			{"a/nonexist", "", unix.ENOENT},
+			{"a/b/file/", "", unix.ENOTDIR},
+			{"a/b/file/..", "", unix.ENOTDIR},
+			{"a/loop1", "", unix.ELOOP},
+		} {
+			test := test // copy iterator
+			t.Run(test.unsafePath, func(t *testing.T) {
+				handle, err := OpenBeneath(rootDir, test.unsafePath)
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+					assert.Nil(t, handle, "handle should be nil on error")
+					return
+				}
+				require.NoError(t, err)
+				defer handle.Close()
+
+				expectedPath, err := filepath.EvalSymlinks(filepath.Join(root, test.expectedPath))
+				require.NoError(t, err)
+				gotPath, err := procSelfFdReadlink(handle)
+				require.NoError(t, err)
+				assert.Equal(t, expectedPath, gotPath, "OpenBeneath handle path")
+			})
+		}
+	})
+}
+
+func TestOpenBeneath_MagicLink(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		procRoot, err := os.OpenFile("/proc", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer procRoot.Close()
+
+		// /proc/self/cwd is a magic-link with an absolute target, but it must
+		// be rejected because it is a magic-link.
+		handle, err := OpenBeneath(procRoot, "self/cwd")
+		assert.ErrorIs(t, err, unix.ELOOP, "OpenBeneath through magic-link")
+		assert.Nil(t, handle, "handle should be nil on error")
+	})
+}
@@ -0,0 +1,59 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ChdirInRoot changes the current working directory to the directory at
+// unsafePath within root. The directory is resolved using [OpenatInRoot] and
+// the working directory is then changed with fchdir(2), so the lookup is not
+// subject to the races that a path-based chdir(2) would be.
+//
+// On success, the returned restore function can be called to change the
+// working directory back to what it was before ChdirInRoot was called. The
+// restore function must only be called once.
+//
+// Note that unlike most of the per-thread state that Go programs need to be
+// careful about (and unlike the /proc/thread-self handles used internally by
+// this package), the working directory of a Go program is shared by every
+// thread in the process. This means that [runtime.LockOSThread] does not
+// isolate the change, and any goroutines using relative paths concurrently
+// with ChdirInRoot (or between ChdirInRoot and restore) will be affected.
+// ChdirInRoot is thus only really suitable for single-threaded setup code.
+func ChdirInRoot(root *os.File, unsafePath string) (restore func() error, Err error) {
+	handle, err := OpenatInRoot(root, unsafePath)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	oldCwd, err := os.OpenFile(".", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.ChdirInRoot", Path: unsafePath, Err: err}
+	}
+	defer func() {
+		if Err != nil {
+			_ = oldCwd.Close()
+		}
+	}()
+
+	if err := unix.Fchdir(int(handle.Fd())); err != nil {
+		return nil, &os.PathError{Op: "securejoin.ChdirInRoot", Path: unsafePath, Err: os.NewSyscallError("fchdir", err)}
+	}
+
+	return func() error {
+		defer oldCwd.Close()
+		if err := unix.Fchdir(int(oldCwd.Fd())); err != nil {
+			return &os.PathError{Op: "fchdir", Path: oldCwd.Name(), Err: err}
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,75 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestChdirInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b/c",
+			"file a/file",
+			"symlink link /a/b",
+			"symlink escape ../../../../../../a",
+		}
+		root := createTree(t, tree...)
+
+		realRoot, err := filepath.EvalSymlinks(root)
+		require.NoError(t, err)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		origCwd, err := os.Getwd()
+		require.NoError(t, err)
+
+		for _, test := range []struct {
+			unsafePath  string
+			expectedCwd string
+			expectedErr error
+		}{
+			{"a/b/c", "/a/b/c", nil},
+			{"link/c", "/a/b/c", nil},
+			{"escape", "/a", nil},
+			{"/", "", nil},
+			{"a/file", "", unix.ENOTDIR},
+			{"a/nope", "", unix.ENOENT},
+		} {
+			test := test // copy iterator
+			t.Run(test.unsafePath, func(t *testing.T) {
+				restore, err := ChdirInRoot(rootDir, test.unsafePath)
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+					if restore != nil {
+						_ = restore()
+					}
+				} else {
+					require.NoError(t, err)
+
+					cwd, err := os.Getwd()
+					require.NoError(t, err)
+					assert.Equal(t, realRoot+test.expectedCwd, cwd, "working directory after ChdirInRoot")
+
+					require.NoError(t, restore(), "restore working directory")
+				}
+
+				cwd, err := os.Getwd()
+				require.NoError(t, err)
+				assert.Equal(t, origCwd, cwd, "working directory should be restored")
+			})
+		}
+	})
+}
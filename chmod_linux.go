@@ -0,0 +1,104 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// fchmodHandle changes the mode of the inode referenced by handle (which may be
+// an O_PATH handle). fchmod(2) does not work on O_PATH handles and fchmodat(2)
+// does not support AT_EMPTY_PATH, so we instead operate on the
+// /proc/thread-self/fd/$n magic-link (which always refers to the exact inode
+// of the handle).
+func fchmodHandle(handle *os.File, mode uint32) error {
+	procRoot, err := getProcRoot()
+	if err != nil {
+		return err
+	}
+
+	procFdDir, closer, err := procThreadSelf(procRoot, "fd/")
+	if err != nil {
+		return fmt.Errorf("get safe /proc/thread-self/fd handle: %w", err)
+	}
+	defer procFdDir.Close()
+	defer closer()
+
+	fdStr := strconv.Itoa(int(handle.Fd()))
+	if err := checkSymlinkOvermount(procRoot, procFdDir, fdStr); err != nil {
+		return fmt.Errorf("check safety of /proc/thread-self/fd/%s magiclink: %w", fdStr, err)
+	}
+	if err := unix.Fchmodat(int(procFdDir.Fd()), fdStr, mode, 0); err != nil {
+		return &os.PathError{Op: "chmod", Path: handle.Name(), Err: err}
+	}
+	return nil
+}
+
+// fchownHandle changes the owner of the inode referenced by handle (which may
+// be an O_PATH handle, including a handle to a symlink).
+func fchownHandle(handle *os.File, uid, gid int) error {
+	if err := unix.Fchownat(int(handle.Fd()), "", uid, gid, unix.AT_EMPTY_PATH); err != nil {
+		return &os.PathError{Op: "chown", Path: handle.Name(), Err: err}
+	}
+	return nil
+}
+
+// ChmodAllInRoot changes the mode of every inode in the tree at unsafePath
+// inside root (including unsafePath itself). fn is called for each inode and
+// returns the mode to set and whether the mode should be changed at all, which
+// allows callers to use different modes for files and directories.
+//
+// The tree is walked using file handles and symlinks are never followed
+// (including a trailing symlink in unsafePath). Because Linux does not support
+// changing the mode of symlinks, fn is not called for symlinks.
+func ChmodAllInRoot(root *os.File, unsafePath string, fn func(os.FileInfo) (os.FileMode, bool)) error {
+	err := walkInRoot(root, unsafePath, func(handle *os.File, _ string, info os.FileInfo) error {
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		mode, ok := fn(info)
+		if !ok || mode == info.Mode()&modePermExt {
+			return nil
+		}
+		unixMode, err := toUnixMode(mode)
+		if err != nil {
+			return err
+		}
+		return fchmodHandle(handle, unixMode)
+	})
+	if err != nil {
+		return &os.PathError{Op: "securejoin.ChmodAllInRoot", Path: unsafePath, Err: err}
+	}
+	return nil
+}
+
+// ChownAllInRoot changes the owner of every inode in the tree at unsafePath
+// inside root (including unsafePath itself). fn is called for each inode and
+// returns the uid and gid to set (as with [os.Chown], -1 leaves the value
+// unchanged) and whether the owner should be changed at all.
+//
+// The tree is walked using file handles and symlinks are never followed
+// (including a trailing symlink in unsafePath). fn is called for symlinks and
+// the owner of the symlink itself is changed -- callers that do not want to
+// change the owner of symlinks should return false for them.
+func ChownAllInRoot(root *os.File, unsafePath string, fn func(os.FileInfo) (uid, gid int, ok bool)) error {
+	err := walkInRoot(root, unsafePath, func(handle *os.File, _ string, info os.FileInfo) error {
+		uid, gid, ok := fn(info)
+		if !ok {
+			return nil
+		}
+		return fchownHandle(handle, uid, gid)
+	})
+	if err != nil {
+		return &os.PathError{Op: "securejoin.ChownAllInRoot", Path: unsafePath, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestChmodAllInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a ::700",
+			"dir a/b ::700",
+			"file a/file data ::600",
+			"file a/b/file data ::600",
+			"fifo a/b/fifo ::600",
+			"symlink a/b/link ../../target",
+			"file target data ::600",
+			"symlink link a",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		chmodFn := func(info os.FileInfo) (os.FileMode, bool) {
+			if info.IsDir() {
+				return 0o755, true
+			}
+			if info.Mode().Type() == os.ModeNamedPipe {
+				// Leave fifos alone.
+				return 0, false
+			}
+			return 0o644, true
+		}
+
+		// A trailing symlink must not be followed.
+		err = ChmodAllInRoot(rootDir, "link", chmodFn)
+		require.NoError(t, err, "ChmodAllInRoot(link)")
+		st, err := os.Stat(filepath.Join(root, "a"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o700), st.Mode().Perm(), "trailing symlink target should not be changed")
+
+		err = ChmodAllInRoot(rootDir, "a", chmodFn)
+		require.NoError(t, err, "ChmodAllInRoot(a)")
+
+		for subPath, expectedMode := range map[string]os.FileMode{
+			"a":        0o755,
+			"a/b":      0o755,
+			"a/file":   0o644,
+			"a/b/file": 0o644,
+			"a/b/fifo": 0o600,
+			// Symlinks must not be followed.
+			"target": 0o600,
+		} {
+			st, err := os.Lstat(filepath.Join(root, subPath))
+			require.NoError(t, err)
+			assert.Equalf(t, expectedMode, st.Mode().Perm(), "mode of %q", subPath)
+		}
+	})
+}
+
+func TestChownAllInRoot(t *testing.T) {
+	requireRoot(t) // chown
+
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a",
+			"dir a/b",
+			"file a/file",
+			"file a/b/file",
+			"symlink a/b/link ../../target",
+			"symlink a/b/skiplink ../../target",
+			"file target",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		err = ChownAllInRoot(rootDir, "a", func(info os.FileInfo) (int, int, bool) {
+			if info.Name() == "skiplink" {
+				return 0, 0, false
+			}
+			return 1000, 1001, true
+		})
+		require.NoError(t, err, "ChownAllInRoot(a)")
+
+		for subPath, expectedOwner := range map[string][2]uint32{
+			"a":            {1000, 1001},
+			"a/b":          {1000, 1001},
+			"a/file":       {1000, 1001},
+			"a/b/file":     {1000, 1001},
+			"a/b/link":     {1000, 1001},
+			"a/b/skiplink": {0, 0},
+			// Symlinks must not be followed.
+			"target": {0, 0},
+		} {
+			var st unix.Stat_t
+			require.NoError(t, unix.Lstat(filepath.Join(root, subPath), &st))
+			assert.Equalf(t, expectedOwner, [2]uint32{st.Uid, st.Gid}, "owner of %q", subPath)
+		}
+	})
+}
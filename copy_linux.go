@@ -0,0 +1,543 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CopyOptions controls the behaviour of [CopyTreeInRoot]. The zero value
+// copies symlinks as symlinks and does not preserve the owner, special mode
+// bits or extended attributes of the copied inodes (similar to "cp -r").
+type CopyOptions struct {
+	// Dereference causes symlinks in the source tree to be followed (the
+	// target is resolved inside the root), so that the target is copied
+	// rather than the symlink itself. Symlink loops result in an error
+	// wrapping ELOOP.
+	Dereference bool
+
+	// PreserveOwner causes the owner of each copied inode to be copied.
+	PreserveOwner bool
+
+	// PreserveMode causes the exact mode of each copied inode (including the
+	// setuid, setgid and sticky bits) to be copied, ignoring the process
+	// umask. Otherwise, inodes are created with the permission bits of the
+	// source inode (subject to the umask).
+	PreserveMode bool
+
+	// PreserveXattrs causes the extended attributes of each copied regular
+	// file and directory to be copied. All extended attributes that can be
+	// read are copied, including security.* attributes such as
+	// security.capability (which requires CAP_SETFCAP to set). The extended
+	// attributes are set after the file contents and owner have been copied
+	// (both of which would cause the kernel to clear security.capability),
+	// so file capabilities are preserved.
+	PreserveXattrs bool
+
+	// Filter, if non-nil, is called for each inode in the source tree before
+	// anything is created in the destination for that inode, with the path
+	// of the inode (relative to the source path) and the inode's metadata.
+	// If Filter returns false, the inode is skipped (and if it is a
+	// directory, so are its contents). An error returned by Filter aborts the
+	// copy. When Dereference is set, Filter is called with the metadata of
+	// the symlink target rather than the symlink itself.
+	Filter func(relPath string, info os.FileInfo) (bool, error)
+
+	// OnProgress, if non-nil, is called after each inode is copied with the
+	// path of the inode (relative to the source path) and the number of bytes
+	// of file data that were copied (which is 0 for non-regular files).
+	OnProgress func(relPath string, bytes int64)
+
+	// Hash, if non-nil, is used to construct a hash for each copied regular
+	// file. The hash is computed from the data as it is written to the
+	// destination file (rather than by reading the file afterwards, which
+	// could be racy), and the digest is passed to OnDigest.
+	Hash func() hash.Hash
+
+	// OnDigest, if non-nil, is called after each regular file is copied
+	// with the path of the file (relative to the source path) and the digest
+	// of its contents computed using Hash. Hardlinks to previously copied
+	// files are reported with the digest computed when the file was copied.
+	OnDigest func(relPath string, digest []byte)
+}
+
+// treeCopier contains the state of a single CopyTreeInRoot operation.
+type treeCopier struct {
+	root *os.File
+	opts CopyOptions
+
+	// dstTopKey is the inode of the top-level destination directory, which
+	// is skipped if found in the source tree (to avoid copying a directory
+	// into itself forever).
+	dstTopKey *inodeKey
+	// ancestors is the stack of source directories (keyed by the destination
+	// path) containing the current entry, used to detect symlink loops when
+	// dereferencing.
+	ancestors []copyAncestor
+	// hardlinks maps source inodes with more than one link to the
+	// destination path they were first copied to.
+	hardlinks map[inodeKey]string
+	// digests maps source inodes with more than one link to the digest
+	// computed when they were first copied (if Hash is set).
+	digests map[inodeKey][]byte
+	// dirModes contains the modes to apply to directories once their
+	// contents have been copied (if PreserveMode is set).
+	dirModes []copyDirMode
+}
+
+type copyAncestor struct {
+	dstPath string
+	key     inodeKey
+}
+
+type copyDirMode struct {
+	dstPath string
+	mode    uint32
+}
+
+// joinCopyPath appends subPath (as passed to a walkInRootFunc) to prefix,
+// without cleaning the resulting path (which could change its meaning).
+func joinCopyPath(prefix, subPath string) string {
+	if subPath == "." {
+		return prefix
+	}
+	return strings.TrimRight(prefix, "/") + "/" + subPath
+}
+
+// CopyTreeInRoot recursively copies the tree at unsafeSrcPath inside root to
+// unsafeDstPath (also inside root). The source tree is walked using file
+// handles in the same way as [ChmodAllInRoot] and every inode in the
+// destination is created using handles to its (confined) parent directory,
+// so an attacker cannot redirect either side of the copy outside of the root.
+//
+// Any missing parent directories of unsafeDstPath are created (with mode
+// 0o755). Directories which already exist in the destination are merged, but
+// an error wrapping EEXIST is returned if any other inode already exists.
+// Hardlinks within the source tree are preserved when possible, and are
+// copied if the link cannot be created (such as when the destination is on a
+// different filesystem to the first copy of the inode).
+//
+// See [CopyOptions] for more information about how the copy can be
+// configured.
+func CopyTreeInRoot(root *os.File, unsafeSrcPath, unsafeDstPath string, opts CopyOptions) error {
+	s := NewCopyTreeSession(root, unsafeSrcPath, unsafeDstPath, opts)
+	defer s.Close()
+
+	for {
+		if _, err := s.nextEntry(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return &os.LinkError{Op: "securejoin.CopyTreeInRoot", Old: unsafeSrcPath, New: unsafeDstPath, Err: err}
+		}
+	}
+}
+
+// copyTree copies the tree at srcPath to dstPath. relPrefix is the path of
+// srcPath relative to the top-level source path (used for OnProgress).
+func (c *treeCopier) copyTree(srcPath, dstPath, relPrefix string) error {
+	return walkInRoot(c.root, srcPath, func(handle *os.File, subPath string, info os.FileInfo) error {
+		relPath := subPath
+		if relPrefix != "" {
+			relPath = joinCopyPath(relPrefix, subPath)
+		}
+		return c.copyEntry(handle, joinCopyPath(srcPath, subPath), joinCopyPath(dstPath, subPath), relPath, info)
+	})
+}
+
+func (c *treeCopier) copyEntry(handle *os.File, srcPath, dstPath, relPath string, info os.FileInfo) error {
+	key, err := getInodeKey(info)
+	if err != nil {
+		return err
+	}
+	if c.dstTopKey != nil && key == *c.dstTopKey {
+		// Don't copy the destination into itself.
+		return fs.SkipDir
+	}
+	// When dereferencing, the filter is applied to the symlink target by the
+	// nested copyEntry or copyTree call.
+	isSymlink := info.Mode()&os.ModeSymlink != 0
+	if c.opts.Filter != nil && !(isSymlink && c.opts.Dereference) {
+		include, err := c.opts.Filter(relPath, info)
+		if err != nil {
+			return err
+		}
+		if !include {
+			if info.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+	}
+
+	var (
+		dst    *os.File
+		copied int64
+		digest []byte
+	)
+	switch mode := info.Mode(); {
+	case isSymlink:
+		if c.opts.Dereference {
+			return c.copyDereference(srcPath, dstPath, relPath)
+		}
+		dst, err = c.copySymlink(handle, dstPath)
+
+	case mode.IsDir():
+		for len(c.ancestors) > 0 && !strings.HasPrefix(dstPath, c.ancestors[len(c.ancestors)-1].dstPath+"/") {
+			c.ancestors = c.ancestors[:len(c.ancestors)-1]
+		}
+		for _, ancestor := range c.ancestors {
+			if ancestor.key == key {
+				return &os.PathError{Op: "copy", Path: srcPath, Err: unix.ELOOP}
+			}
+		}
+		c.ancestors = append(c.ancestors, copyAncestor{dstPath: dstPath, key: key})
+		dst, err = c.copyDir(dstPath, info)
+		if err == nil && c.dstTopKey == nil {
+			dstInfo, err := dst.Stat()
+			if err != nil {
+				_ = dst.Close()
+				return err
+			}
+			dstKey, err := getInodeKey(dstInfo)
+			if err != nil {
+				_ = dst.Close()
+				return err
+			}
+			c.dstTopKey = &dstKey
+		}
+
+	case mode.IsRegular():
+		dst, copied, digest, err = c.copyFile(handle, dstPath, info)
+
+	default:
+		dst, err = c.copySpecial(dstPath, info)
+	}
+	if err != nil {
+		return err
+	}
+	if dst != nil {
+		defer dst.Close()
+		if err := c.copyMetadata(handle, dst, dstPath, info); err != nil {
+			return err
+		}
+	}
+	if digest != nil && c.opts.OnDigest != nil {
+		c.opts.OnDigest(relPath, digest)
+	}
+	if c.opts.OnProgress != nil {
+		c.opts.OnProgress(relPath, copied)
+	}
+	return nil
+}
+
+// copyDereference copies the target of the symlink at srcPath (resolved
+// inside the root) to dstPath.
+func (c *treeCopier) copyDereference(srcPath, dstPath, relPath string) error {
+	target, err := OpenatInRoot(c.root, srcPath)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	targetInfo, err := target.Stat()
+	if err != nil {
+		return err
+	}
+	if targetInfo.IsDir() {
+		// Adding a trailing "/." makes walkInRoot follow the symlink.
+		return c.copyTree(srcPath+"/.", dstPath, relPath)
+	}
+	return c.copyEntry(target, srcPath, dstPath, relPath, targetInfo)
+}
+
+// openDstParent returns a handle to the (existing) parent directory of
+// dstPath along with the final component of dstPath.
+func (c *treeCopier) openDstParent(dstPath string) (*os.File, string, error) {
+	parent, name, err := openParentInRoot(c.root, dstPath)
+	if err != nil {
+		return nil, "", err
+	}
+	switch name {
+	case "", ".", "..":
+		_ = parent.Close()
+		return nil, "", &os.PathError{Op: "copy", Path: dstPath, Err: unix.EEXIST}
+	}
+	return parent, name, nil
+}
+
+func (c *treeCopier) copySymlink(handle *os.File, dstPath string) (*os.File, error) {
+	linkTarget, err := readlinkatFile(handle, "")
+	if err != nil {
+		return nil, err
+	}
+	parent, name, err := c.openDstParent(dstPath)
+	if err != nil {
+		return nil, err
+	}
+	defer parent.Close()
+	if err := unix.Symlinkat(linkTarget, int(parent.Fd()), name); err != nil {
+		return nil, &os.PathError{Op: "symlinkat", Path: parent.Name() + "/" + name, Err: err}
+	}
+	return openatFile(parent, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+}
+
+func (c *treeCopier) copyDir(dstPath string, info os.FileInfo) (*os.File, error) {
+	mode := info.Mode().Perm()
+	if c.opts.PreserveMode {
+		// Make sure we can create the contents of the directory. The real
+		// mode is applied after the contents have been copied.
+		mode = 0o700
+		unixMode, err := toUnixMode(info.Mode() & modePermExt)
+		if err != nil {
+			return nil, err
+		}
+		c.dirModes = append(c.dirModes, copyDirMode{dstPath: dstPath, mode: unixMode})
+	}
+	// MkdirAllHandle will return an error if dstPath exists and is not a
+	// directory. Note that MkdirAllHandle will follow a trailing symlink, so
+	// we need to check it ourselves.
+	dst, err := MkdirAllHandle(c.root, dstPath, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFinalComponent(c.root, dstPath, dst); err != nil {
+		_ = dst.Close()
+		return nil, err
+	}
+	return dst, nil
+}
+
+// copyFile copies the regular file referenced by handle to dstPath, returning
+// a handle to the new file along with the number of bytes copied and (if Hash
+// is set) the digest of the copied data.
+func (c *treeCopier) copyFile(handle *os.File, dstPath string, info os.FileInfo) (_ *os.File, _ int64, _ []byte, Err error) {
+	key, err := getInodeKey(info)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	st, err := getStat(info)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	hardlinked := st.Nlink > 1
+	if hardlinked {
+		if linkPath, ok := c.hardlinks[key]; ok {
+			dst, err := c.linkFile(linkPath, dstPath)
+			if err == nil {
+				return dst, 0, c.digests[key], nil
+			}
+			if !errors.Is(err, unix.EXDEV) {
+				return nil, 0, nil, err
+			}
+			// We can't hardlink across filesystems, so just copy the file.
+		} else {
+			c.hardlinks[key] = dstPath
+		}
+	}
+
+	src, err := Reopen(handle, unix.O_RDONLY)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer src.Close()
+
+	dst, err := CreateAllInRoot(c.root, dstPath, 0o755, info.Mode().Perm())
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer func() {
+		if Err != nil {
+			_ = dst.Close()
+		}
+	}()
+
+	var (
+		w io.Writer = dst
+		h hash.Hash
+	)
+	if c.opts.Hash != nil {
+		h = c.opts.Hash()
+		w = io.MultiWriter(dst, h)
+	}
+	n, err := io.Copy(w, src)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("copy %q: %w", dstPath, err)
+	}
+	var digest []byte
+	if h != nil {
+		digest = h.Sum(nil)
+		if hardlinked {
+			c.digests[key] = digest
+		}
+	}
+	return dst, n, digest, nil
+}
+
+// linkFile creates a hardlink at dstPath to the inode at linkPath. The
+// returned handle is always nil, as the metadata of the inode has already been
+// copied.
+func (c *treeCopier) linkFile(linkPath, dstPath string) (*os.File, error) {
+	oldParent, oldName, err := c.openDstParent(linkPath)
+	if err != nil {
+		return nil, err
+	}
+	defer oldParent.Close()
+	newParent, newName, err := c.openDstParent(dstPath)
+	if err != nil {
+		return nil, err
+	}
+	defer newParent.Close()
+	if err := unix.Linkat(int(oldParent.Fd()), oldName, int(newParent.Fd()), newName, 0); err != nil {
+		return nil, &os.LinkError{Op: "linkat", Old: oldParent.Name() + "/" + oldName, New: newParent.Name() + "/" + newName, Err: err}
+	}
+	return nil, nil
+}
+
+func (c *treeCopier) copySpecial(dstPath string, info os.FileInfo) (*os.File, error) {
+	st, err := getStat(info)
+	if err != nil {
+		return nil, err
+	}
+	parent, name, err := c.openDstParent(dstPath)
+	if err != nil {
+		return nil, err
+	}
+	defer parent.Close()
+	mode := uint32(st.Mode) & (unix.S_IFMT | 0o777)
+	if err := unix.Mknodat(int(parent.Fd()), name, mode, int(st.Rdev)); err != nil {
+		return nil, &os.PathError{Op: "mknodat", Path: parent.Name() + "/" + name, Err: err}
+	}
+	return openatFile(parent, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+}
+
+// copyMetadata copies the requested metadata from src to dst (both of which
+// may be O_PATH handles).
+func (c *treeCopier) copyMetadata(src, dst *os.File, dstPath string, info os.FileInfo) error {
+	st, err := getStat(info)
+	if err != nil {
+		return err
+	}
+	if c.opts.PreserveOwner {
+		if err := fchownHandle(dst, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	if c.opts.PreserveXattrs && (info.Mode().IsRegular() || info.IsDir()) {
+		// We need a proper handle to use f*xattr(2), and the handles are
+		// guaranteed to be directories or regular files at this point.
+		if err := withReadableHandle(src, func(src *os.File) error {
+			return withReadableHandle(dst, func(dst *os.File) error {
+				return copyXattrs(src, dst)
+			})
+		}); err != nil {
+			return err
+		}
+	}
+	// Directory modes are applied after their contents have been copied,
+	// and the mode of symlinks cannot be changed.
+	if c.opts.PreserveMode && !info.IsDir() && info.Mode()&os.ModeSymlink == 0 {
+		unixMode, err := toUnixMode(info.Mode() & modePermExt)
+		if err != nil {
+			return err
+		}
+		if err := fchmodHandle(dst, unixMode); err != nil {
+			return fmt.Errorf("chmod %q: %w", dstPath, err)
+		}
+	}
+	return nil
+}
+
+func (c *treeCopier) chmodPath(dstPath string, mode uint32) error {
+	dst, err := OpenatInRoot(c.root, dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	return fchmodHandle(dst, mode)
+}
+
+// withReadableHandle calls fn with a non-O_PATH handle to the same inode as
+// handle (which must be a directory or regular file).
+func withReadableHandle(handle *os.File, fn func(*os.File) error) error {
+	flags, err := unix.FcntlInt(handle.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		return os.NewSyscallError("fcntl(F_GETFL)", err)
+	}
+	if flags&unix.O_PATH == 0 {
+		return fn(handle)
+	}
+	readable, err := Reopen(handle, unix.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer readable.Close()
+	return fn(readable)
+}
+
+// copyXattrs copies all of the extended attributes of src to dst.
+func copyXattrs(src, dst *os.File) error {
+	names, err := flistxattr(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, err := fgetxattr(src, name)
+		if err != nil {
+			return err
+		}
+		if err := unix.Fsetxattr(int(dst.Fd()), name, value, 0); err != nil {
+			return &os.PathError{Op: "fsetxattr " + name, Path: dst.Name(), Err: err}
+		}
+	}
+	return nil
+}
+
+func flistxattr(f *os.File) ([]string, error) {
+	size := 256
+	for {
+		buf := make([]byte, size)
+		n, err := unix.Flistxattr(int(f.Fd()), buf)
+		if errors.Is(err, unix.ERANGE) {
+			size *= 4
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "flistxattr", Path: f.Name(), Err: err}
+		}
+		var names []string
+		for _, name := range strings.Split(string(buf[:n]), "\x00") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+}
+
+func fgetxattr(f *os.File, name string) ([]byte, error) {
+	size := 256
+	for {
+		buf := make([]byte, size)
+		n, err := unix.Fgetxattr(int(f.Fd()), name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			size *= 4
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "fgetxattr " + name, Path: f.Name(), Err: err}
+		}
+		return buf[:n], nil
+	}
+}
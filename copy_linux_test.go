@@ -0,0 +1,457 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// treeEntry is a simplified description of an inode, used to compare trees.
+type treeEntry struct {
+	Mode    os.FileMode
+	Content string // file contents or symlink target
+}
+
+// readTree returns a description of every inode in the tree at dir.
+func readTree(t *testing.T, dir string) map[string]treeEntry {
+	tree := map[string]treeEntry{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		entry := treeEntry{Mode: info.Mode()}
+		switch {
+		case info.Mode().IsRegular():
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			entry.Content = string(content)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			entry.Content = target
+		}
+		tree[relPath] = entry
+		return nil
+	})
+	require.NoErrorf(t, err, "read tree %q", dir)
+	return tree
+}
+
+func TestCopyTreeInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir src/a/b",
+			"file src/file hello",
+			"file src/a/b/file world",
+			"symlink src/a/link ../file",
+			"symlink src/a/abs /src/a/b",
+			"symlink src/escape ../../../../../../etc/passwd",
+			"fifo src/a/fifo",
+			"dir src/empty ::700",
+			"dir dst",
+			"symlink dst-link ../../../../../dst",
+		}
+
+		for _, test := range []struct {
+			name, srcPath, dstPath string
+			expectedDst            string
+		}{
+			{"basic", "src", "dst", "dst"},
+			{"nested-dst", "src", "x/y/dst", "x/y/dst"},
+			{"symlink-dst-parent", "src", "dst-link/sub", "dst/sub"},
+			{"subdir", "src/a", "dst", "dst"},
+			{"file", "src/file", "new", "new"},
+			{"symlink", "src/a/link", "new", "new"},
+		} {
+			test := test // copy iterator
+			t.Run(test.name, func(t *testing.T) {
+				root := createTree(t, tree...)
+
+				rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+				require.NoError(t, err)
+				defer rootDir.Close()
+
+				err = CopyTreeInRoot(rootDir, test.srcPath, test.dstPath, CopyOptions{})
+				require.NoError(t, err)
+
+				srcTree := readTree(t, filepath.Join(root, test.srcPath))
+				dstTree := readTree(t, filepath.Join(root, test.expectedDst))
+				assert.Equal(t, srcTree, dstTree, "copied tree should match source tree")
+			})
+		}
+	})
+}
+
+func TestCopyTreeInRoot_Dereference(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t,
+			"dir src/a",
+			"dir target",
+			"file target/file hello",
+			"symlink src/file-link /target/file",
+			"symlink src/dir-link ../../../../target",
+			"symlink src/a/escape ../../../../../../target/file",
+		)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		err = CopyTreeInRoot(rootDir, "src", "dst", CopyOptions{Dereference: true})
+		require.NoError(t, err)
+
+		file := treeEntry{Mode: 0o644, Content: "hello"}
+		dir := treeEntry{Mode: os.ModeDir | 0o755}
+		assert.Equal(t, map[string]treeEntry{
+			".":             dir,
+			"a":             dir,
+			"a/escape":      file,
+			"dir-link":      dir,
+			"dir-link/file": file,
+			"file-link":     file,
+		}, readTree(t, filepath.Join(root, "dst")), "dereferenced copy")
+	})
+}
+
+func TestCopyTreeInRoot_Loop(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t,
+			"dir src/a/b",
+			"symlink src/a/b/loop ../..",
+		)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		// Without dereferencing, the loop is copied as a symlink.
+		err = CopyTreeInRoot(rootDir, "src", "dst1", CopyOptions{})
+		require.NoError(t, err)
+		target, err := os.Readlink(filepath.Join(root, "dst1/a/b/loop"))
+		require.NoError(t, err)
+		assert.Equal(t, "../..", target, "copied symlink target")
+
+		err = CopyTreeInRoot(rootDir, "src", "dst2", CopyOptions{Dereference: true})
+		assert.ErrorIs(t, err, unix.ELOOP, "dereferencing a symlink loop")
+	})
+}
+
+func TestCopyTreeInRoot_IntoSelf(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t,
+			"dir src/a",
+			"file src/a/file hello",
+		)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		err = CopyTreeInRoot(rootDir, "src", "src/copy", CopyOptions{})
+		require.NoError(t, err)
+
+		file := treeEntry{Mode: 0o644, Content: "hello"}
+		dir := treeEntry{Mode: os.ModeDir | 0o755}
+		assert.Equal(t, map[string]treeEntry{
+			".":      dir,
+			"a":      dir,
+			"a/file": file,
+		}, readTree(t, filepath.Join(root, "src/copy")), "copy should not include itself")
+	})
+}
+
+func TestCopyTreeInRoot_Existing(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t,
+			"dir src/a",
+			"file src/a/file hello",
+			"file src/other world",
+			"dir dst/a",
+			"file dst/a/file old",
+		)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		err = CopyTreeInRoot(rootDir, "src", "dst", CopyOptions{})
+		assert.ErrorIs(t, err, unix.EEXIST, "copying over an existing file")
+
+		content, err := os.ReadFile(filepath.Join(root, "dst/a/file"))
+		require.NoError(t, err)
+		assert.Equal(t, "old", string(content), "existing file should not be modified")
+	})
+}
+
+func TestCopyTreeInRoot_Hardlinks(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t,
+			"dir src/a",
+			"file src/file hello",
+		)
+		require.NoError(t, os.Link(filepath.Join(root, "src/file"), filepath.Join(root, "src/a/link")))
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		err = CopyTreeInRoot(rootDir, "src", "dst", CopyOptions{})
+		require.NoError(t, err)
+
+		var srcSt, dstFileSt, dstLinkSt unix.Stat_t
+		require.NoError(t, unix.Lstat(filepath.Join(root, "src/file"), &srcSt))
+		require.NoError(t, unix.Lstat(filepath.Join(root, "dst/file"), &dstFileSt))
+		require.NoError(t, unix.Lstat(filepath.Join(root, "dst/a/link"), &dstLinkSt))
+		assert.NotEqual(t, srcSt.Ino, dstFileSt.Ino, "copy should be a new inode")
+		assert.Equal(t, dstFileSt.Ino, dstLinkSt.Ino, "hardlinks should be preserved in the copy")
+		assert.EqualValues(t, 2, dstFileSt.Nlink, "nlink of copied hardlink")
+	})
+}
+
+func TestCopyTreeInRoot_PreserveMode(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t,
+			"dir src/ro ::555",
+			"file src/ro/file hello ::400",
+			"file src/setuid hello ::4755",
+			"dir src/sticky ::1777",
+		)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		err = CopyTreeInRoot(rootDir, "src", "dst", CopyOptions{PreserveMode: true})
+		require.NoError(t, err)
+
+		srcTree := readTree(t, filepath.Join(root, "src"))
+		dstTree := readTree(t, filepath.Join(root, "dst"))
+		assert.Equal(t, srcTree, dstTree, "copied tree should match source tree")
+		assert.Equal(t, os.ModeSetuid|0o755, dstTree["setuid"].Mode, "setuid mode should be copied")
+		assert.Equal(t, os.ModeDir|os.ModeSticky|0o777, dstTree["sticky"].Mode, "sticky mode should be copied")
+	})
+}
+
+func TestCopyTreeInRoot_PreserveOwner(t *testing.T) {
+	requireRoot(t) // chown
+
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t,
+			"dir src/a 1000:1001:755",
+			"file src/a/file hello 1002:1003:644",
+			"symlink src/a/link file",
+		)
+		require.NoError(t, os.Lchown(filepath.Join(root, "src/a/link"), 1004, 1005))
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		err = CopyTreeInRoot(rootDir, "src", "dst", CopyOptions{PreserveOwner: true})
+		require.NoError(t, err)
+
+		for _, subPath := range []string{"a", "a/file", "a/link"} {
+			var srcSt, dstSt unix.Stat_t
+			require.NoError(t, unix.Lstat(filepath.Join(root, "src", subPath), &srcSt))
+			require.NoError(t, unix.Lstat(filepath.Join(root, "dst", subPath), &dstSt))
+			assert.Equalf(t, srcSt.Uid, dstSt.Uid, "uid of %q", subPath)
+			assert.Equalf(t, srcSt.Gid, dstSt.Gid, "gid of %q", subPath)
+		}
+	})
+}
+
+func TestCopyTreeInRoot_PreserveXattrs(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t,
+			"dir src/a",
+			"file src/a/file hello",
+		)
+		for _, subPath := range []string{"a", "a/file"} {
+			err := unix.Setxattr(filepath.Join(root, "src", subPath), "user.securejoin", []byte(subPath), 0)
+			if errors.Is(err, unix.ENOTSUP) {
+				t.Skip("user xattrs not supported on test filesystem")
+			}
+			require.NoError(t, err)
+		}
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		err = CopyTreeInRoot(rootDir, "src", "dst", CopyOptions{PreserveXattrs: true})
+		require.NoError(t, err)
+
+		for _, subPath := range []string{"a", "a/file"} {
+			buf := make([]byte, 256)
+			n, err := unix.Getxattr(filepath.Join(root, "dst", subPath), "user.securejoin", buf)
+			if assert.NoErrorf(t, err, "get xattr of %q", subPath) {
+				assert.Equalf(t, subPath, string(buf[:n]), "xattr value of %q", subPath)
+			}
+		}
+	})
+}
+
+func TestCopyTreeInRoot_OnProgress(t *testing.T) {
+	root := createTree(t,
+		"dir src/a",
+		"file src/a/file hello",
+		"file src/other world!",
+		"symlink src/link a/file",
+	)
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	progress := map[string]int64{}
+	err = CopyTreeInRoot(rootDir, "src", "dst", CopyOptions{
+		OnProgress: func(relPath string, bytes int64) {
+			_, exists := progress[relPath]
+			assert.Falsef(t, exists, "OnProgress called twice for %q", relPath)
+			progress[relPath] = bytes
+		},
+	})
+	require.NoError(t, err)
+
+	var paths []string
+	for path := range progress {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{".", "a", "a/file", "link", "other"}, paths, "OnProgress paths")
+	assert.EqualValues(t, 5, progress["a/file"], "bytes copied for a/file")
+	assert.EqualValues(t, 6, progress["other"], "bytes copied for other")
+	assert.EqualValues(t, 0, progress["link"], "bytes copied for symlink")
+}
+
+func TestCopyTreeInRoot_Filter(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t,
+			"dir src/keep",
+			"file src/keep/file hello",
+			"file src/keep/skip.tmp",
+			"dir src/skipdir",
+			"file src/skipdir/file",
+			"symlink src/link keep/file",
+			"symlink src/deref-skip skipdir",
+		)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		var (
+			filtered []string
+			progress []string
+		)
+		err = CopyTreeInRoot(rootDir, "src", "dst", CopyOptions{
+			Filter: func(relPath string, info os.FileInfo) (bool, error) {
+				filtered = append(filtered, relPath)
+				// Nothing should have been created for this entry yet.
+				_, err := os.Lstat(filepath.Join(root, "dst", relPath))
+				assert.ErrorIsf(t, err, os.ErrNotExist, "%q created before Filter was called", relPath)
+				return !strings.HasSuffix(relPath, ".tmp") && relPath != "skipdir" && relPath != "deref-skip", nil
+			},
+			OnProgress: func(relPath string, _ int64) {
+				progress = append(progress, relPath)
+			},
+		})
+		require.NoError(t, err)
+
+		sort.Strings(filtered)
+		assert.Equal(t, []string{".", "deref-skip", "keep", "keep/file", "keep/skip.tmp", "link", "skipdir"}, filtered, "Filter paths")
+		sort.Strings(progress)
+		assert.Equal(t, []string{".", "keep", "keep/file", "link"}, progress, "OnProgress paths")
+		var copied []string
+		for path := range readTree(t, filepath.Join(root, "dst")) {
+			copied = append(copied, path)
+		}
+		sort.Strings(copied)
+		assert.Equal(t, []string{".", "keep", "keep/file", "link"}, copied, "copied paths")
+	})
+}
+
+func TestCopyTreeInRoot_FilterError(t *testing.T) {
+	root := createTree(t,
+		"dir src/a",
+		"file src/a/file",
+	)
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	errFilter := errors.New("filter error")
+	err = CopyTreeInRoot(rootDir, "src", "dst", CopyOptions{
+		Filter: func(relPath string, _ os.FileInfo) (bool, error) {
+			if relPath == "a/file" {
+				return false, errFilter
+			}
+			return true, nil
+		},
+	})
+	assert.ErrorIs(t, err, errFilter, "Filter error should be returned")
+	_, err = os.Lstat(filepath.Join(root, "dst/a/file"))
+	assert.ErrorIs(t, err, os.ErrNotExist, "rejected entry should not be created")
+}
+
+func TestCopyTreeInRoot_Hash(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t,
+			"dir src/a",
+			"file src/a/file hello",
+			"file src/empty",
+			"symlink src/link a/file",
+		)
+		require.NoError(t, os.Link(filepath.Join(root, "src/a/file"), filepath.Join(root, "src/hardlink")))
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		digests := map[string]string{}
+		err = CopyTreeInRoot(rootDir, "src", "dst", CopyOptions{
+			Hash: sha256.New,
+			OnDigest: func(relPath string, digest []byte) {
+				_, exists := digests[relPath]
+				assert.Falsef(t, exists, "OnDigest called twice for %q", relPath)
+				digests[relPath] = hex.EncodeToString(digest)
+			},
+		})
+		require.NoError(t, err)
+
+		sum := func(data string) string {
+			digest := sha256.Sum256([]byte(data))
+			return hex.EncodeToString(digest[:])
+		}
+		// Only regular files should have digests.
+		assert.Equal(t, map[string]string{
+			"a/file":   sum("hello"),
+			"empty":    sum(""),
+			"hardlink": sum("hello"),
+		}, digests, "digests of copied files")
+	})
+}
@@ -0,0 +1,330 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CopyTreeSession is a step-by-step version of [CopyTreeInRoot], which copies
+// a single inode each time [CopyTreeSession.Next] is called. This allows very
+// large copies to be driven incrementally (such as from a job queue), and for
+// an interrupted copy to be continued later using [CopyTreeSession.Resume].
+//
+// The source tree is walked in the same order as [CopyTreeInRoot]
+// (directories are copied before their contents, and the entries of each
+// directory are copied in lexical order), and every step uses the same
+// confined primitives. When [CopyOptions.PreserveMode] is set, the mode of
+// each directory is applied once all of its contents have been copied. Note
+// that when [CopyOptions.Dereference] is set, a symlink to a directory is
+// copied (along with all of its contents) in a single step.
+//
+// A CopyTreeSession must not be used concurrently, and must be closed with
+// [CopyTreeSession.Close] once it is no longer needed.
+type CopyTreeSession struct {
+	c                *treeCopier
+	srcPath, dstPath string
+
+	started bool
+	stack   []*copyFrame
+	// resumeToken is the path of the last entry copied by a previous
+	// session, and is cleared once the walk has passed it.
+	resumeToken string
+	token       string
+	err         error
+}
+
+// copyFrame is a source directory whose entries are still being copied.
+type copyFrame struct {
+	// handle is an O_PATH handle to the source directory.
+	handle  *os.File
+	subPath string
+	names   []string
+	// dirMode is the mode to apply to the destination directory once all of
+	// its entries have been copied (if PreserveMode is set).
+	dirMode *uint32
+}
+
+// NewCopyTreeSession creates a new [CopyTreeSession] to copy the tree at
+// unsafeSrcPath inside root to unsafeDstPath (also inside root), with the
+// same semantics as [CopyTreeInRoot]. Nothing is copied until
+// [CopyTreeSession.Next] is called.
+func NewCopyTreeSession(root *os.File, unsafeSrcPath, unsafeDstPath string, opts CopyOptions) *CopyTreeSession {
+	return &CopyTreeSession{
+		c: &treeCopier{
+			root:      root,
+			opts:      opts,
+			hardlinks: map[inodeKey]string{},
+			digests:   map[inodeKey][]byte{},
+		},
+		srcPath: unsafeSrcPath,
+		dstPath: unsafeDstPath,
+	}
+}
+
+// Resume configures the session to skip every entry up to (and including)
+// the entry identified by token, which must have been returned by
+// [CopyTreeSession.Token] in a previous session copying the same tree.
+// Directories containing the skipped entries are still walked (but are not
+// copied again). Resume must be called before the first call to
+// [CopyTreeSession.Next].
+//
+// Entries copied before the interruption are not revisited, so hardlinks to
+// them are copied as separate files. If the previous session was interrupted
+// while an entry was being copied, that entry will be copied again (which
+// will fail with an error wrapping EEXIST unless the partial copy is removed
+// first).
+func (s *CopyTreeSession) Resume(token string) error {
+	if s.started {
+		return &os.LinkError{Op: "securejoin.CopyTreeSession", Old: s.srcPath, New: s.dstPath, Err: fmt.Errorf("cannot resume a session that has already started: %w", unix.EINVAL)}
+	}
+	s.resumeToken = token
+	s.token = token
+	return nil
+}
+
+// Token returns a token identifying the last entry that was copied by the
+// session (or the token passed to [CopyTreeSession.Resume] if nothing has
+// been copied yet), which can be passed to [CopyTreeSession.Resume] to
+// continue the copy later. The token is the path of the entry relative to the
+// source path, and is empty if nothing has been copied.
+func (s *CopyTreeSession) Token() string {
+	return s.token
+}
+
+// Next copies the next entry in the source tree, and returns its path
+// (relative to the source path). Entries which are excluded by
+// [CopyOptions.Filter] are still returned. Once the entire tree has been
+// copied, [io.EOF] is returned.
+//
+// If an error occurs, the session cannot be continued and all subsequent
+// calls return the same error. [CopyTreeSession.Token] can be used to resume
+// the copy with a new session.
+func (s *CopyTreeSession) Next() (string, error) {
+	relPath, err := s.nextEntry()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", io.EOF
+		}
+		return "", &os.LinkError{Op: "securejoin.CopyTreeSession", Old: s.srcPath, New: s.dstPath, Err: err}
+	}
+	return relPath, nil
+}
+
+// Close releases the resources held by the session. It is safe to call Close
+// multiple times.
+func (s *CopyTreeSession) Close() error {
+	for _, frame := range s.stack {
+		_ = frame.handle.Close()
+	}
+	s.stack = nil
+	return nil
+}
+
+func (s *CopyTreeSession) nextEntry() (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	relPath, err := s.step()
+	if err != nil {
+		s.err = err
+		_ = s.Close()
+		return "", err
+	}
+	s.token = relPath
+	return relPath, nil
+}
+
+// step copies the next entry, returning io.EOF once the walk is complete.
+func (s *CopyTreeSession) step() (string, error) {
+	if !s.started {
+		s.started = true
+		handle, err := s.start()
+		if err != nil {
+			return "", err
+		}
+		processed, err := s.visit(handle, ".")
+		if err != nil || processed {
+			return ".", err
+		}
+	}
+	for len(s.stack) > 0 {
+		frame := s.stack[len(s.stack)-1]
+		if len(frame.names) == 0 {
+			if err := s.popFrame(); err != nil {
+				return "", err
+			}
+			continue
+		}
+		name := frame.names[0]
+		frame.names = frame.names[1:]
+
+		child, err := openatFile(frame.handle, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			// The entry was removed while we were walking.
+			if errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return "", err
+		}
+		subPath := path.Join(frame.subPath, name)
+		processed, err := s.visit(child, subPath)
+		if err != nil {
+			return "", err
+		}
+		if processed {
+			return subPath, nil
+		}
+	}
+	return "", io.EOF
+}
+
+// start creates the parent of the destination and returns a handle to the
+// top of the source tree.
+func (s *CopyTreeSession) start() (*os.File, error) {
+	dstParentPath, _ := splitParentPath(s.dstPath)
+	dstParent, err := MkdirAllHandle(s.c.root, dstParentPath, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	_ = dstParent.Close()
+
+	if s.resumeToken != "" {
+		// The destination directory was created by the previous session, so
+		// we need to make sure it isn't copied into itself.
+		if dst, err := openNoFollowInRoot(s.c.root, s.dstPath); err == nil {
+			if dstInfo, err := dst.Stat(); err == nil && dstInfo.IsDir() {
+				if dstKey, err := getInodeKey(dstInfo); err == nil {
+					s.c.dstTopKey = &dstKey
+				}
+			}
+			_ = dst.Close()
+		}
+	}
+	return openNoFollowInRoot(s.c.root, s.srcPath)
+}
+
+// visit copies the entry referenced by handle (taking ownership of handle),
+// and returns whether an entry was processed (rather than skipped because it
+// was copied by a previous session).
+func (s *CopyTreeSession) visit(handle *os.File, subPath string) (bool, error) {
+	pushed := false
+	defer func() {
+		if !pushed {
+			_ = handle.Close()
+		}
+	}()
+
+	info, err := handle.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	if s.resumeToken != "" {
+		if walkOrderBefore(subPath, s.resumeToken) {
+			// This entry was already copied, but we need to walk into any
+			// directories containing the resume point.
+			if info.IsDir() && (subPath == "." || subPath == s.resumeToken || strings.HasPrefix(s.resumeToken, subPath+"/")) {
+				pushed = true
+				return false, s.pushFrame(handle, subPath, info)
+			}
+			return false, nil
+		}
+		s.resumeToken = ""
+	}
+
+	c := s.c
+	oldDirModes := len(c.dirModes)
+	err = c.copyEntry(handle, joinCopyPath(s.srcPath, subPath), joinCopyPath(s.dstPath, subPath), subPath, info)
+	switch {
+	case errors.Is(err, fs.SkipDir):
+		if !info.IsDir() && len(s.stack) > 0 {
+			// Skip the rest of the parent directory.
+			s.stack[len(s.stack)-1].names = nil
+		}
+		return true, nil
+	case err != nil:
+		return false, err
+	}
+
+	if info.IsDir() {
+		// The mode of the directory is applied once we pop the frame.
+		c.dirModes = c.dirModes[:oldDirModes]
+		pushed = true
+		return true, s.pushFrame(handle, subPath, info)
+	}
+	// Any directories copied by a dereferenced symlink are complete, so
+	// apply their modes in reverse order (in the same way as CopyTreeInRoot).
+	for i := len(c.dirModes) - 1; i >= oldDirModes; i-- {
+		dirMode := c.dirModes[i]
+		if err := c.chmodPath(dirMode.dstPath, dirMode.mode); err != nil {
+			return false, err
+		}
+	}
+	c.dirModes = c.dirModes[:oldDirModes]
+	return true, nil
+}
+
+// pushFrame adds the source directory referenced by handle to the walk stack.
+// The handle is owned by the stack, even if an error is returned.
+func (s *CopyTreeSession) pushFrame(handle *os.File, subPath string, info os.FileInfo) error {
+	frame := &copyFrame{handle: handle, subPath: subPath}
+	s.stack = append(s.stack, frame)
+
+	if s.c.opts.PreserveMode {
+		unixMode, err := toUnixMode(info.Mode() & modePermExt)
+		if err != nil {
+			return err
+		}
+		frame.dirMode = &unixMode
+	}
+	names, err := readDirNames(handle)
+	if err != nil {
+		return err
+	}
+	frame.names = names
+	return nil
+}
+
+// popFrame removes the top directory from the walk stack, applying its mode
+// to the destination directory.
+func (s *CopyTreeSession) popFrame() error {
+	frame := s.stack[len(s.stack)-1]
+	s.stack = s.stack[:len(s.stack)-1]
+	_ = frame.handle.Close()
+	if frame.dirMode != nil {
+		return s.c.chmodPath(joinCopyPath(s.dstPath, frame.subPath), *frame.dirMode)
+	}
+	return nil
+}
+
+// walkOrderBefore returns whether the entry at subPath a is copied before the
+// entry at subPath b by a CopyTreeSession (or is the same entry).
+func walkOrderBefore(a, b string) bool {
+	if a == "." || a == b {
+		return true
+	}
+	if b == "." {
+		return false
+	}
+	aParts, bParts := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if aParts[i] != bParts[i] {
+			return aParts[i] < bParts[i]
+		}
+	}
+	// Parent directories are copied before their contents.
+	return len(aParts) <= len(bParts)
+}
@@ -0,0 +1,162 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+var copySessionTree = []string{
+	"dir src/a/b",
+	"file src/a/b/file hello",
+	"file src/a/c world",
+	"dir src/ro ::555",
+	"file src/ro/file hello ::400",
+	"symlink src/link a/c",
+	"file src/z last",
+}
+
+// The order in which copySessionTree is copied.
+var copySessionOrder = []string{".", "a", "a/b", "a/b/file", "a/c", "link", "ro", "ro/file", "z"}
+
+// drainCopyTreeSession calls Next until the session is complete, returning the
+// paths of the copied entries.
+func drainCopyTreeSession(t *testing.T, s *CopyTreeSession) []string {
+	var paths []string
+	for {
+		relPath, err := s.Next()
+		if errors.Is(err, io.EOF) {
+			return paths
+		}
+		require.NoError(t, err, "CopyTreeSession.Next")
+		paths = append(paths, relPath)
+		assert.Equal(t, relPath, s.Token(), "CopyTreeSession.Token should be the last copied path")
+	}
+}
+
+func TestCopyTreeSession(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t, copySessionTree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		s := NewCopyTreeSession(rootDir, "src", "dst", CopyOptions{PreserveMode: true})
+		defer s.Close()
+
+		paths := drainCopyTreeSession(t, s)
+		assert.Equal(t, copySessionOrder, paths, "copied paths")
+
+		_, err = s.Next()
+		assert.ErrorIs(t, err, io.EOF, "Next after completion")
+		assert.ErrorIs(t, s.Resume(""), unix.EINVAL, "Resume after starting")
+
+		srcTree := readTree(t, filepath.Join(root, "src"))
+		dstTree := readTree(t, filepath.Join(root, "dst"))
+		assert.Equal(t, srcTree, dstTree, "copied tree should match source tree")
+	})
+}
+
+func TestCopyTreeSession_Resume(t *testing.T) {
+	for i := 0; i < len(copySessionOrder); i++ {
+		stopAfter := copySessionOrder[i]
+		t.Run(stopAfter, func(t *testing.T) {
+			root := createTree(t, copySessionTree...)
+
+			rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+			require.NoError(t, err)
+			defer rootDir.Close()
+
+			// Copy some of the tree, then abandon the session.
+			s := NewCopyTreeSession(rootDir, "src", "dst", CopyOptions{PreserveMode: true})
+			var copied []string
+			for {
+				relPath, err := s.Next()
+				require.NoError(t, err, "CopyTreeSession.Next")
+				copied = append(copied, relPath)
+				if relPath == stopAfter {
+					break
+				}
+			}
+			token := s.Token()
+			_ = s.Close()
+			assert.Equal(t, stopAfter, token, "token of interrupted session")
+
+			// Resume the copy with a new session.
+			s = NewCopyTreeSession(rootDir, "src", "dst", CopyOptions{PreserveMode: true})
+			defer s.Close()
+			require.NoError(t, s.Resume(token), "CopyTreeSession.Resume")
+			resumed := drainCopyTreeSession(t, s)
+
+			assert.Equal(t, copySessionOrder, append(copied, resumed...), "copied paths across both sessions")
+
+			srcTree := readTree(t, filepath.Join(root, "src"))
+			dstTree := readTree(t, filepath.Join(root, "dst"))
+			assert.Equal(t, srcTree, dstTree, "copied tree should match source tree")
+		})
+	}
+}
+
+func TestCopyTreeSession_Error(t *testing.T) {
+	root := createTree(t, "dir src/a", "file src/a/file", "dir dst/a", "file dst/a/file")
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	s := NewCopyTreeSession(rootDir, "src", "dst", CopyOptions{})
+	defer s.Close()
+
+	for _, expected := range []string{".", "a"} {
+		relPath, err := s.Next()
+		require.NoError(t, err, "CopyTreeSession.Next")
+		assert.Equal(t, expected, relPath, "copied path")
+	}
+
+	_, err = s.Next()
+	assert.ErrorIs(t, err, unix.EEXIST, "copy onto existing file")
+	var linkErr *os.LinkError
+	if assert.ErrorAs(t, err, &linkErr) {
+		assert.Equal(t, "securejoin.CopyTreeSession", linkErr.Op, "*os.LinkError op")
+	}
+	assert.Equal(t, "a", s.Token(), "token should not include failed entry")
+
+	// The error is sticky.
+	_, err2 := s.Next()
+	assert.Equal(t, err, err2, "Next after error")
+}
+
+func TestWalkOrderBefore(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		expected bool
+	}{
+		{".", ".", true},
+		{".", "a", true},
+		{"a", ".", false},
+		{"a", "a", true},
+		{"a", "a/b", true},
+		{"a/b", "a", false},
+		{"a/z", "b", true},
+		{"b", "a/z", false},
+		// Entries are compared component-wise, so a directory's contents
+		// are copied before its siblings.
+		{"a/b", "a-b", true},
+		{"a-b", "a/b", false},
+	} {
+		assert.Equalf(t, test.expected, walkOrderBefore(test.a, test.b), "walkOrderBefore(%q, %q)", test.a, test.b)
+	}
+}
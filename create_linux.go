@@ -0,0 +1,99 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CreateAllInRoot creates a new regular file at unsafePath inside root with
+// the given mode, first creating any missing parent directories with
+// [MkdirAllHandle] (using dirMode). The handle to the parent directory
+// returned by [MkdirAllHandle] is used to create the file, so unsafePath is
+// only resolved once. The new file is returned opened O_RDWR.
+//
+// The file is created with O_CREAT|O_EXCL|O_NOFOLLOW, so an error wrapping
+// EEXIST is returned if anything (including a dangling symlink) already
+// exists at unsafePath. As with [os.OpenFile], fileMode is subject to the
+// process umask.
+func CreateAllInRoot(root *os.File, unsafePath string, dirMode, fileMode os.FileMode) (*os.File, error) {
+	parentPath, finalComponent := splitParentPath(unsafePath)
+	switch {
+	case strings.HasSuffix(unsafePath, "/"), finalComponent == "", finalComponent == ".", finalComponent == "..":
+		// We can only create regular files, so paths which can only refer to
+		// directories are not permitted.
+		return nil, &os.PathError{Op: "securejoin.CreateAllInRoot", Path: unsafePath, Err: unix.EISDIR}
+	}
+
+	unixMode, err := toUnixMode(fileMode)
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.CreateAllInRoot", Path: unsafePath, Err: err}
+	}
+
+	parent, err := MkdirAllHandle(root, parentPath, dirMode)
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.CreateAllInRoot", Path: unsafePath, Err: err}
+	}
+	defer parent.Close()
+
+	file, err := openatFile(parent, finalComponent, unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_RDWR|unix.O_CLOEXEC, int(unixMode))
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.CreateAllInRoot", Path: unsafePath, Err: err}
+	}
+	return file, nil
+}
+
+// mknodInRoot creates a new inode of the given type (unix.S_IFIFO or
+// unix.S_IFSOCK) at unsafePath inside root. The parent directory of unsafePath
+// is resolved inside root and must already exist.
+func mknodInRoot(op string, root *os.File, unsafePath string, fileType uint32, mode os.FileMode) error {
+	parentPath, finalComponent := splitParentPath(unsafePath)
+	switch {
+	case strings.HasSuffix(unsafePath, "/"), finalComponent == "", finalComponent == ".", finalComponent == "..":
+		// Paths which can only refer to directories are not permitted.
+		return &os.PathError{Op: op, Path: unsafePath, Err: unix.EISDIR}
+	}
+
+	unixMode, err := toUnixMode(mode)
+	if err != nil {
+		return &os.PathError{Op: op, Path: unsafePath, Err: err}
+	}
+
+	parent, err := OpenatInRoot(root, parentPath)
+	if err != nil {
+		return &os.PathError{Op: op, Path: unsafePath, Err: err}
+	}
+	defer parent.Close()
+
+	// mknodat(2) never follows a trailing symlink, so an existing (possibly
+	// dangling) symlink results in EEXIST.
+	if err := unix.Mknodat(int(parent.Fd()), finalComponent, fileType|unixMode, 0); err != nil {
+		return &os.PathError{Op: op, Path: unsafePath, Err: &os.PathError{Op: "mknodat", Path: parent.Name() + "/" + finalComponent, Err: err}}
+	}
+	return nil
+}
+
+// MkfifoInRoot creates a new FIFO (named pipe) at unsafePath inside root with
+// the given mode, in the same way as mkfifo(3). The parent directory of
+// unsafePath is resolved inside root (and must already exist), and an error
+// wrapping EEXIST is returned if anything (including a dangling symlink)
+// already exists at unsafePath. mode must only contain permission bits, and is
+// subject to the process umask.
+func MkfifoInRoot(root *os.File, unsafePath string, mode os.FileMode) error {
+	return mknodInRoot("securejoin.MkfifoInRoot", root, unsafePath, unix.S_IFIFO, mode)
+}
+
+// MksockInRoot is equivalent to [MkfifoInRoot], except that a Unix domain
+// socket inode is created instead of a FIFO. Note that nothing is listening
+// on the created socket -- this is mostly useful for creating placeholders
+// (such as bind-mount targets for sockets).
+func MksockInRoot(root *os.File, unsafePath string, mode os.FileMode) error {
+	return mknodInRoot("securejoin.MksockInRoot", root, unsafePath, unix.S_IFSOCK, mode)
+}
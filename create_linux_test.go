@@ -0,0 +1,145 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestCreateAllInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a",
+			"file a/file",
+			"dir target",
+			"symlink a/link ../target",
+			"symlink a/dangling ../target/nope",
+		}
+
+		for _, test := range []struct {
+			name, unsafePath string
+			expectedPath     string
+			expectedErr      error
+		}{
+			{"new", "a/new", "/a/new", nil},
+			{"new-parents", "a/b/c/new", "/a/b/c/new", nil},
+			{"toplevel", "new", "/new", nil},
+			{"symlink-parent", "a/link/new", "/target/new", nil},
+			{"symlink-parent-new", "a/link/b/c/new", "/target/b/c/new", nil},
+			{"escape", "../../../a/new", "/a/new", nil},
+			{"existing", "a/file", "", unix.EEXIST},
+			{"existing-dir", "a", "", unix.EEXIST},
+			{"trailing-symlink", "a/link", "", unix.EEXIST},
+			{"dangling-symlink", "a/dangling", "", unix.EEXIST},
+			{"file-parent", "a/file/new", "", unix.ENOTDIR},
+			{"trailing-slash", "a/new/", "", unix.EISDIR},
+			{"dotdot", "a/..", "", unix.EISDIR},
+			{"root", "/", "", unix.EISDIR},
+			{"bad-mode", "a/new", "", errInvalidMode},
+		} {
+			test := test // copy iterator
+			t.Run(test.name, func(t *testing.T) {
+				root := createTree(t, tree...)
+
+				realRoot, err := filepath.EvalSymlinks(root)
+				require.NoError(t, err)
+
+				rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+				require.NoError(t, err)
+				defer rootDir.Close()
+
+				fileMode := os.FileMode(0o640)
+				if test.expectedErr == errInvalidMode {
+					fileMode |= os.ModeDir
+				}
+
+				file, err := CreateAllInRoot(rootDir, test.unsafePath, 0o755, fileMode)
+				if test.expectedErr != nil {
+					if !assert.ErrorIs(t, err, test.expectedErr) {
+						_ = file.Close()
+					}
+					return
+				}
+				require.NoError(t, err)
+				defer file.Close()
+
+				filePath, err := procSelfFdReadlink(file)
+				require.NoError(t, err, "get real path of created file")
+				assert.Equal(t, realRoot+test.expectedPath, filePath, "created file path")
+
+				// The file must be writable, and must be a new empty file.
+				_, err = file.WriteString("hello")
+				require.NoError(t, err, "write to created file")
+				content, err := os.ReadFile(filePath)
+				require.NoError(t, err)
+				assert.Equal(t, "hello", string(content), "created file content")
+
+				st, err := file.Stat()
+				require.NoError(t, err)
+				assert.True(t, st.Mode().IsRegular(), "created file should be a regular file")
+			})
+		}
+	})
+}
+
+func TestMknodInRoot(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		mknodFn  func(root *os.File, unsafePath string, mode os.FileMode) error
+		fileType os.FileMode
+	}{
+		{"MkfifoInRoot", MkfifoInRoot, os.ModeNamedPipe},
+		{"MksockInRoot", MksockInRoot, os.ModeSocket},
+	} {
+		test := test // copy iterator
+		t.Run(test.name, func(t *testing.T) {
+			withWithoutOpenat2(t, true, func(t *testing.T) {
+				root := createTree(t, "dir a", "file a/file", "symlink a/dangling nonexist", "symlink escape ../../../../a")
+
+				rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+				require.NoError(t, err)
+				defer rootDir.Close()
+
+				// The parent is resolved inside the root. The mode is not
+				// affected by any reasonable umask.
+				err = test.mknodFn(rootDir, "escape/new", 0o600)
+				require.NoErrorf(t, err, "%s(escape/new)", test.name)
+				fi, err := os.Lstat(filepath.Join(root, "a/new"))
+				require.NoError(t, err)
+				assert.Equal(t, test.fileType|0o600, fi.Mode(), "mode of created inode")
+
+				for _, tc := range []struct {
+					unsafePath  string
+					mode        os.FileMode
+					expectedErr error
+				}{
+					{"a/file", 0o644, unix.EEXIST},
+					{"a/new", 0o644, unix.EEXIST},
+					{"a/dangling", 0o644, unix.EEXIST},
+					{"nonexist/new", 0o644, unix.ENOENT},
+					{"a/file/new", 0o644, unix.ENOTDIR},
+					{"a/dir/", 0o644, unix.EISDIR},
+					{"", 0o644, unix.EISDIR},
+					{"a/..", 0o644, unix.EISDIR},
+					{"a/bad", os.ModeDir | 0o644, errInvalidMode},
+				} {
+					err := test.mknodFn(rootDir, tc.unsafePath, tc.mode)
+					assert.ErrorIsf(t, err, tc.expectedErr, "%s(%q)", test.name, tc.unsafePath)
+				}
+				// The dangling symlink was not followed.
+				_, err = os.Lstat(filepath.Join(root, "a/nonexist"))
+				assert.ErrorIs(t, err, os.ErrNotExist, "dangling symlink should not be followed")
+			})
+		})
+	}
+}
@@ -0,0 +1,41 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"syscall"
+)
+
+// DiskUsageInRoot returns the disk space used (in bytes) and the number of
+// inodes in the tree at unsafePath inside root. The tree is walked in the same
+// way as [ChmodAllInRoot] (symlinks are never followed), and the disk usage of
+// each inode is calculated from st_blocks.
+//
+// As with du(1), an inode with multiple hardlinks inside the tree is only
+// counted once.
+func DiskUsageInRoot(root *os.File, unsafePath string) (bytes, inodes int64, err error) {
+	seen := map[inodeKey]struct{}{}
+
+	err = walkInRoot(root, unsafePath, func(_ *os.File, _ string, info os.FileInfo) error {
+		key, err := getInodeKey(info)
+		if err != nil {
+			return err
+		}
+		if _, ok := seen[key]; ok {
+			return nil
+		}
+		seen[key] = struct{}{}
+		bytes += info.Sys().(*syscall.Stat_t).Blocks * 512
+		inodes++
+		return nil
+	})
+	if err != nil {
+		return 0, 0, &os.PathError{Op: "securejoin.DiskUsageInRoot", Path: unsafePath, Err: err}
+	}
+	return bytes, inodes, nil
+}
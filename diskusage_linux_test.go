@@ -0,0 +1,77 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestDiskUsageInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/small hello",
+			"file a/b/big " + strings.Repeat("x", 64*1024),
+			"symlink a/link ../../../../outside",
+			"symlink a/dirlink /outside",
+		}
+		root := createTree(t, tree...)
+
+		// Create a hardlink of a/b/big, which must only be counted once.
+		require.NoError(t, os.Link(filepath.Join(root, "a/b/big"), filepath.Join(root, "a/hardlink")))
+		// Put a large file outside the root, which must never be counted.
+		outside := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(outside, "file"), make([]byte, 1024*1024), 0o644))
+		require.NoError(t, os.Symlink(outside, filepath.Join(root, "outside")))
+
+		// Compute the expected usage of the paths with lstat(2).
+		usage := func(paths ...string) int64 {
+			var total int64
+			for _, path := range paths {
+				var st unix.Stat_t
+				require.NoError(t, unix.Lstat(filepath.Join(root, path), &st))
+				total += int64(st.Blocks) * 512
+			}
+			return total
+		}
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			unsafePath     string
+			expectedBytes  int64
+			expectedInodes int64
+		}{
+			{"a", usage("a", "a/b", "a/small", "a/b/big", "a/link", "a/dirlink"), 6},
+			{"a/b", usage("a/b", "a/b/big"), 2},
+			{"a/b/big", usage("a/b/big"), 1},
+			// Symlinks are never followed.
+			{"a/dirlink", usage("a/dirlink"), 1},
+			{"outside", usage("outside"), 1},
+		} {
+			test := test // copy iterator
+			t.Run(test.unsafePath, func(t *testing.T) {
+				bytes, inodes, err := DiskUsageInRoot(rootDir, test.unsafePath)
+				require.NoError(t, err)
+				assert.Equal(t, test.expectedBytes, bytes, "disk usage in bytes")
+				assert.Equal(t, test.expectedInodes, inodes, "number of inodes")
+			})
+		}
+
+		_, _, err = DiskUsageInRoot(rootDir, "a/nope")
+		assert.ErrorIs(t, err, unix.ENOENT, "disk usage of non-existent path")
+	})
+}
@@ -30,6 +30,16 @@
 // history of CVEs in dependent as a result). Users should switch to the modern
 // API as soon as possible (or even better, switch to libpathrs).
 //
+// The errors returned by the modern API have consistent types, so that they
+// can be handled programmatically. Functions which operate on a single path
+// return an *[os.PathError] (with Op set to the name of the function, such as
+// "securejoin.MkdirAllHandle"), except for [OpenInRoot] and its variants which
+// return a *[ResolveError] (which can be converted to an *[os.PathError] with
+// [errors.As]). Functions which operate on two paths (such as
+// [ExchangeInRoot]) return an *[os.LinkError]. In all cases, the underlying
+// errors (such as the errno returned by a syscall, or sentinel errors like
+// [ErrPossibleBreakout]) are wrapped and can be checked with [errors.Is].
+//
 // This project was initially intended to be included in the Go standard
 // library, but [it was rejected](https://go.dev/issue/20126). There is now a
 // [new Go proposal](https://go.dev/issue/67002) for a safe path resolution API
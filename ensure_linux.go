@@ -0,0 +1,153 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkFinalComponent verifies that the final component of unsafePath inside
+// root is not a symlink and refers to the same inode as handle. This is used
+// to make sure we do not modify the target of a trailing symlink (which
+// [MkdirAllHandle] and [OpenatInRoot] will follow).
+func checkFinalComponent(root *os.File, unsafePath string, handle *os.File) error {
+	parent, finalComponent, err := openParentInRoot(root, unsafePath)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	switch finalComponent {
+	case "", ".", "..":
+		// These cannot be symlinks.
+		return nil
+	}
+
+	finalStat, err := fstatatFile(parent, finalComponent, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return err
+	}
+	if finalStat.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return &os.PathError{Op: "securejoin.checkFinalComponent", Path: unsafePath, Err: unix.ELOOP}
+	}
+	handleStat, err := fstat(handle)
+	if err != nil {
+		return err
+	}
+	if finalStat.Dev != handleStat.Dev || finalStat.Ino != handleStat.Ino {
+		return fmt.Errorf("%w: %q was swapped during lookup", ErrPossibleAttack, unsafePath)
+	}
+	return nil
+}
+
+// EnsureDirInRoot makes sure that the directory at unsafePath inside root
+// exists and has the given mode and owner, creating it (and any missing
+// parent directories) with [MkdirAllHandle] if necessary. If the directory
+// already exists but has a different mode or owner, they are changed to match.
+// As with [os.Chown], a uid or gid of -1 means that the corresponding owner
+// will not be changed.
+//
+// An error is returned if unsafePath exists but is not a directory. Unlike
+// [MkdirAllHandle], the final component of unsafePath is not permitted to be
+// a symlink (to avoid changing the mode or owner of a symlink target).
+func EnsureDirInRoot(root *os.File, unsafePath string, mode os.FileMode, uid, gid int) (Err error) {
+	defer func() {
+		if Err != nil {
+			Err = &os.PathError{Op: "securejoin.EnsureDirInRoot", Path: unsafePath, Err: Err}
+		}
+	}()
+
+	unixMode, err := toUnixMode(mode)
+	if err != nil {
+		return err
+	}
+
+	dir, err := MkdirAllHandle(root, unsafePath, mode)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if err := checkFinalComponent(root, unsafePath, dir); err != nil {
+		return err
+	}
+
+	stat, err := fstat(dir)
+	if err != nil {
+		return err
+	}
+	// Change the owner first, as chown(2) can clear the set[ug]id bits.
+	if (uid != -1 && stat.Uid != uint32(uid)) || (gid != -1 && stat.Gid != uint32(gid)) {
+		if err := unix.Fchown(int(dir.Fd()), uid, gid); err != nil {
+			return os.NewSyscallError("fchown", err)
+		}
+		if stat, err = fstat(dir); err != nil {
+			return err
+		}
+	}
+	if stat.Mode&^unix.S_IFMT != unixMode {
+		if err := unix.Fchmod(int(dir.Fd()), unixMode); err != nil {
+			return os.NewSyscallError("fchmod", err)
+		}
+	}
+	return nil
+}
+
+// EnsureSymlinkInRoot makes sure that unsafeLinkPath inside root is a symlink
+// with the contents target, creating it if it does not exist. The parent
+// directory of unsafeLinkPath must already exist.
+//
+// If unsafeLinkPath already exists and is a symlink to target, no error is
+// returned. If it exists but is not a symlink, or is a symlink with different
+// contents, an error wrapping EEXIST is returned and the existing path is
+// left untouched.
+func EnsureSymlinkInRoot(root *os.File, target, unsafeLinkPath string) (Err error) {
+	defer func() {
+		if Err != nil {
+			Err = &os.PathError{Op: "securejoin.EnsureSymlinkInRoot", Path: unsafeLinkPath, Err: Err}
+		}
+	}()
+
+	parent, linkName, err := openParentInRoot(root, unsafeLinkPath)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	switch linkName {
+	case "", ".", "..":
+		// These always exist and are directories.
+		return fmt.Errorf("%w: %q is not a symlink", unix.EEXIST, unsafeLinkPath)
+	}
+
+	if err := unix.Symlinkat(target, int(parent.Fd()), linkName); err == nil {
+		return nil
+	} else if !errors.Is(err, unix.EEXIST) {
+		return &os.PathError{Op: "symlinkat", Path: parent.Name() + "/" + linkName, Err: err}
+	}
+
+	// The path already exists, check whether it is the symlink we want.
+	stat, err := fstatatFile(parent, linkName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return err
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFLNK {
+		return fmt.Errorf("%w: %q is not a symlink", unix.EEXIST, unsafeLinkPath)
+	}
+	gotTarget, err := readlinkatFile(parent, linkName)
+	if err != nil {
+		return err
+	}
+	if gotTarget != target {
+		return fmt.Errorf("%w: symlink %q points to %q rather than %q", unix.EEXIST, unsafeLinkPath, gotTarget, target)
+	}
+	return nil
+}
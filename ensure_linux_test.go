@@ -0,0 +1,153 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestEnsureDirInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a ::700",
+			"file a/file",
+			"dir target ::711",
+			"symlink a/link ../target",
+		}
+
+		for _, test := range []struct {
+			name, unsafePath string
+			mode             os.FileMode
+			expectedErr      error
+		}{
+			{"new", "a/b/c", 0o750, nil},
+			{"new-sticky", "a/b/c", 0o777 | os.ModeSticky, nil},
+			{"existing-same", "a", 0o700, nil},
+			{"existing-different", "a", 0o755, nil},
+			{"existing-dot", "a/.", 0o755, nil},
+			{"symlink-parent", "a/link/new", 0o755, nil},
+			{"file", "a/file", 0o755, unix.ENOTDIR},
+			{"trailing-symlink", "a/link", 0o755, unix.ELOOP},
+			{"bad-mode", "a/b", 0o755 | os.ModeSetuid, errInvalidMode},
+		} {
+			test := test // copy iterator
+			t.Run(test.name, func(t *testing.T) {
+				root := createTree(t, tree...)
+
+				rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+				require.NoError(t, err)
+				defer rootDir.Close()
+
+				targetPath := filepath.Join(root, "target")
+				targetBefore, err := os.Lstat(targetPath)
+				require.NoError(t, err)
+
+				err = EnsureDirInRoot(rootDir, test.unsafePath, test.mode, -1, -1)
+				// The target of a symlink should never be modified.
+				targetAfter, statErr := os.Lstat(targetPath)
+				require.NoError(t, statErr)
+				assert.Equal(t, targetBefore.Mode(), targetAfter.Mode(), "symlink target mode should not change")
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+					return
+				}
+				require.NoError(t, err)
+
+				handle, err := OpenatInRoot(rootDir, test.unsafePath)
+				require.NoError(t, err)
+				defer handle.Close()
+				st, err := handle.Stat()
+				require.NoError(t, err)
+				assert.True(t, st.IsDir(), "EnsureDirInRoot result should be a directory")
+				assert.Equal(t, test.mode, st.Mode()&modePermExt, "EnsureDirInRoot result mode")
+
+				// Running it again should be a no-op.
+				require.NoError(t, EnsureDirInRoot(rootDir, test.unsafePath, test.mode, -1, -1), "second EnsureDirInRoot")
+			})
+		}
+	})
+}
+
+func TestEnsureDirInRoot_Owner(t *testing.T) {
+	requireRoot(t) // chown
+
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t, "dir a ::755")
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, unsafePath := range []string{"a", "a/b/c"} {
+			err := EnsureDirInRoot(rootDir, unsafePath, 0o755, 1000, 1001)
+			require.NoErrorf(t, err, "EnsureDirInRoot(%q)", unsafePath)
+
+			var st unix.Stat_t
+			require.NoError(t, unix.Lstat(filepath.Join(root, unsafePath), &st))
+			assert.EqualValuesf(t, 1000, st.Uid, "EnsureDirInRoot(%q) uid", unsafePath)
+			assert.EqualValuesf(t, 1001, st.Gid, "EnsureDirInRoot(%q) gid", unsafePath)
+			assert.EqualValuesf(t, 0o755, st.Mode&^unix.S_IFMT, "EnsureDirInRoot(%q) mode", unsafePath)
+		}
+	})
+}
+
+func TestEnsureSymlinkInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a",
+			"file a/file",
+			"symlink a/link ../target",
+			"symlink a/dirlink ../a",
+		}
+
+		for _, test := range []struct {
+			name, target, unsafeLinkPath string
+			expectedErr                  error
+		}{
+			{"new", "../target", "a/newlink", nil},
+			{"new-via-symlink-parent", "/foo/bar", "a/dirlink/newlink", nil},
+			{"existing-match", "../target", "a/link", nil},
+			{"existing-mismatch", "../other", "a/link", unix.EEXIST},
+			{"existing-file", "../target", "a/file", unix.EEXIST},
+			{"existing-dir", "../target", "a", unix.EEXIST},
+			{"existing-dot", "../target", "a/.", unix.EEXIST},
+			{"missing-parent", "../target", "a/b/c/link", unix.ENOENT},
+		} {
+			test := test // copy iterator
+			t.Run(test.name, func(t *testing.T) {
+				root := createTree(t, tree...)
+
+				rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+				require.NoError(t, err)
+				defer rootDir.Close()
+
+				err = EnsureSymlinkInRoot(rootDir, test.target, test.unsafeLinkPath)
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+					return
+				}
+				require.NoError(t, err)
+
+				parent, linkName, err := openParentInRoot(rootDir, test.unsafeLinkPath)
+				require.NoError(t, err)
+				defer parent.Close()
+				gotTarget, err := readlinkatFile(parent, linkName)
+				require.NoError(t, err)
+				assert.Equal(t, test.target, gotTarget, "symlink target")
+
+				// Running it again should be a no-op.
+				require.NoError(t, EnsureSymlinkInRoot(rootDir, test.target, test.unsafeLinkPath), "second EnsureSymlinkInRoot")
+			})
+		}
+	})
+}
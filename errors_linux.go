@@ -0,0 +1,142 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// These errors are returned (wrapped) by the functions in this package when a
+// safety check fails during a lookup. Callers can use [errors.Is] to check for
+// them, but should treat them as opaque -- the exact conditions under which
+// they are returned may change as the detection logic is improved.
+var (
+	// ErrPossibleAttack is returned by [OpenInRoot], [OpenatInRoot] (and
+	// their variants), [MkdirAll] and [MkdirAllHandle] if an openat2(2)
+	// lookup had to be retried too many times due to concurrent renames or
+	// mounts on the system. This usually indicates that an attacker is
+	// racing against the lookup.
+	ErrPossibleAttack = errors.New("possible attack detected")
+
+	// ErrPossibleBreakout is returned by [OpenInRoot], [OpenatInRoot] (and
+	// their variants), [MkdirAll] and [MkdirAllHandle] if the emulated
+	// (non-openat2) resolver detects that walking a ".." component resulted
+	// in a path outside of the root (or if the root itself was moved).
+	ErrPossibleBreakout = errors.New("possible breakout detected")
+
+	// ErrInvalidDirectory is returned by [OpenInRoot], [OpenatInRoot] (and
+	// their variants), [MkdirAll] and [MkdirAllHandle] if a directory being
+	// walked into was deleted during the lookup.
+	ErrInvalidDirectory = errors.New("wandered into deleted directory")
+
+	// ErrDeletedInode is returned by [OpenInRoot], [OpenatInRoot] (and their
+	// variants), [MkdirAll] and [MkdirAllHandle] if a non-directory inode
+	// being checked was deleted during the lookup, so its path cannot be
+	// verified.
+	ErrDeletedInode = errors.New("cannot verify path of deleted inode")
+)
+
+// ErrInvalidRoot is returned (wrapped) by [OpenInRoot], [OpenInRootFd] and
+// [MkdirAll] if the provided root path is empty. An empty root path is never
+// treated as the current directory (use "." for that instead).
+var ErrInvalidRoot = errors.New("invalid root path")
+
+// ErrRootNotDirectory is returned (wrapped) by [OpenInRoot], [OpenatInRoot]
+// (and their variants), [MkdirAll] and [MkdirAllHandle] if the provided root
+// is not a directory. It wraps ENOTDIR, so callers checking for ENOTDIR with
+// [errors.Is] will also match it.
+var ErrRootNotDirectory = fmt.Errorf("root is not a directory: %w", unix.ENOTDIR)
+
+// ErrEscapesRoot is returned (wrapped) by [OpenBeneath] if resolving the
+// path would require leaving the root (such as an absolute path, an absolute
+// symlink or a ".." component at the root). It wraps EXDEV (the error
+// returned by openat2(2) with RESOLVE_BENEATH in this case), so callers
+// checking for EXDEV with [errors.Is] will also match it.
+var ErrEscapesRoot = fmt.Errorf("path escapes root: %w", unix.EXDEV)
+
+// ErrBoundaryMissing is returned (wrapped) by [MkdirAllHandleWithOptions] and
+// [MkdirAllWithOptions] if [MkdirAllOptions.MustExistPrefix] does not already
+// exist as a directory inside the root.
+var ErrBoundaryMissing = errors.New("boundary directory does not exist")
+
+// ErrForbiddenDotDot is returned (wrapped) by [OpenatInRootWithOptions] if
+// [ResolveOptions.RejectDotDot] is set and a ".." component was found in the
+// path (or in the target of a symlink in the path).
+var ErrForbiddenDotDot = errors.New("'..' components are forbidden")
+
+// ErrPathTooComplex is returned (wrapped) by [OpenatInRootWithOptions] if the
+// path being resolved (including the targets of any symlinks in the path)
+// exceeds [ResolveOptions.MaxComponents] or [ResolveOptions.MaxTotalLen].
+var ErrPathTooComplex = errors.New("path is too complex")
+
+// ErrUnsupported is returned (wrapped) by operations such as [ExchangeInRoot]
+// when the running kernel (or the filesystem being operated on) does not
+// support a feature required by the operation. On Go 1.21 and later, this is
+// the same error as [errors.ErrUnsupported].
+var ErrUnsupported = baseErrUnsupported
+
+// ResolveError is returned by [OpenInRoot], [OpenatInRoot] (and their
+// variants) if the lookup of the requested path failed. It records where in
+// the path the lookup stopped, so that callers can tell which component was
+// missing (or was not a directory) without needing to re-do the lookup.
+//
+// The underlying error is available with [errors.Is] and [errors.As], so
+// callers can still check for (for instance) ENOENT or [ErrPossibleBreakout].
+type ResolveError struct {
+	// Op is the operation that failed (such as "securejoin.OpenInRoot").
+	Op string
+	// UnsafePath is the path that was being resolved.
+	UnsafePath string
+	// Component is the path component whose lookup failed. This is empty if
+	// the error did not occur while walking a particular component (such as
+	// a failure to get information about the root, a path that exceeds the
+	// configured limits, or a cancelled context).
+	Component string
+	// RemainingPath contains the path components after Component that were
+	// not walked.
+	RemainingPath string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ResolveError) Error() string {
+	if e.Component == "" {
+		return e.Op + " " + e.UnsafePath + ": " + e.Err.Error()
+	}
+	return e.Op + " " + e.UnsafePath + ": component " + strconv.Quote(e.Component) + ": " + e.Err.Error()
+}
+
+func (e *ResolveError) Unwrap() error { return e.Err }
+
+// As allows a *ResolveError to be converted to an *[os.PathError] with
+// [errors.As], so that the errors returned by every single-path function in
+// this package can be handled in the same way.
+func (e *ResolveError) As(target any) bool {
+	if pathErr, ok := target.(**os.PathError); ok {
+		*pathErr = &os.PathError{Op: e.Op, Path: e.UnsafePath, Err: e.Err}
+		return true
+	}
+	return false
+}
+
+// newResolveError fills in the operation details for a *ResolveError returned
+// from the internal lookup functions, or wraps err in a new *ResolveError if
+// it is not already one.
+func newResolveError(op, unsafePath string, err error) *ResolveError {
+	resolveErr, ok := err.(*ResolveError)
+	if !ok {
+		resolveErr = &ResolveError{Err: err}
+	}
+	resolveErr.Op = op
+	resolveErr.UnsafePath = unsafePath
+	return resolveErr
+}
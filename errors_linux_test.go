@@ -0,0 +1,142 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestErrorTypes_PathError(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t, "dir a", "file b")
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for name, test := range map[string]struct {
+			fn          func() error
+			expectedOp  string
+			expectedErr error
+		}{
+			"OpenatInRoot": {
+				fn: func() error {
+					_, err := OpenatInRoot(rootDir, "nonexist")
+					return err
+				},
+				expectedOp:  "securejoin.OpenInRoot",
+				expectedErr: unix.ENOENT,
+			},
+			"OpenatInRootWithOptions": {
+				fn: func() error {
+					_, err := OpenatInRootWithOptions(context.Background(), rootDir, "a/nonexist", nil)
+					return err
+				},
+				expectedOp:  "securejoin.OpenInRoot",
+				expectedErr: unix.ENOENT,
+			},
+			"MkdirAllHandle": {
+				fn: func() error {
+					_, err := MkdirAllHandle(rootDir, "b/c", 0o755)
+					return err
+				},
+				expectedOp:  "securejoin.MkdirAllHandle",
+				expectedErr: unix.ENOTDIR,
+			},
+			"MkdirAllHandle-BadMode": {
+				fn: func() error {
+					_, err := MkdirAllHandle(rootDir, "a/c", os.ModeSetuid|0o755)
+					return err
+				},
+				expectedOp:  "securejoin.MkdirAllHandle",
+				expectedErr: errInvalidMode,
+			},
+			"MkdirAll": {
+				fn:          func() error { return MkdirAll(root, "b/c", 0o755) },
+				expectedOp:  "securejoin.MkdirAllHandle",
+				expectedErr: unix.ENOTDIR,
+			},
+			"Reopen": {
+				fn: func() error {
+					handle, err := OpenatInRoot(rootDir, "b")
+					require.NoError(t, err)
+					defer handle.Close()
+
+					_, err = Reopen(handle, unix.O_DIRECTORY)
+					return err
+				},
+				expectedOp:  "securejoin.Reopen",
+				expectedErr: unix.ENOTDIR,
+			},
+			"CreateAllInRoot": {
+				fn: func() error {
+					_, err := CreateAllInRoot(rootDir, "b", 0o755, 0o644)
+					return err
+				},
+				expectedOp:  "securejoin.CreateAllInRoot",
+				expectedErr: unix.EEXIST,
+			},
+			"EnsureDirInRoot": {
+				fn:          func() error { return EnsureDirInRoot(rootDir, "b", 0o755, -1, -1) },
+				expectedOp:  "securejoin.EnsureDirInRoot",
+				expectedErr: unix.ENOTDIR,
+			},
+			"RemoveAllInRoot": {
+				fn:          func() error { return RemoveAllInRoot(rootDir, ".") },
+				expectedOp:  "securejoin.RemoveAllInRoot",
+				expectedErr: unix.EBUSY,
+			},
+		} {
+			test := test // copy iterator
+			t.Run(name, func(t *testing.T) {
+				err := test.fn()
+				require.ErrorIs(t, err, test.expectedErr)
+
+				var pathErr *os.PathError
+				require.ErrorAs(t, err, &pathErr, "error should be convertible to *os.PathError")
+				assert.Equal(t, test.expectedOp, pathErr.Op, "*os.PathError op")
+				assert.ErrorIs(t, pathErr, test.expectedErr, "*os.PathError should wrap underlying error")
+			})
+		}
+	})
+}
+
+func TestErrorTypes_LinkError(t *testing.T) {
+	root := createTree(t, "file a", "file b")
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	err = RenameNoReplaceInRoot(rootDir, "a", "b")
+	require.ErrorIs(t, err, unix.EEXIST)
+
+	var linkErr *os.LinkError
+	require.ErrorAs(t, err, &linkErr, "error should be *os.LinkError")
+	assert.Equal(t, "securejoin.RenameNoReplaceInRoot", linkErr.Op, "*os.LinkError op")
+}
+
+func TestResolveError_AsPathError(t *testing.T) {
+	resolveErr := &ResolveError{
+		Op:         "securejoin.OpenInRoot",
+		UnsafePath: "a/b/c",
+		Component:  "b",
+		Err:        ErrPossibleBreakout,
+	}
+
+	var pathErr *os.PathError
+	require.ErrorAs(t, resolveErr, &pathErr)
+	assert.Equal(t, "securejoin.OpenInRoot", pathErr.Op, "*os.PathError op")
+	assert.Equal(t, "a/b/c", pathErr.Path, "*os.PathError path")
+	assert.ErrorIs(t, pathErr, ErrPossibleBreakout, "*os.PathError should wrap underlying error")
+}
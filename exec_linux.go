@@ -0,0 +1,74 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// OpenExecutableInRoot safely opens the executable at unsafePath within root,
+// so that it can then be executed with [Fexecve]. The lookup is done in the
+// same way as [OpenatInRoot] and the returned handle is an O_PATH handle
+// (which is sufficient for execveat(2)).
+//
+// If the final component is not a regular file, an error wrapping EACCES is
+// returned (matching the behaviour of execve(2)).
+func OpenExecutableInRoot(root *os.File, unsafePath string) (*os.File, error) {
+	handle, err := OpenatInRoot(root, unsafePath)
+	if err != nil {
+		return nil, err
+	}
+	st, err := handle.Stat()
+	if err != nil {
+		_ = handle.Close()
+		return nil, &os.PathError{Op: "securejoin.OpenExecutableInRoot", Path: unsafePath, Err: err}
+	}
+	if !st.Mode().IsRegular() {
+		_ = handle.Close()
+		return nil, &os.PathError{Op: "securejoin.OpenExecutableInRoot", Path: unsafePath, Err: unix.EACCES}
+	}
+	return handle, nil
+}
+
+// Fexecve executes the program referenced by the file handle f (usually
+// returned by [OpenExecutableInRoot]) using execveat(2) with AT_EMPTY_PATH,
+// replacing the current process image. Because the program is referenced by
+// its file descriptor rather than a path, an attacker cannot redirect the
+// execution by swapping path components after the lookup.
+//
+// As with [syscall.Exec], Fexecve only returns if an error occurred. Note
+// that if f is a script (starting with "#!") and was opened with O_CLOEXEC
+// (as all handles returned by this package are), execveat(2) will fail with
+// ENOENT because the interpreter will not be able to open the script through
+// /dev/fd.
+func Fexecve(f *os.File, argv, envv []string) error {
+	argvp, err := syscall.SlicePtrFromStrings(argv)
+	if err != nil {
+		return &os.PathError{Op: "execveat", Path: f.Name(), Err: err}
+	}
+	envvp, err := syscall.SlicePtrFromStrings(envv)
+	if err != nil {
+		return &os.PathError{Op: "execveat", Path: f.Name(), Err: err}
+	}
+	emptyPath, err := unix.BytePtrFromString("")
+	if err != nil {
+		return &os.PathError{Op: "execveat", Path: f.Name(), Err: err}
+	}
+
+	_, _, errno := unix.Syscall6(unix.SYS_EXECVEAT, f.Fd(),
+		uintptr(unsafe.Pointer(emptyPath)),
+		uintptr(unsafe.Pointer(&argvp[0])),
+		uintptr(unsafe.Pointer(&envvp[0])),
+		unix.AT_EMPTY_PATH, 0)
+	runtime.KeepAlive(f)
+	return &os.PathError{Op: "execveat", Path: f.Name(), Err: errno}
+}
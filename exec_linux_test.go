@@ -0,0 +1,111 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenExecutableInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir bin",
+			"file bin/prog #!/bin/sh 0:0:755",
+			"symlink bin/link /bin/prog",
+			"symlink bin/escape ../../../../../bin/prog",
+			"fifo bin/fifo",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			unsafePath  string
+			expectedErr error
+		}{
+			{"bin/prog", nil},
+			{"bin/link", nil},
+			{"bin/escape", nil},
+			{"bin", unix.EACCES},
+			{"bin/fifo", unix.EACCES},
+			{"bin/nope", unix.ENOENT},
+		} {
+			test := test // copy iterator
+			t.Run(test.unsafePath, func(t *testing.T) {
+				handle, err := OpenExecutableInRoot(rootDir, test.unsafePath)
+				if test.expectedErr != nil {
+					if !assert.ErrorIs(t, err, test.expectedErr) {
+						_ = handle.Close()
+					}
+					return
+				}
+				require.NoError(t, err)
+				defer handle.Close()
+
+				handlePath, err := procSelfFdReadlink(handle)
+				require.NoError(t, err, "get real path of handle")
+				realProg, err := filepath.EvalSymlinks(filepath.Join(root, "bin/prog"))
+				require.NoError(t, err)
+				assert.Equal(t, realProg, handlePath, "executable handle path")
+			})
+		}
+	})
+}
+
+func TestFexecve(t *testing.T) {
+	// When run as the helper process, exec the requested program.
+	if prog := os.Getenv("SECUREJOIN_TEST_FEXECVE"); prog != "" {
+		root, unsafePath := filepath.Split(prog)
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			os.Exit(100)
+		}
+		handle, err := OpenExecutableInRoot(rootDir, unsafePath)
+		if err != nil {
+			os.Exit(101)
+		}
+		_ = Fexecve(handle, []string{unsafePath, "fexecve-ok"}, []string{})
+		os.Exit(102)
+	}
+
+	echo, err := exec.LookPath("echo")
+	if err != nil {
+		t.Skipf("echo binary not found: %v", err)
+	}
+	echo, err = filepath.EvalSymlinks(echo)
+	require.NoError(t, err)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestFexecve$")
+	cmd.Env = append(os.Environ(), "SECUREJOIN_TEST_FEXECVE="+echo)
+	output, err := cmd.Output()
+	require.NoError(t, err, "run Fexecve helper process")
+	assert.Equal(t, "fexecve-ok\n", string(output), "output of executed program")
+}
+
+func TestFexecve_NonExecutable(t *testing.T) {
+	root := createTree(t, "file data hello 0:0:644")
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	handle, err := OpenExecutableInRoot(rootDir, "data")
+	require.NoError(t, err)
+	defer handle.Close()
+
+	err = Fexecve(handle, []string{"data"}, nil)
+	assert.ErrorIs(t, err, unix.EACCES, "executing a non-executable file")
+}
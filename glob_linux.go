@@ -0,0 +1,116 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// globHasMeta reports whether the path component contains any of the magic
+// characters recognised by [path.Match].
+func globHasMeta(part string) bool {
+	return strings.ContainsAny(part, `*?[\`)
+}
+
+// GlobInRoot returns the paths of all files inside root matching pattern, in
+// the same way as [path/filepath.Glob]. Each component of pattern is matched
+// using [path.Match], and the returned paths are relative to the root (and
+// sorted per-directory in lexical order).
+//
+// Unlike [path/filepath.Glob], the walk is done using file handles and so the
+// matching is always confined to root. ".." components never match anything,
+// and symlinks are never followed while walking -- a symlink will only be
+// returned as a match if it is the final component of the pattern.
+//
+// The only possible returned error is [path.ErrBadPattern] (for malformed
+// patterns) or an I/O error encountered while walking the tree.
+func GlobInRoot(root *os.File, pattern string) ([]string, error) {
+	var parts []string
+	for _, part := range strings.Split(pattern, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		// Check the pattern is valid up-front, as path.Match only reports
+		// ErrBadPattern if it gets far enough into the pattern.
+		if _, err := path.Match(part, ""); err != nil {
+			return nil, &os.PathError{Op: "securejoin.GlobInRoot", Path: pattern, Err: err}
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return nil, nil
+	}
+
+	var matches []string
+	if err := globInDir(root, "", parts, &matches); err != nil {
+		return nil, &os.PathError{Op: "securejoin.GlobInRoot", Path: pattern, Err: err}
+	}
+	return matches, nil
+}
+
+func globInDir(dir *os.File, dirPath string, parts []string, matches *[]string) error {
+	part, remainingParts := parts[0], parts[1:]
+
+	var names []string
+	if !globHasMeta(part) {
+		if part == ".." {
+			return nil
+		}
+		if _, err := fstatatFile(dir, part, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			if IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		names = []string{part}
+	} else {
+		readDir, err := openatFile(dir, ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		allNames, err := readDir.Readdirnames(-1)
+		_ = readDir.Close()
+		if err != nil {
+			return err
+		}
+		sort.Strings(allNames)
+		for _, name := range allNames {
+			// We already validated the pattern, so this cannot fail.
+			if ok, _ := path.Match(part, name); ok {
+				names = append(names, name)
+			}
+		}
+	}
+
+	for _, name := range names {
+		namePath := path.Join(dirPath, name)
+		if len(remainingParts) == 0 {
+			*matches = append(*matches, namePath)
+			continue
+		}
+		// Only walk into real directories, never through symlinks.
+		child, err := openatFile(dir, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			if IsNotExist(err) || errors.Is(err, unix.ELOOP) {
+				continue
+			}
+			return err
+		}
+		err = globInDir(child, namePath, remainingParts, matches)
+		_ = child.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
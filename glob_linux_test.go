@@ -0,0 +1,74 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestGlobInRoot(t *testing.T) {
+	tree := []string{
+		"dir a/b1",
+		"dir a/b2",
+		"dir a/c",
+		"file a/b1/foo.txt",
+		"file a/b1/bar.txt",
+		"file a/b2/foo.txt",
+		"file a/b2/foo.log",
+		"file a/c/foo.txt",
+		"symlink a/b3 /a/b1",
+		"symlink a/b4 ../../../../../../outside",
+		"symlink a/b5.txt b1/foo.txt",
+		"file x.txt",
+	}
+	root := createTree(t, tree...)
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	for _, test := range []struct {
+		pattern     string
+		expected    []string
+		expectedErr error
+	}{
+		{"a/b*/foo.txt", []string{"a/b1/foo.txt", "a/b2/foo.txt"}, nil},
+		{"/a/b?/*.txt", []string{"a/b1/bar.txt", "a/b1/foo.txt", "a/b2/foo.txt"}, nil},
+		{"a/[bc]2/foo.*", []string{"a/b2/foo.log", "a/b2/foo.txt"}, nil},
+		{"a/*", []string{"a/b1", "a/b2", "a/b3", "a/b4", "a/b5.txt", "a/c"}, nil},
+		{"a/*.txt", []string{"a/b5.txt"}, nil},
+		{"a/c/foo.txt", []string{"a/c/foo.txt"}, nil},
+		{"./a//./c/*", []string{"a/c/foo.txt"}, nil},
+		{"*.txt", []string{"x.txt"}, nil},
+		// Symlinks are never walked into.
+		{"a/b3/*", nil, nil},
+		{"a/b4/*", nil, nil},
+		// ".." never matches anything.
+		{"../*", nil, nil},
+		{"a/../x.txt", nil, nil},
+		{"a/*/../*", nil, nil},
+		{"nonexist/*", nil, nil},
+		{"a/[", nil, path.ErrBadPattern},
+	} {
+		test := test // copy iterator
+		t.Run(test.pattern, func(t *testing.T) {
+			matches, err := GlobInRoot(rootDir, test.pattern)
+			if test.expectedErr != nil {
+				assert.ErrorIs(t, err, test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, matches, "GlobInRoot(%q)", test.pattern)
+		})
+	}
+}
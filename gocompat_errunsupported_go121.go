@@ -0,0 +1,16 @@
+//go:build linux && go1.21
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+)
+
+// baseErrUnsupported is the base error for ErrUnsupported. On Go 1.21 and
+// later we use errors.ErrUnsupported so that callers can check for it without
+// needing to know about this package.
+var baseErrUnsupported = errors.ErrUnsupported
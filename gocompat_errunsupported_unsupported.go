@@ -0,0 +1,16 @@
+//go:build linux && !go1.21
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+)
+
+// baseErrUnsupported is the base error for ErrUnsupported.
+// errors.ErrUnsupported was only added in Go 1.21, so we need our own error
+// for older Go versions.
+var baseErrUnsupported = errors.New("unsupported operation")
@@ -0,0 +1,14 @@
+//go:build linux && go1.20
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"io/fs"
+)
+
+// errSkipAll is fs.SkipAll, which was only added in Go 1.20.
+var errSkipAll = fs.SkipAll
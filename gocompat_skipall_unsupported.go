@@ -0,0 +1,15 @@
+//go:build linux && !go1.20
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+)
+
+// errSkipAll is a placeholder for fs.SkipAll, which was only added in Go 1.20.
+// Callers cannot return it on older Go versions, so it is never matched.
+var errSkipAll = errors.New("skip everything and stop the walk")
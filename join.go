@@ -7,6 +7,7 @@ package securejoin
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -28,6 +29,14 @@ func IsNotExist(err error) bool {
 // that contains ".." components.
 var errUnsafeRoot = errors.New("root path provided to SecureJoin contains '..' components")
 
+// ErrTooManySymlinks is returned (wrapped in an [*os.PathError]) by
+// [SecureJoin] (and its variants) if more than 255 symlinks were walked while
+// resolving the path, which usually indicates a symlink loop. The emulated
+// resolver used by [OpenInRoot] on Linux (when openat2(2) is not available)
+// returns the same error. It wraps ELOOP, so it can still be checked with
+// [errors.Is] against [syscall.ELOOP].
+var ErrTooManySymlinks = fmt.Errorf("too many symlinks walked: %w", syscall.ELOOP)
+
 // stripVolume just gets rid of the Windows volume included in a path. Based on
 // some godbolt tests, the Go compiler is smart enough to make this a no-op on
 // Linux.
@@ -78,13 +87,27 @@ func hasDotDot(path string) bool {
 // fully resolved using [filepath.EvalSymlinks] or otherwise constructed to
 // avoid containing symlink components. Of course, the root also *must not* be
 // attacker-controlled.
+//
+// If more than 255 symlinks are followed while resolving unsafePath (usually
+// because of a symlink loop), an [*os.PathError] wrapping [ErrTooManySymlinks]
+// is returned.
 func SecureJoinVFS(root, unsafePath string, vfs VFS) (string, error) {
+	joinedPath, _, err := SecureJoinVFSCount(root, unsafePath, vfs)
+	return joinedPath, err
+}
+
+// SecureJoinVFSCount is equivalent to [SecureJoinVFS], except that it also
+// returns the number of symlinks that were followed while resolving
+// unsafePath. Callers can use this to flag untrusted paths which made use of
+// suspiciously long chains of symlinks. If an error is returned, the count is
+// the number of symlinks followed before the error occurred.
+func SecureJoinVFSCount(root, unsafePath string, vfs VFS) (string, int, error) {
 	// The root path must not contain ".." components, otherwise when we join
 	// the subpath we will end up with a weird path. We could work around this
 	// in other ways but users shouldn't be giving us non-lexical root paths in
 	// the first place.
 	if hasDotDot(root) {
-		return "", errUnsafeRoot
+		return "", 0, errUnsafeRoot
 	}
 
 	// Use the os.* VFS implementation if none was specified.
@@ -126,7 +149,7 @@ func SecureJoinVFS(root, unsafePath string, vfs VFS) (string, error) {
 		// Figure out whether the path is a symlink.
 		fi, err := vfs.Lstat(fullPath)
 		if err != nil && !IsNotExist(err) {
-			return "", err
+			return "", linksWalked, err
 		}
 		// Treat non-existent path components the same as non-symlinks (we
 		// can't do any better here).
@@ -139,12 +162,12 @@ func SecureJoinVFS(root, unsafePath string, vfs VFS) (string, error) {
 		// to the yet-unparsed path.
 		linksWalked++
 		if linksWalked > maxSymlinkLimit {
-			return "", &os.PathError{Op: "SecureJoin", Path: root + string(filepath.Separator) + unsafePath, Err: syscall.ELOOP}
+			return "", linksWalked, &os.PathError{Op: "SecureJoin", Path: root + string(filepath.Separator) + unsafePath, Err: ErrTooManySymlinks}
 		}
 
 		dest, err := vfs.Readlink(fullPath)
 		if err != nil {
-			return "", err
+			return "", linksWalked, err
 		}
 		remainingPath = dest + string(filepath.Separator) + remainingPath
 		// Absolute symlinks reset any work we've already done.
@@ -156,7 +179,7 @@ func SecureJoinVFS(root, unsafePath string, vfs VFS) (string, error) {
 	// There should be no lexical components like ".." left in the path here,
 	// but for safety clean up the path before joining it to the root.
 	finalPath := filepath.Join(string(filepath.Separator), currentPath)
-	return filepath.Join(root, finalPath), nil
+	return filepath.Join(root, finalPath), linksWalked, nil
 }
 
 // SecureJoin is a wrapper around [SecureJoinVFS] that just uses the [os].* library
@@ -164,3 +187,107 @@ func SecureJoinVFS(root, unsafePath string, vfs VFS) (string, error) {
 func SecureJoin(root, unsafePath string) (string, error) {
 	return SecureJoinVFS(root, unsafePath, nil)
 }
+
+// SecureJoinN is like [SecureJoin], except that the unsafe path is provided as
+// multiple segments. SecureJoinN(root, a, b, c) is equivalent to
+// SecureJoin(root, a+"/"+b+"/"+c) (using [filepath.Separator]) -- all of the
+// segments are treated as a single untrusted path and resolved in one pass.
+//
+// Note that this is not the same as SecureJoin(SecureJoin(root, a), b). In
+// that case, the result of the first call is treated as a trusted root for
+// the second call, so (for instance) ".." components in b cannot go above the
+// path that a resolved to, even if a was a symlink.
+func SecureJoinN(root string, unsafeSegments ...string) (string, error) {
+	return SecureJoin(root, strings.Join(unsafeSegments, string(filepath.Separator)))
+}
+
+// CleanUnsafePath lexically cleans unsafePath in the same way that
+// [SecureJoin] does for paths without symlinks, without touching the
+// filesystem. The returned path is relative (it never has a leading
+// separator), and ".." components that would go above the root are dropped,
+// so it can be safely joined to a root directory with [filepath.Join]. Any
+// volume name in unsafePath is discarded. If unsafePath refers to the root
+// itself, "." is returned.
+//
+// Note that this is only safe to use on its own if the path will never be
+// resolved on a filesystem where an attacker could add symlinks, because
+// ".." components are resolved lexically.
+func CleanUnsafePath(unsafePath string) string {
+	unsafePath = stripVolume(filepath.FromSlash(unsafePath))
+	cleanPath := filepath.Join(string(filepath.Separator), unsafePath)
+	cleanPath = strings.TrimPrefix(cleanPath, string(filepath.Separator))
+	if cleanPath == "" {
+		cleanPath = "."
+	}
+	return cleanPath
+}
+
+// ResolveLexical is a purely lexical version of [SecureJoin] which does not
+// touch the filesystem (and so does not resolve symlinks). cleaned is the
+// result of joining root with [CleanUnsafePath](unsafePath), and escaped
+// indicates whether any clamping was needed to keep the path inside root --
+// that is, unsafePath was absolute (or contained a volume name) or contained
+// ".." components that would have gone above the root.
+//
+// This is mainly useful for testing and fuzzing, as well as for logging when
+// an untrusted path tried to escape. As with [CleanUnsafePath], it must not
+// be used to resolve paths on filesystems where an attacker could add
+// symlinks.
+func ResolveLexical(root, unsafePath string) (cleaned string, escaped bool) {
+	unsafePath = filepath.FromSlash(unsafePath)
+	if filepath.VolumeName(unsafePath) != "" {
+		escaped = true
+	}
+	relPath := stripVolume(unsafePath)
+	if strings.HasPrefix(relPath, string(filepath.Separator)) {
+		escaped = true
+	}
+
+	var depth int
+	for _, part := range strings.Split(relPath, string(filepath.Separator)) {
+		switch part {
+		case "", ".":
+			// no-op
+		case "..":
+			if depth == 0 {
+				escaped = true
+			} else {
+				depth--
+			}
+		default:
+			depth++
+		}
+	}
+	return filepath.Join(root, CleanUnsafePath(unsafePath)), escaped
+}
+
+// SecureJoinOptions contains optional settings for [SecureJoinWith].
+type SecureJoinOptions struct {
+	// VFS is the [VFS] implementation used to resolve symlinks. If nil, the
+	// standard [os].* family of functions are used.
+	VFS VFS
+
+	// KeepTrailingSlash causes a trailing separator in unsafePath to be kept in
+	// the returned path (unless the path resolved to the root itself). This
+	// means that using the returned path will fail with ENOTDIR if it does not
+	// refer to a directory, which matches how trailing slashes are treated by
+	// the kernel.
+	KeepTrailingSlash bool
+}
+
+// SecureJoinWith is equivalent to [SecureJoinVFS], except that additional
+// options can be specified with opts. See [SecureJoinOptions] for more
+// details.
+func SecureJoinWith(root, unsafePath string, opts SecureJoinOptions) (string, error) {
+	joinedPath, err := SecureJoinVFS(root, unsafePath, opts.VFS)
+	if err != nil {
+		return "", err
+	}
+	// SecureJoinVFS always returns a cleaned path, so we need to compare
+	// against the cleaned root.
+	if opts.KeepTrailingSlash && joinedPath != filepath.Clean(root) &&
+		strings.HasSuffix(filepath.FromSlash(unsafePath), string(filepath.Separator)) {
+		joinedPath += string(filepath.Separator)
+	}
+	return joinedPath, nil
+}
@@ -0,0 +1,64 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// SecureJoinReal is similar to [SecureJoin], except that the existing
+// components of unsafePath are resolved by actually walking the filesystem
+// with the same safe resolver used by [OpenInRoot] (rather than the purely
+// lexical walk done by [SecureJoin]). This means that the returned path is
+// what [OpenInRoot] would have resolved unsafePath to at the time of the call,
+// even in the presence of symlinks that [SecureJoin] cannot handle correctly.
+// The returned path is always an absolute path inside root.
+//
+// Any trailing components of unsafePath that do not exist are resolved in the
+// same way as [SecureJoin] (including dangling symlinks). If a component of
+// unsafePath is not a directory, an error is returned.
+//
+// WARNING: As with [SecureJoin], the returned path is only safe to use if the
+// filesystem is not modified by an attacker after SecureJoinReal returns. A
+// path string cannot provide any protection against time-of-check-time-of-use
+// attacks, so callers should use [OpenInRoot] (or the other *InRoot helpers)
+// and operate on the returned handles if at all possible. SecureJoinReal is
+// only intended for callers which must pass a path to an API that only accepts
+// strings.
+func SecureJoinReal(root, unsafePath string) (string, error) {
+	rootDir, err := openRootPath("securejoin.SecureJoinReal", root, unix.O_PATH)
+	if err != nil {
+		return "", err
+	}
+	defer rootDir.Close()
+
+	handle, remainingPath, err := partialLookupInRoot(rootDir, unsafePath)
+	if handle != nil {
+		defer handle.Close()
+	}
+	if err != nil && (handle == nil || !errors.Is(err, unix.ENOENT)) {
+		return "", newResolveError("securejoin.SecureJoinReal", unsafePath, err)
+	}
+
+	relPath, err := rootRelativePath(rootDir, handle)
+	if err != nil {
+		return "", &os.PathError{Op: "securejoin.SecureJoinReal", Path: unsafePath, Err: err}
+	}
+	// rootDir.Name() is the absolute path of the root.
+	if remainingPath == "" {
+		return filepath.Join(rootDir.Name(), relPath), nil
+	}
+	// The resolved prefix is the real path of the handle, so it contains no
+	// symlinks and can safely be resolved lexically along with the
+	// non-existent remaining components.
+	return SecureJoin(rootDir.Name(), path.Join(relPath, remainingPath))
+}
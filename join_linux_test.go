@@ -0,0 +1,74 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSecureJoinReal(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/file",
+			"symlink a/link b",
+			"symlink a/dangling nonexist",
+			"symlink absdangling /a/b/nonexist",
+			"symlink escape ../../../../a",
+		}
+		root := createTree(t, tree...)
+
+		for _, test := range []struct {
+			unsafePath   string
+			expectedPath string
+			expectedErr  error
+		}{
+			{"", "/", nil},
+			{"/", "/", nil},
+			// Existing paths.
+			{"a/b/file", "/a/b/file", nil},
+			{"a/link/file", "/a/b/file", nil},
+			{"escape/b/../link", "/a/b", nil},
+			{"../../a/./b/", "/a/b", nil},
+			// Non-existent trailing components.
+			{"a/b/c/d", "/a/b/c/d", nil},
+			{"a/link/c/../d", "/a/b/d", nil},
+			{"a/b/c/../../../../../d", "/d", nil},
+			{"a/dangling/foo", "/a/nonexist/foo", nil},
+			{"absdangling/foo", "/a/b/nonexist/foo", nil},
+			// Non-directories in the path are errors.
+			{"a/b/file/c", "", unix.ENOTDIR},
+		} {
+			test := test // copy iterator
+			t.Run(test.unsafePath, func(t *testing.T) {
+				gotPath, err := SecureJoinReal(root, test.unsafePath)
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+					assert.Empty(t, gotPath, "path should be empty on error")
+					return
+				}
+				if assert.NoError(t, err) {
+					assert.Equal(t, filepath.Join(root, test.expectedPath), gotPath)
+				}
+				// Without any racing attackers, this should match SecureJoin.
+				lexicalPath, err := SecureJoin(root, test.unsafePath)
+				if assert.NoError(t, err, "SecureJoin") {
+					assert.Equal(t, lexicalPath, gotPath, "SecureJoinReal should match SecureJoin")
+				}
+			})
+		}
+
+		_, err := SecureJoinReal("", "a/b")
+		assert.ErrorIs(t, err, ErrInvalidRoot, "SecureJoinReal with empty root")
+		_, err = SecureJoinReal(filepath.Join(root, "a/b/file"), "a/b")
+		assert.ErrorIs(t, err, ErrRootNotDirectory, "SecureJoinReal with non-directory root")
+	})
+}
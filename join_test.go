@@ -124,9 +124,93 @@ func TestNoSymlink(t *testing.T) {
 		if got != test.expected {
 			t.Errorf("securejoin(%q, %q): expected %q, got %q", test.root, test.unsafe, test.expected, got)
 		}
+		// Without symlinks, CleanUnsafePath should match SecureJoin.
+		if cleanJoin := filepath.Join(test.root, CleanUnsafePath(test.unsafe)); cleanJoin != got {
+			t.Errorf("CleanUnsafePath(%q): joined path %q does not match securejoin result %q", test.unsafe, cleanJoin, got)
+		}
+	}
+}
+
+func TestCleanUnsafePath(t *testing.T) {
+	for _, test := range []struct {
+		unsafePath, expected string
+	}{
+		{"", "."},
+		{".", "."},
+		{"/", "."},
+		{"../../..", "."},
+		{"somepath", "somepath"},
+		{"even/more/path", filepath.Join("even", "more", "path")},
+		{"/this/is/a/path", filepath.Join("this", "is", "a", "path")},
+		{"also/a/../path/././/with/some/./.././junk", filepath.Join("also", "path", "with", "junk")},
+		{"/../../../../etc/passwd", filepath.Join("etc", "passwd")},
+		{"a/b/../../../../c/", "c"},
+		{"./../../.././etc passwd", "etc passwd"},
+	} {
+		got := CleanUnsafePath(test.unsafePath)
+		if got != test.expected {
+			t.Errorf("CleanUnsafePath(%q): expected %q, got %q", test.unsafePath, test.expected, got)
+		}
+	}
+}
+
+func TestResolveLexical(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "root")
+
+	for _, test := range []struct {
+		unsafePath      string
+		expected        string
+		expectedEscaped bool
+	}{
+		{"", root, false},
+		{"a/b/c", filepath.Join(root, "a", "b", "c"), false},
+		{"a/../b", filepath.Join(root, "b"), false},
+		{"a/./b//c/", filepath.Join(root, "a", "b", "c"), false},
+		{"a/b/../../c", filepath.Join(root, "c"), false},
+		{"/a/b", filepath.Join(root, "a", "b"), true},
+		{"..", root, true},
+		{"a/../../b", filepath.Join(root, "b"), true},
+		{"a/b/../../../../../etc/passwd", filepath.Join(root, "etc", "passwd"), true},
+	} {
+		got, escaped := ResolveLexical(root, test.unsafePath)
+		if got != test.expected || escaped != test.expectedEscaped {
+			t.Errorf("ResolveLexical(%q, %q): expected (%q, %v), got (%q, %v)", root, test.unsafePath, test.expected, test.expectedEscaped, got, escaped)
+		}
 	}
 }
 
+func FuzzResolveLexical(f *testing.F) {
+	for _, seed := range []string{
+		"", ".", "/", "..", "a/b/c", "/etc/passwd", "../../../../etc/passwd",
+		"a/../../b", "a/./b//c/", "./..//.././a/b/../c", "a/..b/c..", "...",
+	} {
+		f.Add(seed)
+	}
+
+	root := filepath.Join(string(filepath.Separator), "root")
+	f.Fuzz(func(t *testing.T, unsafePath string) {
+		got, escaped := ResolveLexical(root, unsafePath)
+
+		// The result must always be inside the root.
+		rel, err := filepath.Rel(root, got)
+		if err != nil {
+			t.Fatalf("ResolveLexical(%q, %q) = %q: cannot make path relative to root: %v", root, unsafePath, got, err)
+		}
+		if hasDotDot(rel) {
+			t.Fatalf("ResolveLexical(%q, %q) = %q: path escapes root (%q)", root, unsafePath, got, rel)
+		}
+		if got != filepath.Clean(got) {
+			t.Fatalf("ResolveLexical(%q, %q) = %q: path is not clean", root, unsafePath, got)
+		}
+		// If nothing was clamped, a plain join must give the same result.
+		if !escaped {
+			if plainJoin := filepath.Join(root, unsafePath); plainJoin != got {
+				t.Fatalf("ResolveLexical(%q, %q) = %q: not escaped but differs from plain join %q", root, unsafePath, got, plainJoin)
+			}
+		}
+	})
+}
+
 // Make sure that .. is **not** expanded lexically.
 func TestNonLexical(t *testing.T) {
 	dir, err := ioutil.TempDir("", "TestNonLexical")
@@ -168,6 +252,126 @@ func TestNonLexical(t *testing.T) {
 	}
 }
 
+// SecureJoinN should be equivalent to joining all of the segments first.
+func TestSecureJoinN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSecureJoinN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "subdir"), 0755)
+	os.MkdirAll(filepath.Join(dir, "cousinparent", "cousin"), 0755)
+	symlink(t, "../cousinparent/cousin", filepath.Join(dir, "subdir", "link"))
+
+	for _, test := range []struct {
+		root     string
+		segments []string
+		expected string
+	}{
+		{dir, nil, dir},
+		{dir, []string{"subdir"}, filepath.Join(dir, "subdir")},
+		{dir, []string{"subdir", "link", "test"}, filepath.Join(dir, "cousinparent", "cousin", "test")},
+		{dir, []string{"subdir/link", "../test"}, filepath.Join(dir, "cousinparent", "test")},
+		// Each of these segments looks harmless on its own, but combined they
+		// try to escape the root.
+		{dir, []string{"subdir/..", "..", "../etc", "passwd"}, filepath.Join(dir, "etc", "passwd")},
+		{dir, []string{"subdir/link", "..", "..", "..", "..", "etc"}, filepath.Join(dir, "etc")},
+		{dir, []string{"subdir", "/etc"}, filepath.Join(dir, "subdir", "etc")},
+	} {
+		got, err := SecureJoinN(test.root, test.segments...)
+		if err != nil {
+			t.Errorf("securejoinN(%q, %q): unexpected error: %v", test.root, test.segments, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("securejoinN(%q, %q): expected %q, got %q", test.root, test.segments, test.expected, got)
+			continue
+		}
+	}
+}
+
+func TestSecureJoinWith_KeepTrailingSlash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSecureJoinWith")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "subdir"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "notdir"), []byte("I am not a directory!"), 0644)
+	symlink(t, "/subdir", filepath.Join(dir, "link"))
+	symlink(t, "../notdir", filepath.Join(dir, "subdir", "filelink"))
+
+	sep := string(filepath.Separator)
+	for _, test := range []struct {
+		unsafe            string
+		keepTrailingSlash bool
+		expected          string
+	}{
+		{"subdir/", false, filepath.Join(dir, "subdir")},
+		{"subdir/", true, filepath.Join(dir, "subdir") + sep},
+		{"subdir", true, filepath.Join(dir, "subdir")},
+		{"link/", true, filepath.Join(dir, "subdir") + sep},
+		{"subdir/filelink/", true, filepath.Join(dir, "notdir") + sep},
+		{"notdir//", true, filepath.Join(dir, "notdir") + sep},
+		// The root itself never gets a trailing slash.
+		{"/", true, dir},
+		{"subdir/../", true, dir},
+	} {
+		got, err := SecureJoinWith(dir, test.unsafe, SecureJoinOptions{KeepTrailingSlash: test.keepTrailingSlash})
+		if err != nil {
+			t.Errorf("securejoinWith(%q, %q, %v): unexpected error: %v", dir, test.unsafe, test.keepTrailingSlash, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("securejoinWith(%q, %q, %v): expected %q, got %q", dir, test.unsafe, test.keepTrailingSlash, test.expected, got)
+		}
+	}
+
+	// The root is compared after being cleaned, so unclean roots must not
+	// get a trailing slash either.
+	for _, test := range []struct {
+		root, unsafe, expected string
+	}{
+		{dir + sep, sep, dir},
+		{dir + sep + "." + sep, sep, dir},
+		{dir + sep + "." + sep + "subdir", sep, filepath.Join(dir, "subdir")},
+		{dir + sep + "subdir" + sep, "..", filepath.Join(dir, "subdir")},
+		{dir + sep, "subdir" + sep, filepath.Join(dir, "subdir") + sep},
+	} {
+		got, err := SecureJoinWith(test.root, test.unsafe, SecureJoinOptions{KeepTrailingSlash: true})
+		if err != nil {
+			t.Errorf("securejoinWith(%q, %q, true): unexpected error: %v", test.root, test.unsafe, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("securejoinWith(%q, %q, true): expected %q, got %q", test.root, test.unsafe, test.expected, got)
+		}
+	}
+
+	// Opening a non-directory with a trailing slash must fail.
+	if runtime.GOOS == "windows" {
+		return
+	}
+	got, err := SecureJoinWith(dir, "notdir/", SecureJoinOptions{KeepTrailingSlash: true})
+	if err != nil {
+		t.Fatalf("securejoinWith(%q, %q): unexpected error: %v", dir, "notdir/", err)
+	}
+	if f, err := os.Open(got); err == nil {
+		f.Close()
+		t.Errorf("os.Open(%q): expected an error for non-directory with trailing slash", got)
+	}
+}
+
 // Make sure that symlink loops result in errors.
 func TestSymlinkLoop(t *testing.T) {
 	dir, err := ioutil.TempDir("", "TestSymlinkLoop")
@@ -203,6 +407,15 @@ func TestSymlinkLoop(t *testing.T) {
 			t.Errorf("securejoin(%q, %q): expected ELOOP, got %q & %v", test.root, test.unsafe, got, err)
 			continue
 		}
+		if !errors.Is(err, ErrTooManySymlinks) {
+			t.Errorf("securejoin(%q, %q): expected ErrTooManySymlinks, got %q & %v", test.root, test.unsafe, got, err)
+			continue
+		}
+		var pathErr *os.PathError
+		if !errors.As(err, &pathErr) || pathErr.Err != ErrTooManySymlinks {
+			t.Errorf("securejoin(%q, %q): expected *os.PathError wrapping ErrTooManySymlinks, got %#v", test.root, test.unsafe, err)
+			continue
+		}
 	}
 }
 
@@ -319,6 +532,44 @@ func TestSecureJoinVFS(t *testing.T) {
 	}
 }
 
+func TestSecureJoinVFSCount(t *testing.T) {
+	dir := t.TempDir()
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.MkdirAll(filepath.Join(dir, "subdir"), 0755)
+	symlink(t, "subdir", filepath.Join(dir, "link1"))
+	symlink(t, "link1", filepath.Join(dir, "link2"))
+	symlink(t, "/link2/../link1", filepath.Join(dir, "link3"))
+	symlink(t, "loop", filepath.Join(dir, "loop"))
+
+	for _, test := range []struct {
+		unsafe      string
+		expected    string
+		expectedErr error
+		links       int
+	}{
+		{unsafe: "subdir", expected: filepath.Join(dir, "subdir"), links: 0},
+		{unsafe: "nonexistent/foo", expected: filepath.Join(dir, "nonexistent", "foo"), links: 0},
+		{unsafe: "link1/foo", expected: filepath.Join(dir, "subdir", "foo"), links: 1},
+		{unsafe: "link2/foo", expected: filepath.Join(dir, "subdir", "foo"), links: 2},
+		{unsafe: "link3", expected: filepath.Join(dir, "subdir"), links: 4},
+		{unsafe: "loop", expectedErr: ErrTooManySymlinks, links: 256},
+	} {
+		got, links, err := SecureJoinVFSCount(dir, test.unsafe, nil)
+		if test.expectedErr != nil {
+			assert.ErrorIsf(t, err, test.expectedErr, "SecureJoinVFSCount(%q)", test.unsafe)
+			assert.ErrorIsf(t, err, syscall.ELOOP, "SecureJoinVFSCount(%q)", test.unsafe)
+		} else {
+			assert.NoErrorf(t, err, "SecureJoinVFSCount(%q)", test.unsafe)
+			assert.Equalf(t, test.expected, got, "SecureJoinVFSCount(%q)", test.unsafe)
+		}
+		assert.Equalf(t, test.links, links, "SecureJoinVFSCount(%q) symlink count", test.unsafe)
+	}
+}
+
 // Make sure that SecureJoinVFS actually does use the given VFS interface, and
 // that errors are correctly propagated.
 func TestSecureJoinVFSErrors(t *testing.T) {
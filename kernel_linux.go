@@ -0,0 +1,150 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrUnsupportedKernel is returned (wrapped in an [*UnsupportedKernelError])
+// by functions which were asked to require a kernel feature (such as
+// [ResolveOptions.RequireOpenat2]) that is not available. This is usually
+// because the kernel is too old, or because the process is running inside a
+// sandbox (such as gVisor or a restrictive seccomp profile) which blocks the
+// necessary syscalls. [ProbeKernel] can be used to check for these features
+// ahead of time.
+var ErrUnsupportedKernel = errors.New("required kernel feature unavailable")
+
+// BlockedSyscall describes a syscall which was found to be unavailable by
+// [ProbeKernel].
+type BlockedSyscall struct {
+	// Name is the name of the syscall (such as "openat2").
+	Name string
+	// Err is the error returned by the syscall when it was probed.
+	Err error
+}
+
+// reason returns a human-readable explanation of why the syscall is
+// unavailable, based on the error that was returned.
+func (s BlockedSyscall) reason() string {
+	switch {
+	case errors.Is(s.Err, unix.ENOSYS):
+		return "not implemented by the kernel (or blocked by a sandbox)"
+	case errors.Is(s.Err, unix.EPERM), errors.Is(s.Err, unix.EACCES):
+		return "blocked by a seccomp filter or sandbox"
+	case errors.Is(s.Err, unix.ENOTSUP), errors.Is(s.Err, unix.EINVAL):
+		return "not supported by the kernel"
+	default:
+		return s.Err.Error()
+	}
+}
+
+// UnsupportedKernelError is the error returned by [ProbeKernel], and by
+// functions that were asked to require a kernel feature which is unavailable.
+// It matches both [ErrUnsupportedKernel] and [ErrUnsupported] with
+// [errors.Is].
+type UnsupportedKernelError struct {
+	// Blocked lists the syscalls which were found to be unavailable.
+	Blocked []BlockedSyscall
+}
+
+func (err *UnsupportedKernelError) Error() string {
+	var reasons []string
+	for _, syscall := range err.Blocked {
+		reasons = append(reasons, syscall.Name+": "+syscall.reason())
+	}
+	return ErrUnsupportedKernel.Error() + " (" + strings.Join(reasons, ", ") + ")"
+}
+
+// Is makes UnsupportedKernelError match [ErrUnsupportedKernel] and
+// [ErrUnsupported].
+func (err *UnsupportedKernelError) Is(target error) bool {
+	return target == ErrUnsupportedKernel || target == ErrUnsupported
+}
+
+// kernelFeature is a kernel feature that is probed by ProbeKernel.
+type kernelFeature struct {
+	name  string
+	has   func() bool
+	probe func() error
+}
+
+var (
+	kernelFeatureOpenat2     = kernelFeature{"openat2", func() bool { return hasOpenat2() }, probeOpenat2}
+	kernelFeatureNewMountApi = kernelFeature{"open_tree", func() bool { return hasNewMountApi() }, probeNewMountApi}
+	kernelFeatureStatxMntId  = kernelFeature{"statx(STATX_MNT_ID)", func() bool { return hasStatxMountId() }, probeStatxMountId}
+)
+
+// blocked returns the BlockedSyscall for the feature, or ok=false if the
+// feature is available.
+func (f kernelFeature) blocked() (_ BlockedSyscall, ok bool) {
+	if f.has() {
+		return BlockedSyscall{}, false
+	}
+	err := f.probe()
+	if err == nil {
+		// The feature was disabled even though the probe succeeded (this
+		// only happens in tests).
+		err = unix.ENOSYS
+	}
+	return BlockedSyscall{Name: f.name, Err: err}, true
+}
+
+// newUnsupportedKernelError returns an *UnsupportedKernelError describing
+// which of the given features are unavailable, or nil if they are all
+// available.
+func newUnsupportedKernelError(features ...kernelFeature) *UnsupportedKernelError {
+	var blocked []BlockedSyscall
+	for _, feature := range features {
+		if syscall, ok := feature.blocked(); ok {
+			blocked = append(blocked, syscall)
+		}
+	}
+	if len(blocked) == 0 {
+		return nil
+	}
+	return &UnsupportedKernelError{Blocked: blocked}
+}
+
+// HasOpenat2 returns whether openat2(2) is supported by the running kernel.
+// When it is not supported, the lookup functions in this package fall back to
+// an emulated (userspace) resolver. The result is cached.
+func HasOpenat2() bool {
+	return hasOpenat2()
+}
+
+// HasNewMountAPI returns whether the new mount API (fsopen(2), open_tree(2)
+// and friends) is supported by the running kernel (and not blocked by a
+// sandbox). When it is not supported, this package falls back to using the
+// host /proc (see [OpenProcRootStrict]). The result is cached.
+func HasNewMountAPI() bool {
+	return hasNewMountApi()
+}
+
+// ProbeKernel checks whether the kernel features used by this package
+// (openat2(2), the new mount API and statx(STATX_MNT_ID)) are available. If
+// any of them are unavailable, an [*UnsupportedKernelError] describing which
+// syscalls are blocked (and why) is returned.
+//
+// This package will still work if some of these features are missing, but it
+// will fall back to slower (and in the case of procfs, less hardened) code
+// paths. ProbeKernel is intended to help diagnose why that is happening,
+// especially in sandboxed environments where the syscalls may be blocked
+// rather than missing. The results of the probe are cached.
+func ProbeKernel() error {
+	if kernelErr := newUnsupportedKernelError(
+		kernelFeatureOpenat2,
+		kernelFeatureNewMountApi,
+		kernelFeatureStatxMntId,
+	); kernelErr != nil {
+		return kernelErr
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestProbeKernel(t *testing.T) {
+	err := ProbeKernel()
+	if hasOpenat2() && hasNewMountApi() && hasStatxMountId() {
+		assert.NoError(t, err, "all kernel features are available")
+		return
+	}
+	assert.ErrorIs(t, err, ErrUnsupportedKernel)
+	assert.ErrorIs(t, err, ErrUnsupported)
+}
+
+func TestProbeKernel_Openat2(t *testing.T) {
+	withWithoutOpenat2(t, false, func(t *testing.T) {
+		var kernelErr *UnsupportedKernelError
+		if errors.As(ProbeKernel(), &kernelErr) {
+			var names []string
+			for _, syscall := range kernelErr.Blocked {
+				names = append(names, syscall.Name)
+			}
+			if hasOpenat2() {
+				assert.NotContains(t, names, "openat2", "openat2 should not be reported as blocked")
+			} else {
+				assert.Contains(t, names, "openat2", "openat2 should be reported as blocked")
+			}
+		} else {
+			assert.True(t, hasOpenat2(), "ProbeKernel should fail without openat2")
+		}
+	})
+}
+
+func TestUnsupportedKernelError(t *testing.T) {
+	err := &UnsupportedKernelError{
+		Blocked: []BlockedSyscall{
+			{Name: "openat2", Err: unix.ENOSYS},
+			{Name: "open_tree", Err: unix.EPERM},
+			{Name: "statx(STATX_MNT_ID)", Err: unix.ENOTSUP},
+			{Name: "foo", Err: unix.EBADF},
+		},
+	}
+	assert.ErrorIs(t, err, ErrUnsupportedKernel)
+	assert.ErrorIs(t, err, ErrUnsupported)
+	assert.NotErrorIs(t, err, unix.ENOSYS)
+	assert.Equal(t, "required kernel feature unavailable ("+
+		"openat2: not implemented by the kernel (or blocked by a sandbox), "+
+		"open_tree: blocked by a seccomp filter or sandbox, "+
+		"statx(STATX_MNT_ID): not supported by the kernel, "+
+		"foo: bad file descriptor)", err.Error())
+}
+
+func TestRequireOpenat2_UnsupportedKernel(t *testing.T) {
+	origHasOpenat2 := hasOpenat2
+	hasOpenat2 = func() bool { return false }
+	defer func() { hasOpenat2 = origHasOpenat2 }()
+
+	root := createTree(t, "file a")
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	handle, err := OpenatInRootWithOptions(context.Background(), rootDir, "a", &ResolveOptions{RequireOpenat2: true})
+	require.Error(t, err)
+	assert.Nil(t, handle, "handle should be nil on error")
+	assert.ErrorIs(t, err, ErrUnsupportedKernel)
+	assert.ErrorContains(t, err, "openat2:", "error should mention openat2")
+}
+
+func TestHasKernelFeatures(t *testing.T) {
+	assert.Equal(t, hasOpenat2(), HasOpenat2(), "HasOpenat2")
+	assert.Equal(t, hasNewMountApi(), HasNewMountAPI(), "HasNewMountAPI")
+}
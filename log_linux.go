@@ -0,0 +1,54 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"sync"
+)
+
+// Log levels passed to [Logger].
+const (
+	// LogLevelInfo is used for notable (but expected) decisions, such as
+	// using the emulated resolver because openat2(2) is not supported.
+	LogLevelInfo = "info"
+	// LogLevelWarn is used for events which may indicate an attack or which
+	// reduce the hardening provided by this package, such as falling back to
+	// the host /proc.
+	LogLevelWarn = "warn"
+)
+
+// Logger, if non-nil, is called at notable decision points inside this
+// package (such as falling back to a less-hardened code path, or detecting a
+// possible attack). msg is a short human-readable description of the event
+// and kv is a list of alternating key-value pairs with additional context
+// (in the style of [log/slog]). Logging never changes the behaviour of this
+// package.
+//
+// Logger is nil by default, in which case no logging is done at all. It is
+// not safe to modify Logger concurrently with other calls into this package,
+// so it should be set during program initialisation.
+var Logger func(level, msg string, kv ...any)
+
+// Callers must check that Logger is non-nil before calling logf (or any of
+// the helpers below), so that the arguments are not evaluated when logging is
+// disabled.
+func logf(level, msg string, kv ...any) {
+	if logger := Logger; logger != nil {
+		logger(level, msg, kv...)
+	}
+}
+
+// logOpenat2Fallback is only used to log the first fallback to the emulated
+// resolver, as every lookup would otherwise produce a log entry on older
+// kernels.
+var logOpenat2Fallback sync.Once
+
+func logOpenat2Unsupported() {
+	logOpenat2Fallback.Do(func() {
+		logf(LogLevelInfo, "openat2(2) is not supported, using emulated resolver")
+	})
+}
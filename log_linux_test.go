@@ -0,0 +1,66 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type logEntry struct {
+	level, msg string
+	kv         []any
+}
+
+// captureLogs sets Logger for the duration of the test, returning a pointer
+// to the slice of log entries that were emitted.
+func captureLogs(t *testing.T) *[]logEntry {
+	var entries []logEntry
+	oldLogger := Logger
+	Logger = func(level, msg string, kv ...any) {
+		entries = append(entries, logEntry{level: level, msg: msg, kv: kv})
+	}
+	t.Cleanup(func() { Logger = oldLogger })
+	return &entries
+}
+
+func TestLogger_UnsafeProcRoot(t *testing.T) {
+	logs := captureLogs(t)
+
+	level := forceGetProcRootUnsafe
+	testingForceGetProcRoot = &level
+	defer func() { testingForceGetProcRoot = nil }()
+
+	procRoot, err := doGetProcRoot()
+	require.NoError(t, err)
+	_ = procRoot.Close()
+
+	require.Len(t, *logs, 1, "falling back to the host /proc should be logged")
+	entry := (*logs)[0]
+	assert.Equal(t, LogLevelWarn, entry.level, "log level")
+	assert.Contains(t, entry.msg, "host /proc", "log message")
+	require.Len(t, entry.kv, 2, "log key-values")
+	assert.Equal(t, "err", entry.kv[0], "log key")
+	assert.Error(t, entry.kv[1].(error), "log value")
+}
+
+func TestLogger_Unset(t *testing.T) {
+	oldLogger := Logger
+	Logger = nil
+	defer func() { Logger = oldLogger }()
+
+	level := forceGetProcRootUnsafe
+	testingForceGetProcRoot = &level
+	defer func() { testingForceGetProcRoot = nil }()
+
+	// Nothing should break if there is no logger.
+	procRoot, err := doGetProcRoot()
+	require.NoError(t, err)
+	_ = procRoot.Close()
+}
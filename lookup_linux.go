@@ -7,12 +7,15 @@
 package securejoin
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"golang.org/x/sys/unix"
 )
@@ -27,14 +30,20 @@ type symlinkStackEntry struct {
 	// Readlink which we have yet to walk. When this slice is empty, we
 	// drop the link from the stack.
 	linkUnwalked []string
+	// linkParts is the backing buffer for linkUnwalked, which is kept so that
+	// it can be re-used if the entry is re-used.
+	linkParts []string
 }
 
 func (se symlinkStackEntry) String() string {
 	return fmt.Sprintf("<%s>/%s [->%s]", se.dir.Name(), se.remainingPath, strings.Join(se.linkUnwalked, "/"))
 }
 
-func (se symlinkStackEntry) Close() {
-	_ = se.dir.Close()
+func (se *symlinkStackEntry) Close() {
+	if se.dir != nil {
+		_ = se.dir.Close()
+		se.dir = nil
+	}
 }
 
 type symlinkStack []*symlinkStackEntry
@@ -48,11 +57,29 @@ func (s *symlinkStack) Close() {
 		for _, link := range *s {
 			link.Close()
 		}
-		// TODO: Switch to clear once we switch to Go 1.21.
-		*s = nil
+		// Keep the backing array (and the entries in it) around so that they
+		// can be re-used by push if the stack is pooled.
+		*s = (*s)[:0]
 	}
 }
 
+// symlinkStackPool is used to re-use symlinkStack allocations between lookups,
+// since high-QPS users can end up doing a lot of lookups.
+var symlinkStackPool = sync.Pool{
+	New: func() any { return new(symlinkStack) },
+}
+
+func getSymlinkStack() *symlinkStack {
+	return symlinkStackPool.Get().(*symlinkStack) //nolint:forcetypeassert // the pool only contains *symlinkStack
+}
+
+// putSymlinkStack closes all of the handles in the stack and returns it to the
+// pool. The stack must not be used after calling putSymlinkStack.
+func putSymlinkStack(s *symlinkStack) {
+	s.Close()
+	symlinkStackPool.Put(s)
+}
+
 var (
 	errEmptyStack         = errors.New("[internal] stack is empty")
 	errBrokenSymlinkStack = errors.New("[internal error] broken symlink stack")
@@ -111,23 +138,42 @@ func (s *symlinkStack) push(dir *os.File, remainingPath, linkTarget string) erro
 	if s == nil {
 		return nil
 	}
-	// Split the link target and clean up any "" parts.
-	linkTargetParts := slices_DeleteFunc(
-		strings.Split(linkTarget, "/"),
-		func(part string) bool { return part == "" || part == "." })
-
 	// Copy the directory so the caller doesn't close our copy.
 	dirCopy, err := dupFile(dir)
 	if err != nil {
 		return err
 	}
 
+	// Re-use a previously allocated entry (and its linkParts buffer) if there
+	// is one left over in the backing array.
+	var entry *symlinkStackEntry
+	if n := len(*s); n < cap(*s) {
+		entry = (*s)[:n+1][n]
+	}
+	if entry == nil {
+		entry = new(symlinkStackEntry)
+	}
+	entry.dir = dirCopy
+	entry.remainingPath = remainingPath
+
+	// Split the link target and clean up any "" parts.
+	linkParts := entry.linkParts[:0]
+	for linkTarget != "" {
+		var part string
+		if i := strings.IndexByte(linkTarget, '/'); i == -1 {
+			part, linkTarget = linkTarget, ""
+		} else {
+			part, linkTarget = linkTarget[:i], linkTarget[i+1:]
+		}
+		if part != "" && part != "." {
+			linkParts = append(linkParts, part)
+		}
+	}
+	entry.linkParts = linkParts
+	entry.linkUnwalked = linkParts
+
 	// Add to the stack.
-	*s = append(*s, &symlinkStackEntry{
-		dir:           dirCopy,
-		remainingPath: remainingPath,
-		linkUnwalked:  linkTargetParts,
-	})
+	*s = append(*s, entry)
 	return nil
 }
 
@@ -151,8 +197,17 @@ func (s *symlinkStack) PopTopSymlink() (*os.File, string, bool) {
 		return nil, "", false
 	}
 	tailEntry := (*s)[0]
-	*s = (*s)[1:]
-	return tailEntry.dir, tailEntry.remainingPath, true
+	// Shift the remaining entries down rather than re-slicing, so that we
+	// don't lose any of the backing array and the popped entry can be
+	// re-used by push.
+	n := len(*s)
+	copy((*s)[:n-1], (*s)[1:])
+	(*s)[n-1] = tailEntry
+	*s = (*s)[:n-1]
+	// The caller now owns the directory handle.
+	dir := tailEntry.dir
+	tailEntry.dir = nil
+	return dir, tailEntry.remainingPath, true
 }
 
 // partialLookupInRoot tries to lookup as much of the request path as possible
@@ -160,41 +215,221 @@ func (s *symlinkStack) PopTopSymlink() (*os.File, string, bool) {
 // component of the requested path, returning a file handle to the final
 // existing component and a string containing the remaining path components.
 func partialLookupInRoot(root *os.File, unsafePath string) (*os.File, string, error) {
-	return lookupInRoot(root, unsafePath, true)
+	return lookupInRoot(context.Background(), root, unsafePath, true, nil)
+}
+
+// isRootPath returns whether unsafePath refers to the root itself without any
+// lookup being necessary ("", "." or any number of "/"s).
+func isRootPath(unsafePath string) bool {
+	unsafePath = strings.TrimLeft(filepath.ToSlash(unsafePath), "/")
+	return unsafePath == "" || unsafePath == "."
+}
+
+// reopenRoot returns a new handle to the root directory. Unlike dupFile, the
+// returned handle is a separate file description, and O_DIRECTORY ensures that
+// we fail if root is not actually a directory.
+func reopenRoot(root *os.File) (*os.File, error) {
+	handle, err := openatFile(root, ".", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, unix.ENOTDIR) {
+			err = fmt.Errorf("%w: %q", ErrRootNotDirectory, root.Name())
+		}
+		return nil, fmt.Errorf("reopen root: %w", err)
+	}
+	return handle, nil
+}
+
+// checkRootIsDir returns an error wrapping ErrRootNotDirectory if the root
+// referenced by rootFd is not a directory. Without this check, passing a
+// non-directory root would result in a confusing ENOTDIR error for the first
+// component of the path being resolved.
+func checkRootIsDir(rootFd int, rootName string) error {
+	var stat unix.Stat_t
+	if err := unix.Fstat(rootFd, &stat); err != nil {
+		return &os.PathError{Op: "fstat", Path: rootName, Err: err}
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return fmt.Errorf("%w: %q", ErrRootNotDirectory, rootName)
+	}
+	return nil
 }
 
-func completeLookupInRoot(root *os.File, unsafePath string) (*os.File, error) {
-	handle, remainingPath, err := lookupInRoot(root, unsafePath, false)
+func completeLookupInRoot(ctx context.Context, root *os.File, unsafePath string, opts *ResolveOptions) (*os.File, error) {
+	opts.setFallback(ReasonNone)
+	if opts.requireDir() && opts.requireNonDir() {
+		return nil, fmt.Errorf("RequireDir and RequireNonDir are mutually exclusive: %w", unix.EINVAL)
+	}
+	if opts.requireOpenat2() && opts.needsEmulatedResolver() {
+		return nil, fmt.Errorf("RequireOpenat2 cannot be combined with RejectDotDot, MaxComponents, MaxTotalLen, SymlinkPolicy or StayOnRootFilesystem: %w", unix.EINVAL)
+	}
+	if isRootPath(unsafePath) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if opts.requireNonDir() {
+			return nil, unix.EISDIR
+		}
+		return reopenRoot(root)
+	}
+	var rootMountId uint64
+	if opts.verifyRootMount() {
+		var err error
+		rootMountId, err = getMountId(root, "")
+		if err != nil {
+			return nil, fmt.Errorf("get root mount id: %w", err)
+		}
+	}
+	handle, remainingPath, err := lookupInRoot(ctx, root, unsafePath, false, opts)
 	if remainingPath != "" && err == nil {
 		// should never happen
 		err = fmt.Errorf("[bug] non-empty remaining path when doing a non-partial lookup: %q", remainingPath)
 	}
 	// lookupInRoot(partial=false) will always close the handle if an error is
 	// returned, so no need to double-check here.
+	if err == nil {
+		if err = checkRequiredFileType(handle, opts); err == nil && opts.verifyRootMount() {
+			err = checkRootMount(root, rootMountId, opts)
+		}
+		if err != nil {
+			_ = handle.Close()
+			handle = nil
+		}
+	}
 	return handle, err
 }
 
-func lookupInRoot(root *os.File, unsafePath string, partial bool) (Handle *os.File, _ string, _ error) {
+// checkRootMount makes sure that the path of root is still on the mount with
+// the given mount id (as recorded from the root handle at the start of the
+// lookup) for ResolveOptions.VerifyRootMount. The path of the root is taken
+// from /proc/self/fd (rather than root.Name(), which need not be a real path)
+// and is opened afresh, so that a mount placed on top of the root path (or
+// the root being unmounted) is detected.
+func checkRootMount(root *os.File, expectedMountId uint64, opts *ResolveOptions) error {
+	rootPath, err := rawProcSelfFdReadlink(int(root.Fd()), opts)
+	if err != nil {
+		return fmt.Errorf("get real root path: %w", err)
+	}
+	if !path.IsAbs(rootPath) {
+		return fmt.Errorf("%w: root path %q is not reachable from our root", ErrPossibleBreakout, rootPath)
+	}
+
+	pathHandle, err := os.OpenFile(rootPath, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("re-open root path %q: %w", rootPath, wrapBaseError(err, ErrPossibleBreakout))
+	}
+	defer pathHandle.Close()
+
+	gotMountId, err := getMountId(pathHandle, "")
+	if err != nil {
+		return fmt.Errorf("get root path mount id: %w", err)
+	}
+	if gotMountId != expectedMountId {
+		return fmt.Errorf("%w: root %q has been remounted during lookup (mount ids do not match %d != %d)", ErrPossibleBreakout, rootPath, expectedMountId, gotMountId)
+	}
+	return nil
+}
+
+// checkSameFilesystem makes sure that handle is on the filesystem with the
+// given device ID (as recorded from the root at the start of the lookup) for
+// ResolveOptions.StayOnRootFilesystem.
+func checkSameFilesystem(handle *os.File, rootDev uint64) error {
+	st, err := fstat(handle)
+	if err != nil {
+		return err
+	}
+	if dev := uint64(st.Dev); dev != rootDev {
+		return &os.PathError{Op: "securejoin.lookupInRoot", Path: handle.Name(), Err: fmt.Errorf("component is on a different filesystem to the root (device %d != %d): %w", dev, rootDev, unix.EXDEV)}
+	}
+	return nil
+}
+
+// checkRequiredFileType makes sure that handle matches opts.RequireDir and
+// opts.RequireNonDir. O_PATH handles always refer to the same inode, so there
+// is no race between the lookup and this check.
+func checkRequiredFileType(handle *os.File, opts *ResolveOptions) error {
+	// openat2(2) lookups enforce RequireDir with O_DIRECTORY, but the
+	// emulated resolver may be used even if openat2(2) is supported, so
+	// always check the file type ourselves.
+	if !opts.requireNonDir() && !opts.requireDir() {
+		return nil
+	}
+	st, err := fstat(handle)
+	if err != nil {
+		return err
+	}
+	isDir := st.Mode&unix.S_IFMT == unix.S_IFDIR
+	switch {
+	case opts.requireDir() && !isDir:
+		return unix.ENOTDIR
+	case opts.requireNonDir() && isDir:
+		return unix.EISDIR
+	}
+	return nil
+}
+
+func lookupInRoot(ctx context.Context, root *os.File, unsafePath string, partial bool, opts *ResolveOptions) (Handle *os.File, _ string, Err error) {
 	unsafePath = filepath.ToSlash(unsafePath) // noop
 
 	// This is very similar to SecureJoin, except that we operate on the
 	// components using file descriptors. We then return the last component we
 	// managed open, along with the remaining path components not opened.
 
-	// Try to use openat2 if possible.
-	if hasOpenat2() {
-		return lookupOpenat2(root, unsafePath, partial)
+	// Reject ".." components and overly-complex paths up-front, before doing
+	// any syscalls. Symlink targets are checked while walking.
+	if opts.rejectDotDot() && hasDotDot(unsafePath) {
+		return nil, "", fmt.Errorf("%w: path %q contains '..' components", ErrForbiddenDotDot, unsafePath)
+	}
+	var budget pathBudget
+	if err := budget.add(opts, unsafePath); err != nil {
+		return nil, "", err
+	}
+	if err := checkRootIsDir(int(root.Fd()), root.Name()); err != nil {
+		return nil, "", err
+	}
+
+	// Try to use openat2 if possible. openat2 does not let us inspect the
+	// targets of symlinks, so some options require the emulated resolver.
+	if hasOpenat2() && !opts.needsEmulatedResolver() {
+		return lookupOpenat2(ctx, root, unsafePath, partial, opts)
+	}
+	if !hasOpenat2() {
+		if opts.requireOpenat2() {
+			return nil, "", newUnsupportedKernelError(kernelFeatureOpenat2)
+		}
+		atomic.AddUint64(&statOpenat2Fallbacks, 1)
+		if Logger != nil {
+			logOpenat2Unsupported()
+		}
+		// hasOpenat2 is only overridden by testing hooks.
+		if probeOpenat2() == nil {
+			opts.setFallback(ReasonForcedEmulated)
+		} else {
+			opts.setFallback(ReasonNoOpenat2)
+		}
+	} else {
+		opts.setFallback(ReasonFlagUnsupported)
 	}
+	atomic.AddUint64(&statEmulatedLookups, 1)
 
 	// Get the "actual" root path from /proc/self/fd. This is necessary if the
 	// root is some magic-link like /proc/$pid/root, in which case we want to
 	// make sure when we do checkProcSelfFdPath that we are using the correct
 	// root path.
-	logicalRootPath, err := procSelfFdReadlink(root)
+	logicalRootPath, err := rawProcSelfFdReadlink(int(root.Fd()), opts)
 	if err != nil {
 		return nil, "", fmt.Errorf("get real root path: %w", err)
 	}
 
+	// Record the filesystem of the root for StayOnRootFilesystem.
+	var rootDev uint64
+	if opts.stayOnRootFilesystem() {
+		st, err := fstat(root)
+		if err != nil {
+			return nil, "", fmt.Errorf("stat root: %w", err)
+		}
+		rootDev = uint64(st.Dev)
+	}
+
 	currentDir, err := dupFile(root)
 	if err != nil {
 		return nil, "", fmt.Errorf("clone root fd: %w", err)
@@ -220,22 +455,40 @@ func lookupInRoot(root *os.File, unsafePath string, partial bool) (Handle *os.Fi
 	// currentDir (as in SecureJoin).
 	var symStack *symlinkStack
 	if partial {
-		symStack = new(symlinkStack)
-		defer symStack.Close()
+		symStack = getSymlinkStack()
+		defer putSymlinkStack(symStack)
 	}
 
 	var (
 		linksWalked   int
 		currentPath   string
+		part          string
 		remainingPath = unsafePath
 	)
+	// For complete lookups, record where the lookup failed. Partial lookups
+	// already return the remaining path to the caller. Errors returned before
+	// this point did not come from resolving a component, and so are not
+	// wrapped (the caller wraps them in a *ResolveError with no Component).
+	defer func() {
+		if Err != nil && !partial {
+			Err = &ResolveError{Component: part, RemainingPath: remainingPath, Err: Err}
+		}
+	}()
 	for remainingPath != "" {
+		// We are between components, so errors from here on should not be
+		// attributed to the previous component.
+		part = ""
+
+		// Bail out if the caller no longer cares about the result.
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+
 		// Save the current remaining path so if the part is not real we can
 		// return the path including the component.
 		oldRemainingPath := remainingPath
 
 		// Get the next path component.
-		var part string
 		if i := strings.IndexByte(remainingPath, '/'); i == -1 {
 			part, remainingPath = remainingPath, ""
 		} else {
@@ -247,6 +500,10 @@ func lookupInRoot(root *os.File, unsafePath string, partial bool) (Handle *os.Fi
 		if part == "" {
 			part = "."
 		}
+		// Any ".." components left at this point came from symlink targets.
+		if part == ".." && opts.rejectDotDot() {
+			return nil, "", fmt.Errorf("%w: symlink target contains '..' components", ErrForbiddenDotDot)
+		}
 
 		// Apply the component lexically to the path we are building.
 		// currentPath does not contain any symlinks, and we are lexically
@@ -267,6 +524,13 @@ func lookupInRoot(root *os.File, unsafePath string, partial bool) (Handle *os.Fi
 			_ = currentDir.Close()
 			currentDir = rootClone
 			currentPath = nextPath
+			if opts.tracing() {
+				action := ResolveActionOpen
+				if part == ".." {
+					action = ResolveActionDotDot
+				}
+				opts.Trace(ResolveStep{Component: part, Action: action, Path: logicalRootPath})
+			}
 			continue
 		}
 
@@ -279,9 +543,27 @@ func lookupInRoot(root *os.File, unsafePath string, partial bool) (Handle *os.Fi
 				_ = nextDir.Close()
 				return nil, "", fmt.Errorf("stat component %q: %w", part, err)
 			}
+			if opts.stayOnRootFilesystem() {
+				if err := checkSameFilesystem(nextDir, rootDev); err != nil {
+					_ = nextDir.Close()
+					return nil, "", err
+				}
+			}
 
 			switch st.Mode() & os.ModeType {
 			case os.ModeSymlink:
+				// If this is the trailing component and the caller asked us
+				// not to follow it, return the symlink itself. A trailing
+				// slash means the symlink must be followed (as with
+				// O_NOFOLLOW), which is why we check oldRemainingPath.
+				if !partial && opts.noFollowTrailing() && oldRemainingPath == part {
+					_ = currentDir.Close()
+					if opts.tracing() {
+						opts.Trace(ResolveStep{Component: part, Action: ResolveActionOpen, Path: logicalRootPath + nextPath})
+					}
+					return nextDir, "", nil
+				}
+
 				// readlinkat implies AT_EMPTY_PATH since Linux 2.6.39. See
 				// Linux commit 65cfc6722361 ("readlinkat(), fchownat() and
 				// fstatat() with empty relative pathnames").
@@ -294,7 +576,15 @@ func lookupInRoot(root *os.File, unsafePath string, partial bool) (Handle *os.Fi
 
 				linksWalked++
 				if linksWalked > maxSymlinkLimit {
-					return nil, "", &os.PathError{Op: "securejoin.lookupInRoot", Path: logicalRootPath + "/" + unsafePath, Err: unix.ELOOP}
+					return nil, "", &os.PathError{Op: "securejoin.lookupInRoot", Path: logicalRootPath + "/" + unsafePath, Err: ErrTooManySymlinks}
+				}
+				if err := budget.add(opts, linkDest); err != nil {
+					return nil, "", fmt.Errorf("walking into symlink %q failed: %w", part, err)
+				}
+				if opts.hasSymlinkPolicy() {
+					if err := opts.SymlinkPolicy(nextPath, linkDest); err != nil {
+						return nil, "", fmt.Errorf("symlink %q rejected by policy: %w", nextPath, err)
+					}
 				}
 
 				// Swap out the symlink's component for the link entry itself.
@@ -302,6 +592,10 @@ func lookupInRoot(root *os.File, unsafePath string, partial bool) (Handle *os.Fi
 					return nil, "", fmt.Errorf("walking into symlink %q failed: push symlink: %w", part, err)
 				}
 
+				if opts.tracing() {
+					opts.Trace(ResolveStep{Component: part, Action: ResolveActionSymlink, Path: path.Join(logicalRootPath, currentPath), Target: linkDest})
+				}
+
 				// Update our logical remaining path.
 				remainingPath = linkDest + "/" + remainingPath
 				// Absolute symlinks reset any work we've already done.
@@ -335,15 +629,23 @@ func lookupInRoot(root *os.File, unsafePath string, partial bool) (Handle *os.Fi
 				// rename or mount on the system.
 				if part == ".." {
 					// Make sure the root hasn't moved.
-					if err := checkProcSelfFdPath(logicalRootPath, root); err != nil {
+					if err := checkProcSelfFdPath(logicalRootPath, root, opts); err != nil {
 						return nil, "", fmt.Errorf("root path moved during lookup: %w", err)
 					}
 					// Make sure the path is what we expect.
 					fullPath := logicalRootPath + nextPath
-					if err := checkProcSelfFdPath(fullPath, currentDir); err != nil {
+					if err := checkProcSelfFdPath(fullPath, currentDir, opts); err != nil {
 						return nil, "", fmt.Errorf("walking into %q had unexpected result: %w", part, err)
 					}
 				}
+
+				if opts.tracing() {
+					action := ResolveActionOpen
+					if part == ".." {
+						action = ResolveActionDotDot
+					}
+					opts.Trace(ResolveStep{Component: part, Action: action, Path: logicalRootPath + nextPath})
+				}
 			}
 
 		default:
@@ -7,6 +7,7 @@
 package securejoin
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -297,8 +298,119 @@ func TestPartialLookupInRoot(t *testing.T) {
 	})
 }
 
+func TestPartialLookupInRoot_TooManySymlinks(t *testing.T) {
+	// Only the emulated resolver returns ErrTooManySymlinks (openat2(2) just
+	// returns ELOOP).
+	origHasOpenat2 := hasOpenat2
+	hasOpenat2 = func() bool { return false }
+	defer func() { hasOpenat2 = origHasOpenat2 }()
+
+	root := createTree(t, "symlink loop loop")
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	handle, _, err := partialLookupInRoot(rootDir, "loop/foo")
+	require.ErrorIs(t, err, ErrTooManySymlinks, "lookup of symlink loop")
+	require.ErrorIs(t, err, unix.ELOOP, "lookup of symlink loop")
+	_ = handle.Close()
+}
+
+func BenchmarkPartialLookupInRoot_SymlinkChain(b *testing.B) {
+	origHasOpenat2 := hasOpenat2
+	hasOpenat2 = func() bool { return false }
+	defer func() { hasOpenat2 = origHasOpenat2 }()
+
+	// A deep chain of (eventually dangling) symlinks, each of which has
+	// multiple components in its target.
+	tree := []string{"dir a/b/c"}
+	for i := 0; i < 16; i++ {
+		tree = append(tree, fmt.Sprintf("symlink link%d ./a/b/c/../../../link%d", i, i+1))
+	}
+	tree = append(tree, "symlink link16 ./a/b/c/nonexist")
+	root := createTree(b, tree...)
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(b, err)
+	defer rootDir.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handle, _, err := partialLookupInRoot(rootDir, "link0/foo/bar")
+		if !errors.Is(err, unix.ENOENT) {
+			b.Fatalf("unexpected error from partial lookup: %v", err)
+		}
+		_ = handle.Close()
+	}
+}
+
+func TestOpenatInRootPartial(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		testPartialLookup(t, OpenatInRootPartial)
+	})
+}
+
+func TestDeepestExisting(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/file",
+			"symlink a/link b",
+			"symlink a/dangling nonexist",
+			"symlink escape ../../../../a",
+		}
+		root := createTree(t, tree...)
+
+		realRoot, err := filepath.EvalSymlinks(root)
+		require.NoError(t, err)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			unsafePath                string
+			expectedPath, expectedRem string
+			expectedErr               error
+		}{
+			// Existing paths.
+			{"a/b", "/a/b", "", nil},
+			{"a/b/file", "/a/b/file", "", nil},
+			{"a/link", "/a/b", "", nil},
+			// Partially existing paths.
+			{"a/b/c/d", "/a/b", "c/d", nil},
+			{"a/link/c/d", "/a/b", "c/d", nil},
+			{"escape/b/c", "/a/b", "c", nil},
+			{"nonexist", "", "nonexist", nil},
+			{"a/dangling/foo", "/a", "dangling/foo", nil},
+			// Non-directories in the path are errors.
+			{"a/b/file/c", "", "", unix.ENOTDIR},
+		} {
+			ancestor, remaining, err := DeepestExisting(rootDir, test.unsafePath)
+			if test.expectedErr != nil {
+				assert.ErrorIsf(t, err, test.expectedErr, "DeepestExisting(%q)", test.unsafePath)
+				assert.Nilf(t, ancestor, "DeepestExisting(%q) ancestor should be nil on error", test.unsafePath)
+				assert.Emptyf(t, remaining, "DeepestExisting(%q) remaining should be empty on error", test.unsafePath)
+				continue
+			}
+			if !assert.NoErrorf(t, err, "DeepestExisting(%q)", test.unsafePath) {
+				continue
+			}
+			gotPath, err := procSelfFdReadlink(ancestor)
+			require.NoError(t, err, "get real path of ancestor")
+			assert.Equalf(t, realRoot+test.expectedPath, gotPath, "DeepestExisting(%q) ancestor", test.unsafePath)
+			assert.Equalf(t, test.expectedRem, remaining, "DeepestExisting(%q) remaining", test.unsafePath)
+			_ = ancestor.Close()
+		}
+	})
+}
+
 func TestPartialOpenat2(t *testing.T) {
-	testPartialLookup(t, partialLookupOpenat2)
+	testPartialLookup(t, func(root *os.File, unsafePath string) (*os.File, string, error) {
+		return partialLookupOpenat2(context.Background(), root, unsafePath, nil)
+	})
 }
 
 func TestPartialLookupInRoot_BadInode(t *testing.T) {
@@ -527,7 +639,7 @@ func TestPartialLookup_RacingRename(t *testing.T) {
 			)},
 		} {
 			test := test // copy iterator
-			test.skipErrs = append(test.skipErrs, errPossibleAttack, errPossibleBreakout)
+			test.skipErrs = append(test.skipErrs, ErrPossibleAttack, ErrPossibleBreakout)
 			t.Run(name, func(t *testing.T) {
 				root := createTree(t, tree...)
 
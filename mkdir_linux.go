@@ -7,19 +7,18 @@
 package securejoin
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"golang.org/x/sys/unix"
 )
 
-var (
-	errInvalidMode    = errors.New("invalid permission mode")
-	errPossibleAttack = errors.New("possible attack detected")
-)
+var errInvalidMode = errors.New("invalid permission mode")
 
 // modePermExt is like os.ModePerm except that it also includes the set[ug]id
 // and sticky bits.
@@ -67,6 +66,12 @@ func toUnixMode(mode os.FileMode) (uint32, error) {
 // doing [MkdirAll]. If you intend to open the directory after creating it, you
 // should use MkdirAllHandle.
 func MkdirAllHandle(root *os.File, unsafePath string, mode os.FileMode) (_ *os.File, Err error) {
+	defer func() {
+		if Err != nil {
+			Err = &os.PathError{Op: "securejoin.MkdirAllHandle", Path: unsafePath, Err: Err}
+		}
+	}()
+
 	unixMode, err := toUnixMode(mode)
 	if err != nil {
 		return nil, err
@@ -106,6 +111,22 @@ func MkdirAllHandle(root *os.File, unsafePath string, mode os.FileMode) (_ *os.F
 		return nil, fmt.Errorf("finding existing subpath of %q: %w", unsafePath, err)
 	}
 
+	// If the entire path already exists (the common case when re-running
+	// MkdirAll), there is nothing left to create and we only need to upgrade
+	// the O_PATH handle. Opening "." relative to a directory handle always
+	// gives us the same directory, so there is no need to go through
+	// /proc/self/fd like Reopen does.
+	if err == nil && remainingPath == "" {
+		dir, err := openatFile(currentDir, ".", unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if errors.Is(err, unix.ENOTDIR) {
+			return nil, fmt.Errorf("cannot create subdirectories in %q: %w", currentDir.Name(), unix.ENOTDIR)
+		} else if err != nil {
+			return nil, fmt.Errorf("re-opening handle to %q: %w", currentDir.Name(), err)
+		}
+		_ = currentDir.Close()
+		return dir, nil
+	}
+
 	// Re-open the path to match the O_DIRECTORY reopen loop later (so that we
 	// always return a non-O_PATH handle). We also check that we actually got a
 	// directory.
@@ -164,10 +185,10 @@ func MkdirAllHandle(root *os.File, unsafePath string, mode os.FileMode) (_ *os.F
 		// to use O_PATH.
 		var nextDir *os.File
 		if hasOpenat2() {
-			nextDir, err = openat2File(currentDir, part, &unix.OpenHow{
+			nextDir, err = openat2File(context.Background(), currentDir, part, &unix.OpenHow{
 				Flags:   unix.O_NOFOLLOW | unix.O_DIRECTORY | unix.O_CLOEXEC,
 				Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_XDEV,
-			})
+			}, nil)
 		} else {
 			nextDir, err = openatFile(currentDir, part, unix.O_NOFOLLOW|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
 		}
@@ -200,6 +221,72 @@ func MkdirAllHandle(root *os.File, unsafePath string, mode os.FileMode) (_ *os.F
 	return currentDir, nil
 }
 
+// MkdirAllOptions controls the behaviour of [MkdirAllHandleWithOptions] and
+// [MkdirAllWithOptions]. The zero value is equivalent to [MkdirAllHandle] and
+// [MkdirAll].
+type MkdirAllOptions struct {
+	// MustExistPrefix, if set, is a path inside the root which must already
+	// exist as a directory before any directories are created. unsafePath
+	// must be (lexically) inside MustExistPrefix, otherwise an error wrapping
+	// EINVAL is returned. If MustExistPrefix does not exist (or is not a
+	// directory), an error wrapping [ErrBoundaryMissing] is returned and
+	// nothing is created. This stops MkdirAll from creating directories (such
+	// as mount points) which should have been created ahead of time by
+	// someone else.
+	//
+	// Note that MustExistPrefix is only checked once before creating the
+	// remaining directories, so it does not protect against an attacker that
+	// can remove the boundary directory concurrently.
+	MustExistPrefix string
+}
+
+// checkBoundary makes sure that opts.MustExistPrefix exists as a directory
+// inside root, and that unsafePath is inside it.
+func (opts MkdirAllOptions) checkBoundary(root *os.File, unsafePath string) error {
+	if opts.MustExistPrefix == "" {
+		return nil
+	}
+	prefix := path.Join("/", filepath.ToSlash(opts.MustExistPrefix))
+	cleanPath := path.Join("/", filepath.ToSlash(unsafePath))
+	if prefix != "/" && cleanPath != prefix && !strings.HasPrefix(cleanPath, prefix+"/") {
+		return fmt.Errorf("path %q is not inside boundary %q: %w", unsafePath, opts.MustExistPrefix, unix.EINVAL)
+	}
+	boundary, err := OpenatInRootWithOptions(context.Background(), root, opts.MustExistPrefix, &ResolveOptions{RequireDir: true})
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+			// TODO: Once we bump the minimum Go version to 1.20, we can use
+			// multiple %w verbs for this wrapping. For now we need to use a
+			// compatibility shim for older Go versions.
+			//err = fmt.Errorf("%w: %w", ErrBoundaryMissing, err)
+			err = wrapBaseError(err, ErrBoundaryMissing)
+		}
+		return err
+	}
+	_ = boundary.Close()
+	return nil
+}
+
+// MkdirAllHandleWithOptions is equivalent to [MkdirAllHandle], except that
+// the behaviour can be customised with opts.
+func MkdirAllHandleWithOptions(root *os.File, unsafePath string, mode os.FileMode, opts MkdirAllOptions) (*os.File, error) {
+	if err := opts.checkBoundary(root, unsafePath); err != nil {
+		return nil, &os.PathError{Op: "securejoin.MkdirAllHandle", Path: unsafePath, Err: err}
+	}
+	return MkdirAllHandle(root, unsafePath, mode)
+}
+
+// MkdirAllHandleRaw is equivalent to [MkdirAllHandle], except that the root is
+// provided as a raw file descriptor. MkdirAllHandleRaw does not take ownership
+// of rootFd.
+func MkdirAllHandleRaw(rootFd int, unsafePath string, mode os.FileMode) (*os.File, error) {
+	root, err := dupRawFd(rootFd)
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.MkdirAllHandle", Path: unsafePath, Err: err}
+	}
+	defer root.Close()
+	return MkdirAllHandle(root, unsafePath, mode)
+}
+
 // MkdirAll is a race-safe alternative to the [os.MkdirAll] function,
 // where the new directory is guaranteed to be within the root directory (if an
 // attacker can move directories from inside the root to outside the root, the
@@ -219,15 +306,23 @@ func MkdirAllHandle(root *os.File, unsafePath string, mode os.FileMode) (_ *os.F
 //
 // If you plan to open the directory after you have created it or want to use
 // an open directory handle as the root, you should use [MkdirAllHandle] instead.
-// This function is a wrapper around [MkdirAllHandle].
+// This function is a wrapper around [MkdirAllHandle]. root is handled in the
+// same way as with [OpenInRoot] (an empty root results in an error wrapping
+// [ErrInvalidRoot]).
 func MkdirAll(root, unsafePath string, mode os.FileMode) error {
-	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	return MkdirAllWithOptions(root, unsafePath, mode, MkdirAllOptions{})
+}
+
+// MkdirAllWithOptions is equivalent to [MkdirAll], except that the behaviour
+// can be customised with opts.
+func MkdirAllWithOptions(root, unsafePath string, mode os.FileMode, opts MkdirAllOptions) error {
+	rootDir, err := openRootPath("securejoin.MkdirAll", root, unix.O_PATH)
 	if err != nil {
 		return err
 	}
 	defer rootDir.Close()
 
-	f, err := MkdirAllHandle(rootDir, unsafePath, mode)
+	f, err := MkdirAllHandleWithOptions(rootDir, unsafePath, mode, opts)
 	if err != nil {
 		return err
 	}
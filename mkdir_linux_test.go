@@ -55,6 +55,32 @@ var mkdirAll_MkdirAllHandle mkdirAllFunc = func(t *testing.T, root, unsafePath s
 	return nil
 }
 
+var mkdirAll_MkdirAllHandleRaw mkdirAllFunc = func(t *testing.T, root, unsafePath string, mode os.FileMode) error {
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer rootDir.Close()
+	handle, err := MkdirAllHandleRaw(int(rootDir.Fd()), unsafePath, mode)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	// The caller's fd must not have been closed.
+	_, err = unix.FcntlInt(rootDir.Fd(), unix.F_GETFD, 0)
+	require.NoError(t, err, "root fd should still be open after MkdirAllHandleRaw")
+
+	expectedPath, err := SecureJoin(root, unsafePath)
+	require.NoError(t, err)
+
+	gotPath, err := procSelfFdReadlink(handle)
+	require.NoError(t, err, "get real path of returned handle")
+	assert.Equal(t, expectedPath, gotPath, "wrong final path from MkdirAllHandleRaw")
+	assert.Equal(t, expectedPath, handle.Name(), "handle from MkdirAllHandleRaw has the wrong .Name()")
+	return nil
+}
+
 func checkMkdirAll(t *testing.T, mkdirAll mkdirAllFunc, root, unsafePath string, mode os.FileMode, expectedMode int, expectedErr error) {
 	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
 	require.NoError(t, err)
@@ -138,6 +164,9 @@ func testMkdirAll_Basic(t *testing.T, mkdirAll mkdirAllFunc) {
 			expectedModeBits int
 		}{
 			"existing":              {unsafePath: "a"},
+			"existing-deep":         {unsafePath: "b/c/d/e/f"},
+			"existing-symlink":      {unsafePath: "e"},
+			"existing-nonlexical":   {unsafePath: "link3/target_rel"},
 			"basic":                 {unsafePath: "a/b/c/d/e/f/g/h/i/j"},
 			"dotdot-in-nonexisting": {unsafePath: "a/b/c/d/e/f/g/h/i/j/k/../lmnop", expectedErr: unix.ENOENT},
 			"dotdot-in-existing":    {unsafePath: "b/c/../c/./d/e/f/g/h"},
@@ -204,6 +233,10 @@ func TestMkdirAllHandle_Basic(t *testing.T) {
 	testMkdirAll_Basic(t, mkdirAll_MkdirAllHandle)
 }
 
+func TestMkdirAllHandleRaw_Basic(t *testing.T) {
+	testMkdirAll_Basic(t, mkdirAll_MkdirAllHandleRaw)
+}
+
 func testMkdirAll_AsRoot(t *testing.T, mkdirAll mkdirAllFunc) {
 	requireRoot(t) // chown
 
@@ -289,6 +322,116 @@ func TestMkdirAllHandle_InvalidMode(t *testing.T) {
 	testMkdirAll_InvalidMode(t, mkdirAll_MkdirAllHandle)
 }
 
+func TestMkdirAllHandle_Existing(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t, "dir a/b/c", "file a/b/c/file", "symlink link a/b")
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, unsafePath := range []string{"a/b/c", "link/c", "link"} {
+			handle, err := MkdirAllHandle(rootDir, unsafePath, 0o755)
+			require.NoErrorf(t, err, "MkdirAllHandle(%q)", unsafePath)
+
+			// The returned handle must be a real (non-O_PATH) directory
+			// handle, even if nothing was created.
+			flags, err := unix.FcntlInt(handle.Fd(), unix.F_GETFL, 0)
+			require.NoError(t, err)
+			assert.Zerof(t, flags&unix.O_PATH, "MkdirAllHandle(%q) should not return an O_PATH handle", unsafePath)
+			_, err = handle.Readdirnames(-1)
+			assert.NoErrorf(t, err, "readdir MkdirAllHandle(%q) handle", unsafePath)
+			_ = handle.Close()
+		}
+
+		_, err = MkdirAllHandle(rootDir, "a/b/c/file", 0o755)
+		assert.ErrorIs(t, err, unix.ENOTDIR, "MkdirAllHandle of existing file")
+	})
+}
+
+func TestMkdirAllHandleWithOptions_MustExistPrefix(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t, "dir mnt/a", "file file", "symlink link mnt")
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			prefix, unsafePath string
+			expectedErr        error
+		}{
+			{"", "x/y", nil},
+			{"/", "x/y", nil},
+			{"mnt", "mnt/a/b/c", nil},
+			{"/mnt/", "mnt/new/dir", nil},
+			{"mnt/a", "mnt/a", nil},
+			// Symlinks in the prefix are resolved inside the root.
+			{"link", "link/b", nil},
+			// The boundary must exist, and must be a directory.
+			{"nonexist", "nonexist/a/b", ErrBoundaryMissing},
+			{"mnt/nonexist", "mnt/nonexist/a", ErrBoundaryMissing},
+			{"file", "file/a", ErrBoundaryMissing},
+			// The path must be inside the boundary.
+			{"mnt", "other/a", unix.EINVAL},
+			{"mnt", "mntfoo", unix.EINVAL},
+		} {
+			handle, err := MkdirAllHandleWithOptions(rootDir, test.unsafePath, 0o755, MkdirAllOptions{MustExistPrefix: test.prefix})
+			if test.expectedErr != nil {
+				assert.ErrorIsf(t, err, test.expectedErr, "MkdirAllHandleWithOptions(%q, MustExistPrefix=%q)", test.unsafePath, test.prefix)
+				assert.Nil(t, handle, "handle should be nil on error")
+				// Nothing should have been created.
+				_, err := os.Lstat(filepath.Join(root, test.unsafePath))
+				assert.Truef(t, IsNotExist(err), "MkdirAllHandleWithOptions(%q) should not create anything on error: %v", test.unsafePath, err)
+				continue
+			}
+			if assert.NoErrorf(t, err, "MkdirAllHandleWithOptions(%q, MustExistPrefix=%q)", test.unsafePath, test.prefix) {
+				_ = handle.Close()
+			}
+		}
+
+		err = MkdirAllWithOptions(root, "nonexist/a", 0o755, MkdirAllOptions{MustExistPrefix: "nonexist"})
+		assert.ErrorIs(t, err, ErrBoundaryMissing, "MkdirAllWithOptions with missing boundary")
+	})
+}
+
+func BenchmarkMkdirAllHandle(b *testing.B) {
+	const existingPath = "a/b/c/d/e/f/g/h/i/j"
+	root := createTree(b, "dir "+existingPath)
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(b, err)
+	defer rootDir.Close()
+
+	// Re-running MkdirAllHandle on a tree that already exists can skip
+	// re-opening the handle through /proc.
+	b.Run("existing", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			handle, err := MkdirAllHandle(rootDir, existingPath, 0o755)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_ = handle.Close()
+		}
+	})
+
+	// Creating a single new directory needs to take the slow path.
+	b.Run("create-final", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			handle, err := MkdirAllHandle(rootDir, existingPath+"/new", 0o755)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_ = handle.Close()
+
+			b.StopTimer()
+			if err := os.Remove(filepath.Join(root, existingPath, "new")); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+		}
+	})
+}
+
 type racingMkdirMeta struct {
 	passOkCount, passErrCount, failCount int
 	passErrCounts                        map[error]int
@@ -446,9 +589,9 @@ func TestMkdirAllHandle_RacingDelete(t *testing.T) {
 			unsafePath  string
 			allowedErrs []error
 		}{
-			{"rm-top", "target", "target/a/b/c/d/e/f/g/h/i/j/k", []error{errInvalidDirectory, unix.ENOENT}},
-			{"rm-existing", "target/a/b/c", "target/a/b/c/d/e/f/g/h/i/j/k", []error{errInvalidDirectory, unix.ENOENT}},
-			{"rm-nonexisting", "target/a/b/c/d/e", "target/a/b/c/d/e/f/g/h/i/j/k", []error{errInvalidDirectory, unix.ENOENT}},
+			{"rm-top", "target", "target/a/b/c/d/e/f/g/h/i/j/k", []error{ErrInvalidDirectory, unix.ENOENT}},
+			{"rm-existing", "target/a/b/c", "target/a/b/c/d/e/f/g/h/i/j/k", []error{ErrInvalidDirectory, unix.ENOENT}},
+			{"rm-nonexisting", "target/a/b/c/d/e", "target/a/b/c/d/e/f/g/h/i/j/k", []error{ErrInvalidDirectory, unix.ENOENT}},
 		} {
 			test := test // copy iterator
 			t.Run(test.rmPath, func(t *testing.T) {
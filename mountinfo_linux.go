@@ -0,0 +1,177 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// MountEntry is a single entry in a mountinfo file. See proc_pid_mountinfo(5)
+// for more details about the meaning of each field.
+type MountEntry struct {
+	// MountID is the unique (for the lifetime of the mount) ID of the mount.
+	MountID int
+	// ParentID is the mount ID of the parent mount (or of the mount itself
+	// for the root of the mount namespace).
+	ParentID int
+	// Major and Minor are the device numbers of st_dev for files on this
+	// filesystem.
+	Major, Minor int
+	// Root is the path of the directory in the filesystem which forms the
+	// root of this mount.
+	Root string
+	// MountPoint is the path of the mount point relative to the process's
+	// root directory.
+	MountPoint string
+	// Options contains the per-mount options.
+	Options string
+	// OptionalFields contains the optional "tag[:value]" fields (such as
+	// "shared:1" or "master:2").
+	OptionalFields []string
+	// FSType is the filesystem type (in the form "type[.subtype]").
+	FSType string
+	// Source is the filesystem-specific mount source (or "none").
+	Source string
+	// SuperOptions contains the per-superblock options.
+	SuperOptions string
+}
+
+// OpenMountinfo returns a handle to the mountinfo file of the current thread
+// (/proc/thread-self/mountinfo), opened through the same hardened procfs
+// handle used internally by this package. This avoids being tricked into
+// reading a fake mountinfo file by an attacker that has over-mounted parts of
+// /proc. The returned file can be passed to [ParseMountinfo].
+//
+// The contents of the file describe the mount namespace the calling thread
+// was in when OpenMountinfo was called, and do not change if the file is read
+// from another thread.
+func OpenMountinfo() (*os.File, error) {
+	procRoot, err := getProcRoot()
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.OpenMountinfo", Path: "/proc/thread-self/mountinfo", Err: err}
+	}
+	handle, closer, err := procThreadSelf(procRoot, "mountinfo")
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.OpenMountinfo", Path: "/proc/thread-self/mountinfo", Err: err}
+	}
+	defer handle.Close()
+	defer closer()
+
+	return Reopen(handle, unix.O_RDONLY)
+}
+
+// unescapeMountinfo undoes the octal escaping ("\040" and so on) that the
+// kernel applies to whitespace and backslashes in mountinfo path fields.
+func unescapeMountinfo(field string) (string, error) {
+	if !strings.Contains(field, `\`) {
+		return field, nil
+	}
+	var buf strings.Builder
+	buf.Grow(len(field))
+	for i := 0; i < len(field); i++ {
+		if field[i] != '\\' {
+			buf.WriteByte(field[i])
+			continue
+		}
+		if i+3 >= len(field) {
+			return "", fmt.Errorf("truncated escape sequence in %q", field)
+		}
+		ch, err := strconv.ParseUint(field[i+1:i+4], 8, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in %q: %w", field, err)
+		}
+		buf.WriteByte(byte(ch))
+		i += 3
+	}
+	return buf.String(), nil
+}
+
+func parseMountinfoLine(line string) (MountEntry, error) {
+	var entry MountEntry
+
+	// The line is made up of a set of fixed fields, an arbitrary number of
+	// optional fields, a "-" separator, and then some more fixed fields.
+	fields := strings.Split(line, " ")
+	sepIdx := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sepIdx = i
+			break
+		}
+	}
+	if len(fields) < 10 || sepIdx == -1 || len(fields) != sepIdx+4 {
+		return entry, fmt.Errorf("unexpected number of fields (%d)", len(fields))
+	}
+
+	var err error
+	if entry.MountID, err = strconv.Atoi(fields[0]); err != nil {
+		return entry, fmt.Errorf("parse mount id: %w", err)
+	}
+	if entry.ParentID, err = strconv.Atoi(fields[1]); err != nil {
+		return entry, fmt.Errorf("parse parent id: %w", err)
+	}
+	major, minor, ok := strings.Cut(fields[2], ":")
+	if !ok {
+		return entry, fmt.Errorf("parse device number %q: missing ':'", fields[2])
+	}
+	if entry.Major, err = strconv.Atoi(major); err != nil {
+		return entry, fmt.Errorf("parse device major: %w", err)
+	}
+	if entry.Minor, err = strconv.Atoi(minor); err != nil {
+		return entry, fmt.Errorf("parse device minor: %w", err)
+	}
+	if entry.Root, err = unescapeMountinfo(fields[3]); err != nil {
+		return entry, fmt.Errorf("parse root: %w", err)
+	}
+	if entry.MountPoint, err = unescapeMountinfo(fields[4]); err != nil {
+		return entry, fmt.Errorf("parse mount point: %w", err)
+	}
+	entry.Options = fields[5]
+	if sepIdx > 6 {
+		entry.OptionalFields = fields[6:sepIdx]
+	}
+	entry.FSType = fields[sepIdx+1]
+	if entry.Source, err = unescapeMountinfo(fields[sepIdx+2]); err != nil {
+		return entry, fmt.Errorf("parse mount source: %w", err)
+	}
+	entry.SuperOptions = fields[sepIdx+3]
+	return entry, nil
+}
+
+// ParseMountinfo parses the contents of a mountinfo file (in the format
+// described in proc_pid_mountinfo(5)), such as one returned by
+// [OpenMountinfo]. Escaped characters in the path fields are unescaped.
+func ParseMountinfo(r io.Reader) ([]MountEntry, error) {
+	var entries []MountEntry
+
+	scanner := bufio.NewScanner(r)
+	// Mount paths can be up to PATH_MAX each, so make sure we can handle
+	// lines that are longer than the default limit.
+	scanner.Buffer(nil, 4*unix.PathMax+bufio.MaxScanTokenSize)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		entry, err := parseMountinfoLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("parse mountinfo line %d: %w", lineNum, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read mountinfo: %w", err)
+	}
+	return entries, nil
+}
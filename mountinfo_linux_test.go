@@ -0,0 +1,80 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMountinfo(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		mountinfo string
+		expected  []MountEntry
+		expectErr bool
+	}{
+		{"Basic", "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro\n", []MountEntry{
+			{MountID: 22, ParentID: 1, Major: 8, Minor: 1, Root: "/", MountPoint: "/", Options: "rw,relatime", OptionalFields: []string{"shared:1"}, FSType: "ext4", Source: "/dev/sda1", SuperOptions: "rw,errors=remount-ro"},
+		}, false},
+		{"NoOptionalFields", "40 22 0:5 / /proc rw,nosuid - proc proc rw\n", []MountEntry{
+			{MountID: 40, ParentID: 22, Major: 0, Minor: 5, Root: "/", MountPoint: "/proc", Options: "rw,nosuid", FSType: "proc", Source: "proc", SuperOptions: "rw"},
+		}, false},
+		{"MultipleOptionalFields", "41 22 0:6 /sub /mnt/a ro shared:2 master:1 propagate_from:1 - tmpfs none rw\n", []MountEntry{
+			{MountID: 41, ParentID: 22, Major: 0, Minor: 6, Root: "/sub", MountPoint: "/mnt/a", Options: "ro", OptionalFields: []string{"shared:2", "master:1", "propagate_from:1"}, FSType: "tmpfs", Source: "none", SuperOptions: "rw"},
+		}, false},
+		{"Escaped", `42 22 0:7 /a\134b /mnt/with\040space\011tab rw - fuse.sshfs host:/x\040y rw` + "\n", []MountEntry{
+			{MountID: 42, ParentID: 22, Major: 0, Minor: 7, Root: `/a\b`, MountPoint: "/mnt/with space\ttab", Options: "rw", FSType: "fuse.sshfs", Source: "host:/x y", SuperOptions: "rw"},
+		}, false},
+		{"MultipleLines", "1 0 0:1 / / rw - rootfs rootfs rw\n\n2 1 0:2 / /tmp rw - tmpfs tmpfs rw", []MountEntry{
+			{MountID: 1, ParentID: 0, Major: 0, Minor: 1, Root: "/", MountPoint: "/", Options: "rw", FSType: "rootfs", Source: "rootfs", SuperOptions: "rw"},
+			{MountID: 2, ParentID: 1, Major: 0, Minor: 2, Root: "/", MountPoint: "/tmp", Options: "rw", FSType: "tmpfs", Source: "tmpfs", SuperOptions: "rw"},
+		}, false},
+		{"Empty", "", nil, false},
+		// Invalid lines.
+		{"MissingSeparator", "22 1 8:1 / / rw shared:1 ext4 /dev/sda1 rw\n", nil, true},
+		{"TooFewFields", "22 1 8:1 / / rw - ext4 /dev/sda1\n", nil, true},
+		{"BadMountID", "a 1 8:1 / / rw - ext4 /dev/sda1 rw\n", nil, true},
+		{"BadDevice", "22 1 81 / / rw - ext4 /dev/sda1 rw\n", nil, true},
+		{"BadEscape", `22 1 8:1 / /mnt\09 rw - ext4 /dev/sda1 rw` + "\n", nil, true},
+	} {
+		test := test // copy iterator
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := ParseMountinfo(strings.NewReader(test.mountinfo))
+			if test.expectErr {
+				assert.Error(t, err, "ParseMountinfo should fail")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, entries, "parsed mountinfo")
+		})
+	}
+}
+
+func TestOpenMountinfo(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		testForceGetProcRoot(t, func(t *testing.T, expectOvermounts bool) {
+			f, err := OpenMountinfo()
+			require.NoError(t, err)
+			defer f.Close()
+
+			entries, err := ParseMountinfo(f)
+			require.NoError(t, err)
+
+			var foundRoot bool
+			for _, entry := range entries {
+				if entry.MountPoint == "/" {
+					foundRoot = true
+				}
+			}
+			assert.True(t, foundRoot, "mountinfo should contain an entry for /")
+		})
+	})
+}
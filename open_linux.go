@@ -7,23 +7,182 @@
 package securejoin
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"golang.org/x/sys/unix"
 )
 
 // OpenatInRoot is equivalent to [OpenInRoot], except that the root is provided
 // using an *[os.File] handle, to ensure that the correct root directory is used.
+//
+// If unsafePath refers to the root itself ("", "." or "/"), a new O_DIRECTORY
+// handle to the root is returned. This is always a separate file descriptor
+// from root, so it is safe to close either handle independently.
+//
+// As with path resolution on Linux, a trailing slash in unsafePath requires
+// the final component to be a directory (a trailing symlink is followed in
+// order to check this). If the final component is not a directory, an error
+// wrapping ENOTDIR is returned. Callers that strip trailing slashes from
+// unsafePath will lose this check, and can use [ResolveOptions.RequireDir]
+// to enforce it explicitly.
 func OpenatInRoot(root *os.File, unsafePath string) (*os.File, error) {
-	handle, err := completeLookupInRoot(root, unsafePath)
+	return OpenatInRootContext(context.Background(), root, unsafePath)
+}
+
+// OpenatInRootContext is equivalent to [OpenatInRoot], except that the lookup
+// can be interrupted by cancelling ctx. The context is checked before each
+// path component is walked and before each openat2(2) attempt, so that
+// pathological lookups (such as those with many symlinks, or those being
+// retried due to an attacker renaming directories) can be bounded. If the
+// context is cancelled, the returned error wraps ctx.Err().
+func OpenatInRootContext(ctx context.Context, root *os.File, unsafePath string) (*os.File, error) {
+	return OpenatInRootWithOptions(ctx, root, unsafePath, nil)
+}
+
+// OpenatInRootWithOptions is equivalent to [OpenatInRootContext], except that
+// the behaviour of the lookup can be customised with opts. A nil opts is
+// equivalent to the default behaviour.
+func OpenatInRootWithOptions(ctx context.Context, root *os.File, unsafePath string, opts *ResolveOptions) (*os.File, error) {
+	handle, err := completeLookupInRoot(ctx, root, unsafePath, opts)
+	if err != nil {
+		return nil, newResolveError("securejoin.OpenInRoot", unsafePath, err)
+	}
+	return handle, nil
+}
+
+// OpenRelativeTo opens exactly one path component (singleComponent) inside the
+// directory referenced by parent, and returns an O_PATH handle to it. This is
+// a lower-level primitive intended for callers that already hold a chain of
+// directory handles (such as from a previous walk) and want to build their
+// own confined walks.
+//
+// parent is treated as the root of the lookup, so if singleComponent is a
+// symlink it is resolved inside parent (in the same way as
+// [OpenatInRootWithOptions]) and can never escape above parent. If
+// opts.NoFollowTrailing is set, a symlink is not followed and a handle to the
+// symlink itself is returned (as with O_NOFOLLOW). All of the other options
+// in opts are supported, and a nil opts is equivalent to the default
+// behaviour.
+//
+// singleComponent must be a single non-empty path component, and so must not
+// contain any "/" characters or be "." or "..". Otherwise, an error wrapping
+// EINVAL is returned.
+func OpenRelativeTo(parent *os.File, singleComponent string, opts *ResolveOptions) (*os.File, error) {
+	if singleComponent == "" || singleComponent == "." || singleComponent == ".." || strings.ContainsRune(singleComponent, '/') {
+		return nil, &os.PathError{Op: "securejoin.OpenRelativeTo", Path: singleComponent, Err: fmt.Errorf("path must be a single component: %w", unix.EINVAL)}
+	}
+	handle, err := completeLookupInRoot(context.Background(), parent, singleComponent, opts)
 	if err != nil {
-		return nil, &os.PathError{Op: "securejoin.OpenInRoot", Path: unsafePath, Err: err}
+		return nil, newResolveError("securejoin.OpenRelativeTo", singleComponent, err)
 	}
 	return handle, nil
 }
 
+// OpenatInRootPartial is equivalent to [OpenatInRoot], except that if the
+// lookup fails because a component of unsafePath does not exist (ENOENT) or
+// is not a directory (ENOTDIR), a handle to the deepest existing component of
+// unsafePath is returned along with the remaining path components that could
+// not be walked (as well as the error). This allows callers to decide how to
+// handle the remaining components (such as creating them) without needing to
+// re-do the lookup from the root.
+//
+// If the lookup succeeds, the remaining path is always "". For any other
+// error, no handle is returned.
+func OpenatInRootPartial(root *os.File, unsafePath string) (*os.File, string, error) {
+	handle, remainingPath, err := partialLookupInRoot(root, unsafePath)
+	if err != nil {
+		if handle != nil && (errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR)) {
+			return handle, remainingPath, newResolveError("securejoin.OpenInRootPartial", unsafePath, err)
+		}
+		if handle != nil {
+			_ = handle.Close()
+		}
+		return nil, "", newResolveError("securejoin.OpenInRootPartial", unsafePath, err)
+	}
+	return handle, remainingPath, nil
+}
+
+// DeepestExisting returns an O_PATH handle to the deepest existing ancestor of
+// unsafePath inside root, along with the remaining components of unsafePath
+// that do not exist yet. This is useful before creating something at
+// unsafePath, as the remaining components can be created relative to the
+// returned handle without needing to re-do the lookup from the root.
+//
+// Unlike [OpenatInRootPartial], a path that does not (fully) exist is not
+// treated as an error. If unsafePath already exists, a handle to it is
+// returned (which may not be a directory) and remaining is "". Otherwise,
+// ancestor is always a directory. Note that the first component of remaining
+// may be a dangling symlink.
+//
+// If any other error occurs during the lookup (including if a component of
+// unsafePath is not a directory, which means the remaining components can
+// never be created), no handle is returned.
+func DeepestExisting(root *os.File, unsafePath string) (ancestor *os.File, remaining string, err error) {
+	handle, remainingPath, err := partialLookupInRoot(root, unsafePath)
+	if err != nil {
+		if handle != nil && errors.Is(err, unix.ENOENT) {
+			return handle, remainingPath, nil
+		}
+		if handle != nil {
+			_ = handle.Close()
+		}
+		return nil, "", newResolveError("securejoin.DeepestExisting", unsafePath, err)
+	}
+	return handle, remainingPath, nil
+}
+
+// OpenatInRootRaw is equivalent to [OpenatInRoot], except that the root is
+// provided as a raw file descriptor. This is intended for callers (such as
+// programs using cgo) that do not hold their directory handles as *[os.File].
+//
+// OpenatInRootRaw does not take ownership of rootFd -- it is never closed by
+// this function, and the caller is free to close it once OpenatInRootRaw has
+// returned.
+func OpenatInRootRaw(rootFd int, unsafePath string) (*os.File, error) {
+	root, err := dupRawFd(rootFd)
+	if err != nil {
+		return nil, newResolveError("securejoin.OpenInRoot", unsafePath, err)
+	}
+	defer root.Close()
+	return OpenatInRoot(root, unsafePath)
+}
+
+// openRootPath opens a handle (with the provided open flags, in addition to
+// O_DIRECTORY and O_CLOEXEC) to the root directory path used by the
+// path-based helpers (such as [OpenInRoot]). An empty root is rejected with
+// an error wrapping [ErrInvalidRoot], and a relative root is resolved
+// (relative to the current directory) only once, when the handle is opened.
+// The returned handle is named using the cleaned absolute path of the root,
+// so that the names of handles derived from it do not depend on the current
+// directory.
+func openRootPath(op, root string, flags int) (*os.File, error) {
+	if root == "" {
+		return nil, &os.PathError{Op: op, Path: root, Err: ErrInvalidRoot}
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: root, Err: err}
+	}
+	rootDir, err := os.OpenFile(absRoot, flags|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, unix.ENOTDIR) {
+			// ENOTDIR is also returned if a parent directory of the root is
+			// not a directory, so check that the root itself exists.
+			if fi, statErr := os.Stat(absRoot); statErr == nil && !fi.IsDir() {
+				err = &os.PathError{Op: op, Path: root, Err: ErrRootNotDirectory}
+			}
+		}
+		return nil, err
+	}
+	return rootDir, nil
+}
+
 // OpenInRoot safely opens the provided unsafePath within the root.
 // Effectively, OpenInRoot(root, unsafePath) is equivalent to
 //
@@ -40,8 +199,14 @@ func OpenatInRoot(root *os.File, unsafePath string) (*os.File, error) {
 // disconnected TTY that could cause a DoS, or some other issue). In order to
 // use the returned handle, you can "upgrade" it to a proper handle using
 // [Reopen].
+//
+// If root is a relative path, it is resolved relative to the current
+// directory once (when the root is opened) and the lookup is then done
+// relative to the root handle. An empty root is not treated as the current
+// directory, and results in an error wrapping [ErrInvalidRoot]. If root is not
+// a directory, an error wrapping [ErrRootNotDirectory] is returned.
 func OpenInRoot(root, unsafePath string) (*os.File, error) {
-	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	rootDir, err := openRootPath("securejoin.OpenInRoot", root, unix.O_PATH)
 	if err != nil {
 		return nil, err
 	}
@@ -49,6 +214,117 @@ func OpenInRoot(root, unsafePath string) (*os.File, error) {
 	return OpenatInRoot(rootDir, unsafePath)
 }
 
+// OpenatInRootFd is equivalent to [OpenatInRoot], except that both the root and
+// the returned handle are raw file descriptors. This is intended for callers
+// (such as C programs embedding Go code with cgo) where allocating an
+// *[os.File] for every handle is undesirable.
+//
+// OpenatInRootFd does not take ownership of rootFd. The returned file
+// descriptor is owned by the caller, who is responsible for closing it (it is
+// not tracked by the Go runtime, and so will never be closed automatically).
+// The returned file descriptor always has O_CLOEXEC set.
+//
+// On kernels without openat2(2), the lookup is done using *[os.File] handles
+// internally and so the allocation savings only apply to newer kernels.
+func OpenatInRootFd(rootFd int, unsafePath string) (int, error) {
+	if err := checkRootIsDir(rootFd, "fd:"+strconv.Itoa(rootFd)); err != nil {
+		return -1, newResolveError("securejoin.OpenInRoot", unsafePath, err)
+	}
+	if isRootPath(unsafePath) {
+		fd, err := unix.Openat(rootFd, ".", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return -1, newResolveError("securejoin.OpenInRoot", unsafePath, os.NewSyscallError("openat", err))
+		}
+		return fd, nil
+	}
+	if hasOpenat2() {
+		fd, err := openat2(context.Background(), rootFd, unsafePath, &unix.OpenHow{
+			Flags:   unix.O_PATH | unix.O_CLOEXEC,
+			Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+		}, nil)
+		if err != nil {
+			// Figure out which component failed to resolve. This is only
+			// done in the error path, so the extra work is not an issue.
+			if root, dupErr := dupRawFd(rootFd); dupErr == nil {
+				err = openat2ResolveError(context.Background(), root, unsafePath, err)
+				_ = root.Close()
+			}
+			return -1, newResolveError("securejoin.OpenInRoot", unsafePath, err)
+		}
+		return fd, nil
+	}
+
+	handle, err := OpenatInRootRaw(rootFd, unsafePath)
+	if err != nil {
+		return -1, err
+	}
+	defer handle.Close()
+
+	// Get our own copy of the file descriptor, so that the *os.File can be
+	// closed without affecting the returned fd.
+	fd, err := unix.FcntlInt(handle.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "securejoin.OpenInRoot", Path: unsafePath, Err: os.NewSyscallError("fcntl(F_DUPFD_CLOEXEC)", err)}
+	}
+	return fd, nil
+}
+
+// OpenInRootFd is equivalent to [OpenInRoot], except that the returned handle
+// is a raw file descriptor. See [OpenatInRootFd] for more details about the
+// ownership of the returned file descriptor.
+func OpenInRootFd(root, unsafePath string) (int, error) {
+	rootDir, err := openRootPath("securejoin.OpenInRoot", root, unix.O_PATH)
+	if err != nil {
+		return -1, err
+	}
+	defer rootDir.Close()
+	return OpenatInRootFd(int(rootDir.Fd()), unsafePath)
+}
+
+// OpenRootRW opens a handle to the root directory path for use as the root
+// of write-heavy operations (such as extracting an archive with
+// [MkdirAllHandle] and [CreateAllInRoot]). The root is handled in the same way
+// as with [OpenInRoot].
+//
+// The returned handle is opened with O_DIRECTORY|O_RDONLY (directory handles
+// do not need to be writable to create files relative to them), and so it
+// can also be used for operations that require a non-O_PATH handle (such as
+// fsync(2)). If the filesystem containing the root is mounted read-only, an
+// error wrapping EROFS is returned immediately, rather than failing part way
+// through the caller's operations. Note that this does not guarantee that
+// writes will succeed (the caller may not have write access to the root, and
+// the filesystem could be remounted read-only later).
+func OpenRootRW(root string) (*os.File, error) {
+	rootDir, err := openRootPath("securejoin.OpenRootRW", root, unix.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	var statfs unix.Statfs_t
+	if err := unix.Fstatfs(int(rootDir.Fd()), &statfs); err != nil {
+		_ = rootDir.Close()
+		return nil, &os.PathError{Op: "securejoin.OpenRootRW", Path: root, Err: os.NewSyscallError("fstatfs", err)}
+	}
+	if statfs.Flags&unix.ST_RDONLY != 0 {
+		_ = rootDir.Close()
+		return nil, &os.PathError{Op: "securejoin.OpenRootRW", Path: root, Err: unix.EROFS}
+	}
+	return rootDir, nil
+}
+
+// LstatHandleInRoot returns an O_PATH|O_NOFOLLOW handle to the final component
+// of unsafePath within root, in the same way as [OpenatInRoot] except that a
+// trailing symlink is not followed. The returned handle is never upgraded, so
+// no open(2) side effects can occur (devices are not opened, and FIFOs cannot
+// block), which makes it safe to [os.File.Stat] any kind of inode.
+//
+// This is equivalent to calling [OpenatInRootWithOptions] with
+// [ResolveOptions.NoFollowTrailing] set.
+func LstatHandleInRoot(root *os.File, unsafePath string) (*os.File, error) {
+	return OpenatInRootWithOptions(context.Background(), root, unsafePath, &ResolveOptions{
+		NoFollowTrailing: true,
+	})
+}
+
 // Reopen takes an *[os.File] handle and re-opens it through /proc/self/fd.
 // Reopen(file, flags) is effectively equivalent to
 //
@@ -63,7 +339,54 @@ func OpenInRoot(root, unsafePath string) (*os.File, error) {
 //
 // [CVE-2019-19921]: https://github.com/advisories/GHSA-fh74-hm69-rqjw
 func Reopen(handle *os.File, flags int) (*os.File, error) {
-	procRoot, err := getProcRoot()
+	return ReopenWithOptions(handle, flags, nil)
+}
+
+// reopenStatusFlags are the file status flags which are copied to the new
+// handle by ReopenWithOptions if [ReopenOptions.PreserveStatusFlags] is set.
+const reopenStatusFlags = unix.O_APPEND | unix.O_NONBLOCK | unix.O_DIRECT | unix.O_NOATIME | unix.O_SYNC | unix.O_DSYNC
+
+// ReopenOptions contains optional settings for [ReopenWithOptions].
+type ReopenOptions struct {
+	// ResolveOptions, if set, is used for the internal procfs operations done
+	// while re-opening the handle. Only [ResolveOptions.SkipOvermountCheck]
+	// and [ResolveOptions.ProcRoot] are applicable, all other options are
+	// ignored.
+	ResolveOptions *ResolveOptions
+
+	// PreserveStatusFlags causes the file status flags (O_APPEND, O_NONBLOCK,
+	// O_DIRECT, O_NOATIME, O_SYNC and O_DSYNC) of the original handle to be
+	// copied onto the re-opened handle, in addition to the flags requested by
+	// the caller. This allows for a handle to be re-opened with a different
+	// access mode without losing (for instance) O_APPEND.
+	PreserveStatusFlags bool
+}
+
+// resolveOptions returns opts.ResolveOptions, which may be nil.
+func (opts *ReopenOptions) resolveOptions() *ResolveOptions {
+	if opts == nil {
+		return nil
+	}
+	return opts.ResolveOptions
+}
+
+// preserveStatusFlags returns whether opts.PreserveStatusFlags is set.
+func (opts *ReopenOptions) preserveStatusFlags() bool {
+	return opts != nil && opts.PreserveStatusFlags
+}
+
+// ReopenWithOptions is equivalent to [Reopen], except that the behaviour can
+// be customised with opts. See [ReopenOptions] for more details. A nil opts
+// is equivalent to [Reopen].
+func ReopenWithOptions(handle *os.File, flags int, opts *ReopenOptions) (_ *os.File, Err error) {
+	defer func() {
+		if Err != nil {
+			Err = &os.PathError{Op: "securejoin.Reopen", Path: handle.Name(), Err: Err}
+		}
+	}()
+
+	resolveOpts := opts.resolveOptions()
+	procRoot, err := resolveOpts.procRoot()
 	if err != nil {
 		return nil, err
 	}
@@ -88,8 +411,18 @@ func Reopen(handle *os.File, flags int) (*os.File, error) {
 	// [1]: Linux commit ee2e3f50629f ("mount: fix mounting of detached mounts
 	// onto targets that reside on shared mounts").
 	fdStr := strconv.Itoa(int(handle.Fd()))
-	if err := checkSymlinkOvermount(procRoot, procFdDir, fdStr); err != nil {
-		return nil, fmt.Errorf("check safety of /proc/thread-self/fd/%s magiclink: %w", fdStr, err)
+	if !resolveOpts.skipOvermountCheck() {
+		if err := checkSymlinkOvermount(procRoot, procFdDir, fdStr); err != nil {
+			return nil, fmt.Errorf("check safety of /proc/thread-self/fd/%s magiclink: %w", fdStr, err)
+		}
+	}
+
+	if opts.preserveStatusFlags() {
+		oldFlags, err := unix.FcntlInt(handle.Fd(), unix.F_GETFL, 0)
+		if err != nil {
+			return nil, os.NewSyscallError("fcntl(F_GETFL)", err)
+		}
+		flags |= oldFlags & reopenStatusFlags
 	}
 
 	flags |= unix.O_CLOEXEC
@@ -101,3 +434,189 @@ func Reopen(handle *os.File, flags int) (*os.File, error) {
 	}
 	return os.NewFile(uintptr(reopenFd), handle.Name()), nil
 }
+
+// ReopenRaw is equivalent to [Reopen], except that the handle is provided as a
+// raw file descriptor. ReopenRaw does not take ownership of fd.
+func ReopenRaw(fd int, flags int) (*os.File, error) {
+	handle, err := dupRawFd(fd)
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.Reopen", Path: "fd:" + strconv.Itoa(fd), Err: err}
+	}
+	defer handle.Close()
+	return Reopen(handle, flags)
+}
+
+// DupFd returns a new *os.File referencing a duplicate of the file descriptor
+// of f (created with F_DUPFD_CLOEXEC), with the same name as f. The returned
+// file has an independent lifetime to f, which makes it possible to hand a
+// root handle to another goroutine (or a subprocess) without the risk that
+// closing one of the *os.File handles will close the file descriptor that is
+// still being used by the other. The caller must close the returned file once
+// they are done with it.
+func DupFd(f *os.File) (*os.File, error) {
+	dup, err := dupFile(f)
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.DupFd", Path: f.Name(), Err: err}
+	}
+	return dup, nil
+}
+
+// ReopenTmpfile creates a new unnamed temporary file (using O_TMPFILE) inside
+// the directory referenced by dirHandle (which may be an O_PATH handle, such as
+// one returned by [OpenatInRoot]). flags must contain either O_WRONLY or
+// O_RDWR, and mode is the mode of the new file (subject to the process umask).
+// If O_EXCL is included in flags, the file can never be linked into the
+// filesystem.
+//
+// Unlike [Reopen], the directory is not re-opened through /proc -- the new
+// file is created relative to dirHandle directly, so an attacker cannot
+// redirect it to another directory. This makes it simple to implement atomic
+// writes, by writing to the returned file and then linking it into place.
+//
+// If the kernel or the filesystem does not support O_TMPFILE, an error
+// wrapping [ErrUnsupported] is returned.
+func ReopenTmpfile(dirHandle *os.File, flags int, mode os.FileMode) (*os.File, error) {
+	if accMode := flags & unix.O_ACCMODE; accMode != unix.O_WRONLY && accMode != unix.O_RDWR {
+		return nil, &os.PathError{Op: "securejoin.ReopenTmpfile", Path: dirHandle.Name(), Err: fmt.Errorf("O_TMPFILE requires O_WRONLY or O_RDWR: %w", unix.EINVAL)}
+	}
+	unixMode, err := toUnixMode(mode)
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.ReopenTmpfile", Path: dirHandle.Name(), Err: err}
+	}
+
+	fd, err := unix.Openat(int(dirHandle.Fd()), ".", flags|unix.O_TMPFILE|unix.O_CLOEXEC, unixMode)
+	if err != nil {
+		// Kernels without O_TMPFILE support treat it as O_DIRECTORY (giving
+		// us EISDIR), and filesystems without O_TMPFILE support return
+		// EOPNOTSUPP.
+		if errors.Is(err, unix.EISDIR) || errors.Is(err, unix.EOPNOTSUPP) {
+			err = wrapBaseError(err, ErrUnsupported)
+		}
+		return nil, &os.PathError{Op: "securejoin.ReopenTmpfile", Path: dirHandle.Name(), Err: err}
+	}
+	return os.NewFile(uintptr(fd), dirHandle.Name()+"/#tmpfile"), nil
+}
+
+// splitParentPath splits unsafePath into its parent directory and final
+// component, ignoring any trailing slashes. If unsafePath has only one
+// component, the parent directory is ".".
+func splitParentPath(unsafePath string) (parentPath, finalComponent string) {
+	unsafePath = strings.TrimRight(unsafePath, "/")
+	parentPath, finalComponent = ".", unsafePath
+	if i := strings.LastIndexByte(unsafePath, '/'); i != -1 {
+		parentPath, finalComponent = unsafePath[:i+1], unsafePath[i+1:]
+	}
+	return parentPath, finalComponent
+}
+
+// openParentInRoot splits unsafePath into its parent directory and final
+// component, and returns an O_PATH handle to the parent directory (resolved
+// inside root) along with the name of the final component. Trailing slashes
+// are ignored. The final component may be "", "." or "..", which callers need
+// to handle explicitly.
+func openParentInRoot(root *os.File, unsafePath string) (*os.File, string, error) {
+	parentPath, finalComponent := splitParentPath(unsafePath)
+	parent, err := OpenatInRoot(root, parentPath)
+	if err != nil {
+		return nil, "", err
+	}
+	return parent, finalComponent, nil
+}
+
+// OpenParentInRoot returns an O_PATH handle to the parent directory of
+// unsafePath (resolved inside root in the same way as [OpenatInRoot]), along
+// with the name of the final component of unsafePath. This is useful for
+// operations which act on a directory entry rather than an inode (such as
+// creating, renaming or unlinking a file), which can then be done relative to
+// the parent handle with the *at(2) family of syscalls.
+//
+// Only the parent directory is resolved, so the final component is not
+// required to exist and is never followed if it is a symlink. Trailing
+// slashes in unsafePath are ignored. If the final component is ".", ".." (or
+// unsafePath refers to the root itself), it does not name an entry that can
+// be created or removed and so an error wrapping EINVAL is returned.
+func OpenParentInRoot(root *os.File, unsafePath string) (parent *os.File, base string, err error) {
+	parent, base, err = openParentInRoot(root, unsafePath)
+	if err != nil {
+		return nil, "", err
+	}
+	switch base {
+	case "", ".", "..":
+		_ = parent.Close()
+		return nil, "", &os.PathError{Op: "securejoin.OpenParentInRoot", Path: unsafePath, Err: fmt.Errorf("final component %q does not name a directory entry: %w", base, unix.EINVAL)}
+	}
+	return parent, base, nil
+}
+
+// LookupUntilSymlink walks the components of unsafePath inside root until it
+// finds a symlink, without following it. It returns a handle to the directory
+// containing the symlink, the prefix of unsafePath that was consumed
+// (including the symlink component itself) and the contents of the symlink.
+// This is intended for tools that need to audit where symlinks are used in a
+// path.
+//
+// If no symlinks are found, a handle to the final component of unsafePath is
+// returned, with consumed set to unsafePath and an empty linkTarget. Since no
+// symlinks are followed, ".." components are resolved lexically (and cannot
+// go above the root). As with the other resolvers, any component (including
+// ".." or a trailing slash) following a non-directory results in an error
+// wrapping ENOTDIR. The caller is responsible for closing the returned handle.
+func LookupUntilSymlink(root *os.File, unsafePath string) (handle *os.File, consumed string, linkTarget string, Err error) {
+	rootHandle, err := reopenRoot(root)
+	if err != nil {
+		return nil, "", "", &os.PathError{Op: "securejoin.LookupUntilSymlink", Path: unsafePath, Err: err}
+	}
+	// The stack of handles for each directory walked, so that ".." can be
+	// resolved without needing to do a lookup.
+	stack := []*os.File{rootHandle}
+	defer func() {
+		for _, dir := range stack {
+			if dir != handle {
+				_ = dir.Close()
+			}
+		}
+	}()
+
+	// Whether the last component walked was a non-directory, in which case
+	// any following component (including "." and "..") fails with ENOTDIR.
+	var currentIsNonDir bool
+
+	parts := strings.Split(filepath.ToSlash(unsafePath), "/")
+	for i, part := range parts {
+		current := stack[len(stack)-1]
+		if currentIsNonDir {
+			return nil, "", "", &os.PathError{Op: "securejoin.LookupUntilSymlink", Path: unsafePath, Err: unix.ENOTDIR}
+		}
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				_ = current.Close()
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+
+		next, err := openatFile(current, part, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, "", "", &os.PathError{Op: "securejoin.LookupUntilSymlink", Path: unsafePath, Err: err}
+		}
+		st, err := fstat(next)
+		if err != nil {
+			_ = next.Close()
+			return nil, "", "", &os.PathError{Op: "securejoin.LookupUntilSymlink", Path: unsafePath, Err: err}
+		}
+		if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			target, err := readlinkatFile(next, "")
+			_ = next.Close()
+			if err != nil {
+				return nil, "", "", &os.PathError{Op: "securejoin.LookupUntilSymlink", Path: unsafePath, Err: err}
+			}
+			return current, strings.Join(parts[:i+1], "/"), target, nil
+		}
+		currentIsNonDir = st.Mode&unix.S_IFMT != unix.S_IFDIR
+		stack = append(stack, next)
+	}
+	return stack[len(stack)-1], unsafePath, "", nil
+}
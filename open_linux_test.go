@@ -7,6 +7,10 @@
 package securejoin
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -358,6 +362,172 @@ func TestOpenInRoot(t *testing.T) {
 	})
 }
 
+func TestOpenInRoot_RootPath(t *testing.T) {
+	base := createTree(t, "dir root/a/b", "file root/a/b/file")
+	root := filepath.Join(base, "root")
+
+	for name, test := range map[string]struct {
+		fn func(root, unsafePath string) error
+	}{
+		"OpenInRoot": {fn: func(root, unsafePath string) error {
+			handle, err := OpenInRoot(root, unsafePath)
+			if err == nil {
+				_ = handle.Close()
+			}
+			return err
+		}},
+		"OpenInRootFd": {fn: func(root, unsafePath string) error {
+			fd, err := OpenInRootFd(root, unsafePath)
+			if err == nil {
+				_ = unix.Close(fd)
+			}
+			return err
+		}},
+		"MkdirAll": {fn: func(root, unsafePath string) error {
+			return MkdirAll(root, unsafePath, 0o755)
+		}},
+	} {
+		test := test // copy iterator
+		t.Run(name, func(t *testing.T) {
+			err := test.fn("", "a/b")
+			assert.ErrorIs(t, err, ErrInvalidRoot, "empty root")
+
+			for _, rootPath := range []string{root, root + "/", root + "//", base + "/./root/"} {
+				err := test.fn(rootPath, "a/b")
+				assert.NoErrorf(t, err, "root %q", rootPath)
+			}
+
+			origCwd, err := os.Getwd()
+			require.NoError(t, err)
+			defer func() { require.NoError(t, os.Chdir(origCwd)) }()
+
+			// Relative roots are resolved relative to the current directory.
+			require.NoError(t, os.Chdir(base))
+			for _, rootPath := range []string{"root", "root/", "./root", "root/a/.."} {
+				err := test.fn(rootPath, "a/b")
+				assert.NoErrorf(t, err, "relative root %q", rootPath)
+			}
+			require.NoError(t, os.Chdir(root))
+			err = test.fn(".", "a/b")
+			assert.NoError(t, err, "relative root \".\"")
+			err = test.fn("..", "root/a/b")
+			assert.NoError(t, err, "relative root \"..\"")
+			err = test.fn("nonexist", "a/b")
+			assert.ErrorIs(t, err, unix.ENOENT, "non-existent relative root")
+		})
+	}
+
+	origCwd, err := os.Getwd()
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.Chdir(origCwd)) }()
+	require.NoError(t, os.Chdir(base))
+
+	// The handle name is based on the absolute path of the root.
+	handle, err := OpenInRoot("./root/", "a/b")
+	require.NoError(t, err)
+	defer handle.Close()
+	assert.Equal(t, filepath.Join(root, "a/b"), handle.Name(), "handle name should use the absolute root path")
+}
+
+func TestOpenInRoot_RootNotDirectory(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		base := createTree(t, "file file data", "symlink link file")
+		root := filepath.Join(base, "file")
+
+		rootFile, err := os.OpenFile(root, unix.O_PATH|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootFile.Close()
+
+		for name, fn := range map[string]func() error{
+			"OpenInRoot": func() error {
+				_, err := OpenInRoot(root, "a")
+				return err
+			},
+			"OpenInRoot-Symlink": func() error {
+				_, err := OpenInRoot(filepath.Join(base, "link"), "a")
+				return err
+			},
+			"OpenInRootFd": func() error {
+				_, err := OpenInRootFd(root, "a")
+				return err
+			},
+			"MkdirAll": func() error { return MkdirAll(root, "a/b", 0o755) },
+			"OpenatInRoot": func() error {
+				_, err := OpenatInRoot(rootFile, "a")
+				return err
+			},
+			"OpenatInRoot-Root": func() error {
+				_, err := OpenatInRoot(rootFile, "/")
+				return err
+			},
+			"OpenatInRootWithOptions": func() error {
+				_, err := OpenatInRootWithOptions(context.Background(), rootFile, "a/b", &ResolveOptions{NoFollowTrailing: true})
+				return err
+			},
+			"OpenatInRootFd": func() error {
+				_, err := OpenatInRootFd(int(rootFile.Fd()), "a")
+				return err
+			},
+			"MkdirAllHandle": func() error {
+				_, err := MkdirAllHandle(rootFile, "a/b", 0o755)
+				return err
+			},
+		} {
+			fn := fn // copy iterator
+			t.Run(name, func(t *testing.T) {
+				err := fn()
+				assert.ErrorIs(t, err, ErrRootNotDirectory)
+				assert.ErrorIs(t, err, unix.ENOTDIR, "ErrRootNotDirectory should wrap ENOTDIR")
+			})
+		}
+
+		// A non-directory parent of the root is not the same as the root
+		// itself not being a directory.
+		_, err = OpenInRoot(filepath.Join(root, "sub"), "a")
+		assert.ErrorIs(t, err, unix.ENOTDIR)
+		assert.NotErrorIs(t, err, ErrRootNotDirectory, "non-directory parent of root")
+	})
+}
+
+func TestOpenRootRW(t *testing.T) {
+	base := createTree(t, "dir root", "file file")
+	root := filepath.Join(base, "root")
+
+	rootDir, err := OpenRootRW(root)
+	require.NoError(t, err, "OpenRootRW")
+	defer rootDir.Close()
+
+	flags, err := unix.FcntlInt(rootDir.Fd(), unix.F_GETFL, 0)
+	require.NoError(t, err)
+	assert.Zero(t, flags&unix.O_PATH, "OpenRootRW should not return an O_PATH handle")
+	assert.Equal(t, unix.O_RDONLY, flags&unix.O_ACCMODE, "OpenRootRW access mode")
+	assert.Equal(t, root, rootDir.Name(), "OpenRootRW handle name")
+
+	// The handle can be used as the root for creating files.
+	f, err := CreateAllInRoot(rootDir, "a/b/file", 0o755, 0o644)
+	require.NoError(t, err, "CreateAllInRoot with OpenRootRW root")
+	_ = f.Close()
+
+	_, err = OpenRootRW("")
+	assert.ErrorIs(t, err, ErrInvalidRoot, "OpenRootRW with empty root")
+	_, err = OpenRootRW(filepath.Join(base, "file"))
+	assert.ErrorIs(t, err, ErrRootNotDirectory, "OpenRootRW with non-directory root")
+	_, err = OpenRootRW(filepath.Join(base, "nonexist"))
+	assert.ErrorIs(t, err, unix.ENOENT, "OpenRootRW with non-existent root")
+}
+
+func TestOpenRootRW_ReadOnly(t *testing.T) {
+	setupMountNamespace(t)
+
+	root := t.TempDir()
+	err := unix.Mount("tmpfs", root, "tmpfs", unix.MS_RDONLY, "")
+	require.NoError(t, err, "mount read-only tmpfs")
+	defer func() { _ = unix.Unmount(root, unix.MNT_DETACH) }()
+
+	_, err = OpenRootRW(root)
+	assert.ErrorIs(t, err, unix.EROFS, "OpenRootRW on read-only filesystem")
+}
+
 func TestOpenInRootHandle(t *testing.T) {
 	withWithoutOpenat2(t, true, func(t *testing.T) {
 		testOpenInRoot(t, func(root, unsafePath string) (*os.File, error) {
@@ -372,6 +542,245 @@ func TestOpenInRootHandle(t *testing.T) {
 	})
 }
 
+func TestOpenInRootContext(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		testOpenInRoot(t, func(root, unsafePath string) (*os.File, error) {
+			rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+			if err != nil {
+				return nil, err
+			}
+			defer rootDir.Close()
+
+			return OpenatInRootContext(context.Background(), rootDir, unsafePath)
+		})
+	})
+}
+
+func TestOpenInRootContext_Cancelled(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b/c",
+			"symlink link1 a",
+			"symlink link2 link1/b",
+			"file a/b/c/file",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		for _, unsafePath := range []string{"a/b/c/file", "link2/c/file", "nonexist"} {
+			handle, err := OpenatInRootContext(ctx, rootDir, unsafePath)
+			if !assert.ErrorIsf(t, err, context.Canceled, "OpenatInRootContext(%q) with cancelled context", unsafePath) {
+				_ = handle.Close()
+			}
+		}
+	})
+}
+
+func TestOpenInRootRaw(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		testOpenInRoot(t, func(root, unsafePath string) (*os.File, error) {
+			rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+			if err != nil {
+				return nil, err
+			}
+			defer rootDir.Close()
+
+			handle, err := OpenatInRootRaw(int(rootDir.Fd()), unsafePath)
+
+			// The caller's fd must not have been closed.
+			_, fcntlErr := unix.FcntlInt(rootDir.Fd(), unix.F_GETFD, 0)
+			require.NoError(t, fcntlErr, "root fd should still be open after OpenatInRootRaw")
+			return handle, err
+		})
+	})
+}
+
+func TestOpenInRootFd(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		testOpenInRoot(t, func(root, unsafePath string) (*os.File, error) {
+			fd, err := OpenInRootFd(root, unsafePath)
+			if err != nil {
+				return nil, err
+			}
+			name, err := rawProcSelfFdReadlink(fd, nil)
+			require.NoError(t, err, "get real path of returned fd")
+			return os.NewFile(uintptr(fd), name), nil
+		})
+	})
+}
+
+func TestOpenatInRootFd(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		testOpenInRoot(t, func(root, unsafePath string) (*os.File, error) {
+			rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+			if err != nil {
+				return nil, err
+			}
+			defer rootDir.Close()
+
+			fd, err := OpenatInRootFd(int(rootDir.Fd()), unsafePath)
+
+			// The caller's fd must not have been closed.
+			_, fcntlErr := unix.FcntlInt(rootDir.Fd(), unix.F_GETFD, 0)
+			require.NoError(t, fcntlErr, "root fd should still be open after OpenatInRootFd")
+			if err != nil {
+				return nil, err
+			}
+
+			fdFlags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+			require.NoError(t, err, "get fd flags of returned fd")
+			assert.NotZero(t, fdFlags&unix.FD_CLOEXEC, "returned fd should be O_CLOEXEC")
+
+			name, err := rawProcSelfFdReadlink(fd, nil)
+			require.NoError(t, err, "get real path of returned fd")
+			return os.NewFile(uintptr(fd), name), nil
+		})
+	})
+}
+
+func TestReopenRaw(t *testing.T) {
+	root := createTree(t, "file foo bar")
+
+	handle, err := OpenInRoot(root, "foo")
+	require.NoError(t, err)
+	defer handle.Close()
+
+	reopened, err := ReopenRaw(int(handle.Fd()), unix.O_RDONLY)
+	require.NoError(t, err, "ReopenRaw")
+	defer reopened.Close()
+
+	// The caller's fd must not have been closed.
+	_, err = unix.FcntlInt(handle.Fd(), unix.F_GETFD, 0)
+	require.NoError(t, err, "handle fd should still be open after ReopenRaw")
+
+	handlePath, err := procSelfFdReadlink(handle)
+	require.NoError(t, err, "get real path of original handle")
+	reopenedPath, err := procSelfFdReadlink(reopened)
+	require.NoError(t, err, "get real path of reopened handle")
+	assert.Equal(t, handlePath, reopenedPath, "old and reopen handle paths")
+	assert.Equal(t, handlePath, reopened.Name(), "reopen handle.Name()")
+}
+
+func TestDupFd(t *testing.T) {
+	root := createTree(t, "dir a", "file a/b")
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	dup, err := DupFd(rootDir)
+	require.NoError(t, err, "DupFd")
+	defer dup.Close()
+
+	assert.NotEqual(t, rootDir.Fd(), dup.Fd(), "DupFd should return a new fd")
+	assert.Equal(t, rootDir.Name(), dup.Name(), "DupFd should keep the name")
+	fdFlags, err := unix.FcntlInt(dup.Fd(), unix.F_GETFD, 0)
+	require.NoError(t, err)
+	assert.NotZero(t, fdFlags&unix.FD_CLOEXEC, "DupFd should set FD_CLOEXEC")
+
+	// Closing the original handle must not affect the duplicate.
+	require.NoError(t, rootDir.Close())
+	handle, err := OpenatInRoot(dup, "a/b")
+	require.NoError(t, err, "OpenatInRoot with duplicated root after closing original")
+	_ = handle.Close()
+
+	_, err = DupFd(rootDir)
+	var pathErr *os.PathError
+	if assert.ErrorAs(t, err, &pathErr, "DupFd of closed file") {
+		assert.Equal(t, "securejoin.DupFd", pathErr.Op, "*os.PathError op")
+	}
+}
+
+func TestReopenWithOptions_PreserveStatusFlags(t *testing.T) {
+	root := createTree(t, "file foo bar")
+
+	handle, err := os.OpenFile(filepath.Join(root, "foo"), unix.O_WRONLY|unix.O_APPEND|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer handle.Close()
+
+	for _, test := range []struct {
+		name          string
+		opts          *ReopenOptions
+		expectedFlags int
+	}{
+		{"default", nil, unix.O_RDWR},
+		{"preserve", &ReopenOptions{PreserveStatusFlags: true}, unix.O_RDWR | unix.O_APPEND | unix.O_NONBLOCK},
+	} {
+		test := test // copy iterator
+		t.Run(test.name, func(t *testing.T) {
+			reopened, err := ReopenWithOptions(handle, unix.O_RDWR, test.opts)
+			require.NoError(t, err, "ReopenWithOptions")
+			defer reopened.Close()
+
+			statusFlags, err := unix.FcntlInt(reopened.Fd(), unix.F_GETFL, 0)
+			require.NoError(t, err, "fcntl(F_GETFL)")
+			statusFlags &^= O_LARGEFILE // ignore the O_LARGEFILE flag
+			assert.Equal(t, test.expectedFlags, statusFlags, "re-opened handle status flags (%+x)")
+		})
+	}
+
+	// Writes to the re-opened handle must still be appended.
+	reopened, err := ReopenWithOptions(handle, unix.O_RDWR, &ReopenOptions{PreserveStatusFlags: true})
+	require.NoError(t, err, "ReopenWithOptions")
+	defer reopened.Close()
+
+	_, err = reopened.Seek(0, io.SeekStart)
+	require.NoError(t, err, "seek re-opened handle")
+	_, err = reopened.WriteString("baz")
+	require.NoError(t, err, "write to re-opened handle")
+	content, err := os.ReadFile(filepath.Join(root, "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, "barbaz", string(content), "write should be appended")
+}
+
+func TestReopenTmpfile(t *testing.T) {
+	root := createTree(t, "dir a", "file b")
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	dir, err := OpenatInRoot(rootDir, "a")
+	require.NoError(t, err)
+	defer dir.Close()
+
+	tmpfile, err := ReopenTmpfile(dir, unix.O_RDWR, 0o600)
+	if errors.Is(err, ErrUnsupported) {
+		t.Skip("O_TMPFILE not supported")
+	}
+	require.NoError(t, err, "ReopenTmpfile")
+	defer tmpfile.Close()
+
+	_, err = tmpfile.WriteString("hello")
+	require.NoError(t, err, "write to tmpfile")
+
+	var st unix.Stat_t
+	require.NoError(t, unix.Fstat(int(tmpfile.Fd()), &st), "fstat tmpfile")
+	assert.EqualValues(t, unix.S_IFREG, st.Mode&unix.S_IFMT, "tmpfile should be a regular file")
+	assert.EqualValues(t, 0, st.Nlink, "tmpfile should be unlinked")
+
+	names, err := readDirNames(dir)
+	require.NoError(t, err)
+	assert.Empty(t, names, "tmpfile should not be visible in directory")
+
+	// Read-only tmpfiles are not allowed.
+	_, err = ReopenTmpfile(dir, unix.O_RDONLY, 0o600)
+	assert.ErrorIs(t, err, unix.EINVAL, "ReopenTmpfile(O_RDONLY)")
+
+	// Non-directory handles cannot be used.
+	file, err := OpenatInRoot(rootDir, "b")
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = ReopenTmpfile(file, unix.O_RDWR, 0o600)
+	assert.ErrorIs(t, err, unix.ENOTDIR, "ReopenTmpfile(file)")
+}
+
 func TestOpenInRoot_BadInode(t *testing.T) {
 	requireRoot(t) // mknod
 
@@ -415,3 +824,383 @@ func TestOpenInRoot_BadInode(t *testing.T) {
 		}
 	})
 }
+
+func TestOpenInRoot_Root(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t, "dir a", "file b")
+
+		for name, openFn := range map[string]func(rootDir *os.File, unsafePath string) (*os.File, error){
+			"OpenatInRoot": OpenatInRoot,
+			"OpenatInRootFd": func(rootDir *os.File, unsafePath string) (*os.File, error) {
+				fd, err := OpenatInRootFd(int(rootDir.Fd()), unsafePath)
+				if err != nil {
+					return nil, err
+				}
+				return os.NewFile(uintptr(fd), rootDir.Name()), nil
+			},
+		} {
+			openFn := openFn // copy iterator
+			t.Run(name, func(t *testing.T) {
+				for _, unsafePath := range []string{"", ".", "/", "//", "/."} {
+					unsafePath := unsafePath // copy iterator
+					t.Run(fmt.Sprintf("%q", unsafePath), func(t *testing.T) {
+						rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+						require.NoError(t, err)
+						defer rootDir.Close()
+
+						handle, err := openFn(rootDir, unsafePath)
+						require.NoError(t, err)
+						defer handle.Close()
+
+						assert.NotEqual(t, rootDir.Fd(), handle.Fd(), "root handle should be a new fd")
+
+						flags, err := unix.FcntlInt(handle.Fd(), unix.F_GETFL, 0)
+						require.NoError(t, err, "get file flags of root handle")
+						assert.NotZero(t, flags&unix.O_DIRECTORY, "root handle should be O_DIRECTORY")
+
+						rootPath, err := procSelfFdReadlink(rootDir)
+						require.NoError(t, err, "get real path of root")
+						handlePath, err := procSelfFdReadlink(handle)
+						require.NoError(t, err, "get real path of root handle")
+						assert.Equal(t, rootPath, handlePath, "root handle path")
+
+						// Closing the original root must not affect the new handle.
+						require.NoError(t, rootDir.Close())
+						_, err = unix.FcntlInt(handle.Fd(), unix.F_GETFD, 0)
+						assert.NoError(t, err, "root handle should be usable after closing root")
+					})
+				}
+			})
+		}
+
+		t.Run("NonDirRoot", func(t *testing.T) {
+			file, err := os.OpenFile(filepath.Join(root, "b"), unix.O_PATH|unix.O_CLOEXEC, 0)
+			require.NoError(t, err)
+			defer file.Close()
+
+			handle, err := OpenatInRoot(file, ".")
+			if !assert.ErrorIs(t, err, unix.ENOTDIR, "opening non-directory root") {
+				_ = handle.Close()
+			}
+		})
+	})
+}
+
+func TestLstatHandleInRoot(t *testing.T) {
+	requireRoot(t) // mknod
+
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a",
+			"file a/file",
+			"fifo a/fifo",
+			"sock a/sock",
+			"char a/null 1 3",
+			"symlink a/link file",
+			"symlink dirlink a",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			unsafePath   string
+			expectedType os.FileMode
+		}{
+			{"a", os.ModeDir},
+			{"a/file", 0},
+			{"a/fifo", os.ModeNamedPipe},
+			{"a/sock", os.ModeSocket},
+			{"a/null", os.ModeDevice | os.ModeCharDevice},
+			{"a/link", os.ModeSymlink},
+			{"dirlink", os.ModeSymlink},
+			{"dirlink/fifo", os.ModeNamedPipe},
+		} {
+			test := test // copy iterator
+			t.Run(test.unsafePath, func(t *testing.T) {
+				handle, err := LstatHandleInRoot(rootDir, test.unsafePath)
+				require.NoError(t, err)
+				defer handle.Close()
+
+				flags, err := unix.FcntlInt(handle.Fd(), unix.F_GETFL, 0)
+				require.NoError(t, err, "get file flags of handle")
+				assert.NotZero(t, flags&unix.O_PATH, "handle should be O_PATH")
+
+				st, err := handle.Stat()
+				require.NoError(t, err, "stat handle")
+				assert.Equal(t, test.expectedType, st.Mode()&os.ModeType, "inode type")
+			})
+		}
+	})
+}
+
+func TestOpenInRoot_ResolveError(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/file",
+		}
+		root := createTree(t, tree...)
+
+		for _, test := range []struct {
+			unsafePath                               string
+			expectedComponent, expectedRemainingPath string
+			expectedErr                              error
+		}{
+			{"a/b/c/d/e", "c", "d/e", unix.ENOENT},
+			{"a/nope", "nope", "", unix.ENOENT},
+			{"a/b/file/foo", "foo", "", unix.ENOTDIR},
+		} {
+			test := test // copy iterator
+			t.Run(test.unsafePath, func(t *testing.T) {
+				handle, err := OpenInRoot(root, test.unsafePath)
+				if !assert.Error(t, err) {
+					_ = handle.Close()
+					return
+				}
+				assert.ErrorIs(t, err, test.expectedErr, "ResolveError should unwrap to the underlying error")
+
+				var resolveErr *ResolveError
+				require.ErrorAs(t, err, &resolveErr)
+				assert.Equal(t, "securejoin.OpenInRoot", resolveErr.Op, "ResolveError.Op")
+				assert.Equal(t, test.unsafePath, resolveErr.UnsafePath, "ResolveError.UnsafePath")
+				assert.Equal(t, test.expectedComponent, resolveErr.Component, "ResolveError.Component")
+				assert.Equal(t, test.expectedRemainingPath, resolveErr.RemainingPath, "ResolveError.RemainingPath")
+			})
+		}
+	})
+}
+
+func TestOpenInRoot_TrailingSlash(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir dir",
+			"file file",
+			"symlink file-link file",
+			"symlink dir-link dir",
+			"symlink dangling nonexist",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			unsafePath   string
+			expectedPath string
+			expectedErr  error
+		}{
+			{"dir/", "/dir", nil},
+			{"dir//", "/dir", nil},
+			{"dir-link/", "/dir", nil},
+			{"file", "/file", nil},
+			{"file/", "", unix.ENOTDIR},
+			{"file//", "", unix.ENOTDIR},
+			{"file/.", "", unix.ENOTDIR},
+			{"file-link/", "", unix.ENOTDIR},
+			{"dangling/", "", unix.ENOENT},
+		} {
+			// A trailing slash always requires a directory, even if the
+			// trailing component would not otherwise be followed.
+			for _, noFollowTrailing := range []bool{false, true} {
+				handle, err := OpenatInRootWithOptions(context.Background(), rootDir, test.unsafePath, &ResolveOptions{
+					NoFollowTrailing: noFollowTrailing,
+				})
+				if test.expectedErr != nil {
+					assert.ErrorIsf(t, err, test.expectedErr, "OpenatInRootWithOptions(%q, NoFollowTrailing=%v)", test.unsafePath, noFollowTrailing)
+					continue
+				}
+				if assert.NoErrorf(t, err, "OpenatInRootWithOptions(%q, NoFollowTrailing=%v)", test.unsafePath, noFollowTrailing) {
+					assert.Equalf(t, filepath.Join(root, test.expectedPath), handle.Name(), "OpenatInRootWithOptions(%q, NoFollowTrailing=%v)", test.unsafePath, noFollowTrailing)
+					_ = handle.Close()
+				}
+			}
+		}
+	})
+}
+
+func TestOpenParentInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/file",
+			"symlink link a/b",
+			"symlink a/b/dangling nonexist",
+			"symlink escape ../../../..",
+		}
+		root := createTree(t, tree...)
+
+		realRoot, err := filepath.EvalSymlinks(root)
+		require.NoError(t, err)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			unsafePath                   string
+			expectedParent, expectedBase string
+			expectedErr                  error
+		}{
+			{"file", "", "file", nil},
+			{"/a/b/file", "/a/b", "file", nil},
+			{"a/b/nonexist", "/a/b", "nonexist", nil},
+			{"link/file", "/a/b", "file", nil},
+			{"escape/a/b/new", "/a/b", "new", nil},
+			// The final component is never followed.
+			{"link", "", "link", nil},
+			{"a/b/dangling", "/a/b", "dangling", nil},
+			// Trailing slashes are ignored.
+			{"a/b/new//", "/a/b", "new", nil},
+			// The parent must exist.
+			{"a/nonexist/new", "", "", unix.ENOENT},
+			{"a/b/file/new", "", "", unix.ENOTDIR},
+			// These do not name a directory entry.
+			{"", "", "", unix.EINVAL},
+			{"/", "", "", unix.EINVAL},
+			{".", "", "", unix.EINVAL},
+			{"a/b/.", "", "", unix.EINVAL},
+			{"a/b/..", "", "", unix.EINVAL},
+			{"a/b/../", "", "", unix.EINVAL},
+		} {
+			parent, base, err := OpenParentInRoot(rootDir, test.unsafePath)
+			if test.expectedErr != nil {
+				assert.ErrorIsf(t, err, test.expectedErr, "OpenParentInRoot(%q)", test.unsafePath)
+				assert.Nilf(t, parent, "OpenParentInRoot(%q) parent should be nil on error", test.unsafePath)
+				continue
+			}
+			if !assert.NoErrorf(t, err, "OpenParentInRoot(%q)", test.unsafePath) {
+				continue
+			}
+			gotPath, err := procSelfFdReadlink(parent)
+			require.NoError(t, err, "get real path of parent")
+			assert.Equalf(t, realRoot+test.expectedParent, gotPath, "OpenParentInRoot(%q) parent", test.unsafePath)
+			assert.Equalf(t, test.expectedBase, base, "OpenParentInRoot(%q) base", test.unsafePath)
+			_ = parent.Close()
+		}
+	})
+}
+
+func TestOpenRelativeTo(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b/c",
+			"file a/file",
+			"file a/b/file",
+			"symlink a/b/up ../../../..",
+			"symlink a/b/escape ../file",
+			"symlink a/b/abs /file",
+			"symlink a/b/dirlink c",
+		}
+		root := createTree(t, tree...)
+
+		realRoot, err := filepath.EvalSymlinks(root)
+		require.NoError(t, err)
+
+		parent, err := OpenInRoot(root, "a/b")
+		require.NoError(t, err)
+		defer parent.Close()
+
+		for _, test := range []struct {
+			component        string
+			noFollowTrailing bool
+			expectedPath     string
+			expectedErr      error
+		}{
+			{component: "file", expectedPath: "/a/b/file"},
+			{component: "c", expectedPath: "/a/b/c"},
+			{component: "dirlink", expectedPath: "/a/b/c"},
+			// Symlinks are resolved with parent as the root.
+			{component: "up", expectedPath: "/a/b"},
+			{component: "escape", expectedPath: "/a/b/file"},
+			{component: "abs", expectedPath: "/a/b/file"},
+			{component: "escape", noFollowTrailing: true, expectedPath: "/a/b/escape"},
+			{component: "nonexist", expectedErr: unix.ENOENT},
+			// Only single components are permitted.
+			{component: "", expectedErr: unix.EINVAL},
+			{component: ".", expectedErr: unix.EINVAL},
+			{component: "..", expectedErr: unix.EINVAL},
+			{component: "c/", expectedErr: unix.EINVAL},
+			{component: "dirlink/../../file", expectedErr: unix.EINVAL},
+		} {
+			handle, err := OpenRelativeTo(parent, test.component, &ResolveOptions{NoFollowTrailing: test.noFollowTrailing})
+			if test.expectedErr != nil {
+				assert.ErrorIsf(t, err, test.expectedErr, "OpenRelativeTo(%q)", test.component)
+				assert.Nilf(t, handle, "OpenRelativeTo(%q) handle should be nil on error", test.component)
+				continue
+			}
+			if !assert.NoErrorf(t, err, "OpenRelativeTo(%q)", test.component) {
+				continue
+			}
+			gotPath, err := procSelfFdReadlink(handle)
+			require.NoError(t, err, "get real path of handle")
+			assert.Equalf(t, realRoot+test.expectedPath, gotPath, "OpenRelativeTo(%q) path", test.component)
+			_ = handle.Close()
+		}
+	})
+}
+
+func TestLookupUntilSymlink(t *testing.T) {
+	tree := []string{
+		"dir a/b/c",
+		"file a/b/c/file",
+		"symlink a/link ../../../outside",
+		"symlink a/b/abs /a/b/c",
+		"symlink toplink a",
+	}
+	root := createTree(t, tree...)
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	require.NoError(t, err)
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	for _, test := range []struct {
+		unsafePath                     string
+		expectedPath, expectedConsumed string
+		expectedLinkTarget             string
+		expectedErr                    error
+	}{
+		// No symlinks.
+		{"a/b/c/file", "/a/b/c/file", "a/b/c/file", "", nil},
+		{"/a/b/c/", "/a/b/c", "/a/b/c/", "", nil},
+		{"", "", "", "", nil},
+		// ".." is resolved lexically and cannot go above the root.
+		{"a/../../../a/b/../b/c", "/a/b/c", "a/../../../a/b/../b/c", "", nil},
+		// Symlinks are not followed.
+		{"a/link", "/a", "a/link", "../../../outside", nil},
+		{"a/link/foo/bar", "/a", "a/link", "../../../outside", nil},
+		{"/a/b/abs/file", "/a/b", "/a/b/abs", "/a/b/c", nil},
+		{"toplink/b", "", "toplink", "a", nil},
+		{"a/b/../../toplink", "", "a/b/../../toplink", "a", nil},
+		// Errors.
+		{"a/b/nope/link", "", "", "", unix.ENOENT},
+		{"a/b/c/file/foo", "", "", "", unix.ENOTDIR},
+		{"a/b/c/file/..", "", "", "", unix.ENOTDIR},
+		{"a/b/c/file/.", "", "", "", unix.ENOTDIR},
+		{"a/b/c/file/", "", "", "", unix.ENOTDIR},
+	} {
+		test := test // copy iterator
+		t.Run(test.unsafePath, func(t *testing.T) {
+			handle, consumed, linkTarget, err := LookupUntilSymlink(rootDir, test.unsafePath)
+			if test.expectedErr != nil {
+				assert.ErrorIs(t, err, test.expectedErr)
+				assert.Nil(t, handle, "handle should be nil on error")
+				return
+			}
+			require.NoError(t, err)
+			defer handle.Close()
+
+			handlePath, err := procSelfFdReadlink(handle)
+			require.NoError(t, err, "get real path of handle")
+			assert.Equal(t, realRoot+test.expectedPath, handlePath, "handle path")
+			assert.Equal(t, test.expectedConsumed, consumed, "consumed path")
+			assert.Equal(t, test.expectedLinkTarget, linkTarget, "symlink target")
+		})
+	}
+}
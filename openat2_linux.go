@@ -7,27 +7,33 @@
 package securejoin
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 
 	"golang.org/x/sys/unix"
 )
 
-var hasOpenat2 = sync_OnceValue(func() bool {
+var probeOpenat2 = sync_OnceValue(func() error {
 	fd, err := unix.Openat2(unix.AT_FDCWD, ".", &unix.OpenHow{
 		Flags:   unix.O_PATH | unix.O_CLOEXEC,
 		Resolve: unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_IN_ROOT,
 	})
 	if err != nil {
-		return false
+		return err
 	}
 	_ = unix.Close(fd)
-	return true
+	return nil
 })
 
+var hasOpenat2 = func() bool {
+	return probeOpenat2() == nil
+}
+
 func scopedLookupShouldRetry(how *unix.OpenHow, err error) bool {
 	// RESOLVE_IN_ROOT (and RESOLVE_BENEATH) can return -EAGAIN if we resolve
 	// ".." while a mount or rename occurs anywhere on the system. This could
@@ -43,51 +49,138 @@ func scopedLookupShouldRetry(how *unix.OpenHow, err error) bool {
 
 const scopedLookupMaxRetries = 10
 
-func openat2File(dir *os.File, path string, how *unix.OpenHow) (*os.File, error) {
-	fullPath := dir.Name() + "/" + path
+// resolveCached is RESOLVE_CACHED, which is not yet defined by
+// golang.org/x/sys/unix.
+const resolveCached = 0x20
+
+// openat2Cached attempts an openat2(2) lookup with RESOLVE_CACHED, returning
+// ok=false if the lookup could not be done using only the dentry cache (or if
+// RESOLVE_CACHED is not supported), in which case the caller should do a
+// regular lookup.
+func openat2Cached(dirFd int, path string, how *unix.OpenHow) (fd int, ok bool, err error) {
+	cachedHow := *how
+	cachedHow.Resolve |= resolveCached
+	fd, err = unix.Openat2(dirFd, path, &cachedHow)
+	// EAGAIN means the lookup would have blocked (or a scoped lookup needs
+	// to be retried), and older kernels reject unknown resolve flags with
+	// EINVAL.
+	if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINVAL) {
+		return -1, false, nil
+	}
+	return fd, true, err
+}
+
+// openat2 is a wrapper around unix.Openat2 which retries scoped lookups that
+// failed spuriously. The returned file descriptor is a raw fd that the caller
+// is responsible for closing. If ctx is cancelled, no further attempts are
+// made and ctx.Err() is returned. Retries are reported to opts.Trace.
+func openat2(ctx context.Context, dirFd int, path string, how *unix.OpenHow, opts *ResolveOptions) (int, error) {
 	// Make sure we always set O_CLOEXEC.
 	how.Flags |= unix.O_CLOEXEC
+	if opts.tryCached() {
+		if err := ctx.Err(); err != nil {
+			return -1, err
+		}
+		// Any errors that need to be retried will be hit again by the
+		// regular lookup below.
+		if fd, ok, err := openat2Cached(dirFd, path, how); ok && !scopedLookupShouldRetry(how, err) {
+			return fd, err
+		}
+	}
 	var tries int
 	for tries < scopedLookupMaxRetries {
-		fd, err := unix.Openat2(int(dir.Fd()), path, how)
+		if err := ctx.Err(); err != nil {
+			return -1, err
+		}
+		fd, err := unix.Openat2(dirFd, path, how)
 		if err != nil {
 			if scopedLookupShouldRetry(how, err) {
 				// We retry a couple of times to avoid the spurious errors, and
 				// if we are being attacked then returning -EAGAIN is the best
 				// we can do.
 				tries++
+				atomic.AddUint64(&statOpenat2Retries, 1)
+				if opts.tracing() {
+					opts.Trace(ResolveStep{Component: path, Action: ResolveActionRetry, Err: err})
+				}
 				continue
 			}
-			return nil, &os.PathError{Op: "openat2", Path: fullPath, Err: err}
+			return -1, err
 		}
-		// If we are using RESOLVE_IN_ROOT, the name we generated may be wrong.
-		// NOTE: The procRoot code MUST NOT use RESOLVE_IN_ROOT, otherwise
-		//       you'll get infinite recursion here.
-		if how.Resolve&unix.RESOLVE_IN_ROOT == unix.RESOLVE_IN_ROOT {
-			if actualPath, err := rawProcSelfFdReadlink(fd); err == nil {
-				fullPath = actualPath
-			}
+		return fd, nil
+	}
+	if Logger != nil {
+		logf(LogLevelWarn, "openat2(2) lookup retries exhausted", "path", path, "retries", tries)
+	}
+	return -1, ErrPossibleAttack
+}
+
+func openat2File(ctx context.Context, dir *os.File, path string, how *unix.OpenHow, opts *ResolveOptions) (*os.File, error) {
+	fullPath := dir.Name() + "/" + path
+	fd, err := openat2(ctx, int(dir.Fd()), path, how, opts)
+	if err != nil {
+		return nil, &os.PathError{Op: "openat2", Path: fullPath, Err: err}
+	}
+	// If we are using RESOLVE_IN_ROOT, the name we generated may be wrong.
+	// NOTE: The procRoot code MUST NOT use RESOLVE_IN_ROOT, otherwise
+	//       you'll get infinite recursion here.
+	if how.Resolve&unix.RESOLVE_IN_ROOT == unix.RESOLVE_IN_ROOT {
+		if actualPath, err := rawProcSelfFdReadlink(fd, opts); err == nil {
+			fullPath = actualPath
 		}
-		return os.NewFile(uintptr(fd), fullPath), nil
 	}
-	return nil, &os.PathError{Op: "openat2", Path: fullPath, Err: errPossibleAttack}
+	return os.NewFile(uintptr(fd), fullPath), nil
 }
 
-func lookupOpenat2(root *os.File, unsafePath string, partial bool) (*os.File, string, error) {
+// Openat2 is a wrapper around openat2(2) which returns an *[os.File]. dir may
+// be nil, in which case path is resolved relative to the current directory.
+// O_CLOEXEC is always set, and how is not modified.
+//
+// Lookups using RESOLVE_IN_ROOT or RESOLVE_BENEATH which fail spuriously
+// (due to a concurrent rename or mount on the system) are retried a few
+// times, and an error wrapping [ErrPossibleAttack] is returned if they keep
+// failing. If openat2(2) is not supported by the running kernel, an error
+// wrapping both ENOSYS and [ErrUnsupportedKernel] is returned.
+func Openat2(dir *os.File, path string, how *unix.OpenHow) (*os.File, error) {
+	if !hasOpenat2() {
+		return nil, &os.PathError{Op: "securejoin.Openat2", Path: path, Err: wrapBaseError(unix.ENOSYS, newUnsupportedKernelError(kernelFeatureOpenat2))}
+	}
+	howCopy := *how
+	if dir == nil {
+		fd, err := openat2(context.Background(), unix.AT_FDCWD, path, &howCopy, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "openat2", Path: path, Err: err}
+		}
+		return os.NewFile(uintptr(fd), path), nil
+	}
+	return openat2File(context.Background(), dir, path, &howCopy, nil)
+}
+
+func lookupOpenat2(ctx context.Context, root *os.File, unsafePath string, partial bool, opts *ResolveOptions) (*os.File, string, error) {
 	if !partial {
-		file, err := openat2File(root, unsafePath, &unix.OpenHow{
-			Flags:   unix.O_PATH | unix.O_CLOEXEC,
+		flags := unix.O_PATH | unix.O_CLOEXEC
+		if opts.noFollowTrailing() {
+			flags |= unix.O_NOFOLLOW
+		}
+		if opts.requireDir() {
+			flags |= unix.O_DIRECTORY
+		}
+		file, err := openat2File(ctx, root, unsafePath, &unix.OpenHow{
+			Flags:   uint64(flags),
 			Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
-		})
-		return file, "", err
+		}, opts)
+		if err != nil {
+			return nil, "", openat2ResolveError(ctx, root, unsafePath, err)
+		}
+		return file, "", nil
 	}
-	return partialLookupOpenat2(root, unsafePath)
+	return partialLookupOpenat2(ctx, root, unsafePath, opts)
 }
 
 // partialLookupOpenat2 is an alternative implementation of
 // partialLookupInRoot, using openat2(RESOLVE_IN_ROOT) to more safely get a
 // handle to the deepest existing child of the requested path within the root.
-func partialLookupOpenat2(root *os.File, unsafePath string) (*os.File, string, error) {
+func partialLookupOpenat2(ctx context.Context, root *os.File, unsafePath string, opts *ResolveOptions) (*os.File, string, error) {
 	// TODO: Implement this as a git-bisect-like binary search.
 
 	unsafePath = filepath.ToSlash(unsafePath) // noop
@@ -96,10 +189,10 @@ func partialLookupOpenat2(root *os.File, unsafePath string) (*os.File, string, e
 	for endIdx > 0 {
 		subpath := unsafePath[:endIdx]
 
-		handle, err := openat2File(root, subpath, &unix.OpenHow{
+		handle, err := openat2File(ctx, root, subpath, &unix.OpenHow{
 			Flags:   unix.O_PATH | unix.O_CLOEXEC,
 			Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
-		})
+		}, opts)
 		if err == nil {
 			// Jump over the slash if we have a non-"" remainingPath.
 			if endIdx < len(unsafePath) {
@@ -125,3 +218,23 @@ func partialLookupOpenat2(root *os.File, unsafePath string) (*os.File, string, e
 	}
 	return rootClone, unsafePath, lastError
 }
+
+// openat2ResolveError converts an error returned by a complete openat2 lookup
+// into a *ResolveError. openat2 does not tell us which component failed, so for
+// ENOENT and ENOTDIR errors we do a partial lookup to find the first component
+// that could not be resolved. This is racy, but the result is purely
+// informational.
+func openat2ResolveError(ctx context.Context, root *os.File, unsafePath string, err error) error {
+	resolveErr := &ResolveError{Err: err}
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+		handle, remainingPath, _ := partialLookupOpenat2(ctx, root, unsafePath, nil)
+		if handle != nil {
+			_ = handle.Close()
+			resolveErr.Component, resolveErr.RemainingPath = remainingPath, ""
+			if i := strings.IndexByte(remainingPath, '/'); i != -1 {
+				resolveErr.Component, resolveErr.RemainingPath = remainingPath[:i], remainingPath[i+1:]
+			}
+		}
+	}
+	return resolveErr
+}
@@ -0,0 +1,60 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenat2(t *testing.T) {
+	withWithoutOpenat2(t, false, func(t *testing.T) {
+		root := createTree(t, "dir a/b", "file a/b/c", "symlink link /a/b")
+
+		realRoot, err := filepath.EvalSymlinks(root)
+		require.NoError(t, err)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		how := &unix.OpenHow{
+			Flags:   unix.O_PATH,
+			Resolve: unix.RESOLVE_IN_ROOT,
+		}
+		handle, err := Openat2(rootDir, "link/../../../a/b/c", how)
+		if !hasOpenat2() {
+			assert.ErrorIs(t, err, unix.ENOSYS, "Openat2 without openat2 support")
+			assert.ErrorIs(t, err, ErrUnsupportedKernel, "Openat2 without openat2 support")
+			assert.Nil(t, handle, "handle should be nil on error")
+			return
+		}
+		require.NoError(t, err)
+		defer handle.Close()
+
+		assert.EqualValues(t, unix.O_PATH, how.Flags, "Openat2 should not modify how")
+		assert.Equal(t, realRoot+"/a/b/c", handle.Name(), "handle name")
+		handlePath, err := procSelfFdReadlink(handle)
+		require.NoError(t, err, "get real path of handle")
+		assert.Equal(t, realRoot+"/a/b/c", handlePath, "handle path")
+
+		flags, err := unix.FcntlInt(handle.Fd(), unix.F_GETFD, 0)
+		require.NoError(t, err)
+		assert.NotZero(t, flags&unix.FD_CLOEXEC, "handle should have O_CLOEXEC set")
+
+		_, err = Openat2(rootDir, "link/c", &unix.OpenHow{
+			Flags:   unix.O_PATH,
+			Resolve: unix.RESOLVE_NO_SYMLINKS,
+		})
+		assert.ErrorIs(t, err, unix.ELOOP, "Openat2 with RESOLVE_NO_SYMLINKS")
+	})
+}
@@ -9,6 +9,8 @@ package securejoin
 import (
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 
 	"golang.org/x/sys/unix"
 )
@@ -21,6 +23,25 @@ func dupFile(f *os.File) (*os.File, error) {
 	return os.NewFile(uintptr(fd), f.Name()), nil
 }
 
+// dupRawFd returns an *os.File wrapping a copy of the provided raw file
+// descriptor. The caller retains ownership of fd (we never close it, and the
+// finalizer of the returned *os.File only closes the copy), and must close the
+// returned *os.File once they are done with it.
+func dupRawFd(fd int) (*os.File, error) {
+	newFd, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("fcntl(F_DUPFD_CLOEXEC)", err)
+	}
+	// Try to give the file a useful name, since the names of any handles we
+	// derive from it are based on it. This is only cosmetic, so fall back to
+	// a placeholder if /proc is not usable.
+	name, err := rawProcSelfFdReadlink(newFd, nil)
+	if err != nil {
+		name = "fd:" + strconv.Itoa(fd)
+	}
+	return os.NewFile(uintptr(newFd), name), nil
+}
+
 func openatFile(dir *os.File, path string, flags int, mode int) (*os.File, error) {
 	// Make sure we always set O_CLOEXEC.
 	flags |= unix.O_CLOEXEC
@@ -57,3 +78,22 @@ func readlinkatFile(dir *os.File, path string) (string, error) {
 		size *= 2
 	}
 }
+
+// readDirNames returns the sorted names of the entries in the directory
+// referenced by dir (which may be an O_PATH handle).
+func readDirNames(dir *os.File) ([]string, error) {
+	// We need a non-O_PATH handle to read the directory. Opening "." is safe
+	// because dir is guaranteed to be a directory.
+	handle, err := openatFile(dir, ".", unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	names, err := handle.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+
+	"golang.org/x/sys/unix"
+)
+
+// FindOvermounts walks the tree at unsafePath within root and returns the
+// paths (relative to unsafePath) of any entries which have something mounted
+// on top of them, which could indicate that an attacker has bind-mounted
+// something over an entry in an untrusted directory. The walk is done in the
+// same way as [ChmodAllInRoot] (symlinks are never followed), and the contents
+// of an overmounted directory are not walked.
+//
+// An entry is considered to be overmounted if its mount ID differs from that
+// of its parent directory. unsafePath itself is not checked. As this requires
+// statx(STATX_MNT_ID), an error wrapping both ENOTSUP and [ErrUnsupported] is
+// returned on kernels older than Linux 5.8.
+func FindOvermounts(root *os.File, unsafePath string) ([]string, error) {
+	if !hasStatxMountId() {
+		return nil, &os.PathError{Op: "securejoin.FindOvermounts", Path: unsafePath, Err: fmt.Errorf("statx(STATX_MNT_ID): %w", wrapBaseError(unix.ENOTSUP, ErrUnsupported))}
+	}
+
+	var (
+		overmounts  []string
+		dirMountIds = map[string]uint64{}
+	)
+	err := walkInRoot(root, unsafePath, func(handle *os.File, subPath string, info os.FileInfo) error {
+		mountId, err := getMountId(handle, "")
+		if err != nil {
+			return err
+		}
+		if subPath != "." {
+			if parentMountId, ok := dirMountIds[path.Dir(subPath)]; ok && parentMountId != mountId {
+				overmounts = append(overmounts, subPath)
+				if info.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+		}
+		if info.IsDir() {
+			dirMountIds[subPath] = mountId
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.FindOvermounts", Path: unsafePath, Err: err}
+	}
+	return overmounts, nil
+}
@@ -0,0 +1,78 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestFindOvermounts(t *testing.T) {
+	if !hasStatxMountId() {
+		t.Skip("statx(STATX_MNT_ID) not supported")
+	}
+
+	withWithoutOpenat2(t, true, testFindOvermounts)
+}
+
+func testFindOvermounts(t *testing.T) {
+	setupMountNamespace(t)
+
+	tree := []string{
+		"dir a/b/c",
+		"dir a/d",
+		"file a/file",
+		"file a/d/file",
+		"symlink a/link file",
+		"dir other",
+		"file other/file",
+	}
+	root := createTree(t, tree...)
+
+	// Overmount a directory, a file and a symlink. The mounts need to be
+	// removed before the tree is cleaned up.
+	t.Cleanup(func() {
+		for _, target := range []string{"a/b/nested", "a/b", "a/file", "a/link"} {
+			_ = unix.Unmount(filepath.Join(root, target), unix.MNT_DETACH)
+		}
+	})
+	doMount(t, "", filepath.Join(root, "a/b"), "tmpfs", 0)
+	doMount(t, filepath.Join(root, "other/file"), filepath.Join(root, "a/file"), "", unix.MS_BIND)
+	doMount(t, filepath.Join(root, "other/file"), filepath.Join(root, "a/link"), "", unix.MS_BIND)
+	// Create a nested mount inside the tmpfs, which should not be reported
+	// when walking the parent tree.
+	require.NoError(t, os.Mkdir(filepath.Join(root, "a/b/nested"), 0o755))
+	doMount(t, "", filepath.Join(root, "a/b/nested"), "tmpfs", 0)
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	for _, test := range []struct {
+		unsafePath string
+		expected   []string
+	}{
+		{".", []string{"a/b", "a/file", "a/link"}},
+		{"a", []string{"b", "file", "link"}},
+		{"a/d", nil},
+		{"other", nil},
+		// The top-level path is not checked.
+		{"a/b", []string{"nested"}},
+	} {
+		// We cannot use subtests here, because they would run in a different
+		// goroutine (and thus possibly a different mount namespace).
+		overmounts, err := FindOvermounts(rootDir, test.unsafePath)
+		if assert.NoErrorf(t, err, "FindOvermounts(%q)", test.unsafePath) {
+			assert.Equalf(t, test.expected, overmounts, "FindOvermounts(%q) overmounted paths", test.unsafePath)
+		}
+	}
+}
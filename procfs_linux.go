@@ -7,11 +7,13 @@
 package securejoin
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"runtime"
 	"strconv"
+	"sync/atomic"
 
 	"golang.org/x/sys/unix"
 )
@@ -53,7 +55,7 @@ func verifyProcRoot(procRoot *os.File) error {
 	return nil
 }
 
-var hasNewMountApi = sync_OnceValue(func() bool {
+var probeNewMountApi = sync_OnceValue(func() error {
 	// All of the pieces of the new mount API we use (fsopen, fsconfig,
 	// fsmount, open_tree) were added together in Linux 5.1[1,2], so we can
 	// just check for one of the syscalls and the others should also be
@@ -68,12 +70,16 @@ var hasNewMountApi = sync_OnceValue(func() bool {
 	// [2]: <https://lore.kernel.org/lkml/153754740781.17872.7869536526927736855.stgit@warthog.procyon.org.uk/>
 	fd, err := unix.OpenTree(-int(unix.EBADF), "/", unix.OPEN_TREE_CLOEXEC)
 	if err != nil {
-		return false
+		return err
 	}
 	_ = unix.Close(fd)
-	return true
+	return nil
 })
 
+var hasNewMountApi = func() bool {
+	return probeNewMountApi() == nil
+}
+
 func fsopen(fsName string, flags int) (*os.File, error) {
 	// Make sure we always set O_CLOEXEC.
 	flags |= unix.FSOPEN_CLOEXEC
@@ -164,6 +170,100 @@ func privateProcRoot() (*os.File, error) {
 	return procRoot, err
 }
 
+// OpenProcRootStrict returns a new handle to a private procfs mount (created
+// with fsopen(2) or cloned with open_tree(2)) which cannot be affected by
+// mounts on top of the host /proc. Unlike the procfs handle used internally
+// by this package, this never falls back to using the host /proc -- an error
+// is returned if a private procfs mount cannot be created (such as when the
+// new mount API is not supported or the process lacks the necessary
+// privileges). The caller is responsible for closing the returned handle.
+//
+// If the new mount API is not supported, the returned error wraps
+// [ErrUnsupportedKernel].
+func OpenProcRootStrict() (*os.File, error) {
+	if !hasNewMountApi() {
+		return nil, &os.PathError{Op: "securejoin.OpenProcRootStrict", Path: "/proc", Err: newUnsupportedKernelError(kernelFeatureNewMountApi)}
+	}
+	procRoot, err := privateProcRoot()
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.OpenProcRootStrict", Path: "/proc", Err: err}
+	}
+	return procRoot, nil
+}
+
+// OpenProcPidRoot returns an O_PATH handle to the root directory of the
+// process with the given pid (the target of the /proc/$pid/root magic-link),
+// which can then be used as the root for the *InRoot helpers in this package
+// in order to safely operate on files inside the mount namespace of another
+// process (such as a container). The /proc/$pid directory is resolved using
+// the same hardened procfs handle used internally by this package, and both
+// /proc/$pid and the magic-link are checked for overmounts before the
+// magic-link is followed. The caller is responsible for closing the returned
+// handle.
+//
+// Note that the process may exit (and its pid be re-used) at any time, so
+// callers should make sure that the pid refers to the expected process (such
+// as by holding a pidfd or being its parent) before trusting the result.
+func OpenProcPidRoot(pid int) (*os.File, error) {
+	rootPath := "/proc/" + strconv.Itoa(pid) + "/root"
+	procRoot, err := getProcRoot()
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.OpenProcPidRoot", Path: rootPath, Err: err}
+	}
+	root, err := openProcPidRoot(procRoot, pid, rootPath)
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.OpenProcPidRoot", Path: rootPath, Err: err}
+	}
+	return root, nil
+}
+
+func openProcPidRoot(procRoot *os.File, pid int, rootPath string) (*os.File, error) {
+	if pid <= 0 {
+		return nil, fmt.Errorf("invalid pid %d: %w", pid, unix.EINVAL)
+	}
+
+	var err error
+	pidStr := strconv.Itoa(pid)
+	var pidDir *os.File
+	if hasOpenat2() {
+		// As with procThreadSelf, use RESOLVE_NO_XDEV to make sure there are
+		// no overmounts on top of /proc/$pid.
+		pidDir, err = openat2File(context.Background(), procRoot, pidStr, &unix.OpenHow{
+			Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC,
+			Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_XDEV | unix.RESOLVE_NO_MAGICLINKS,
+		}, nil)
+	} else {
+		pidDir, err = openatFile(procRoot, pidStr, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer pidDir.Close()
+	if statfs, err := fstatfs(pidDir); err != nil {
+		return nil, err
+	} else if statfs.Type != procSuperMagic {
+		return nil, fmt.Errorf("%w: incorrect /proc/%d filesystem type 0x%x", errUnsafeProcfs, pid, statfs.Type)
+	}
+	if !hasOpenat2() {
+		// Without RESOLVE_NO_XDEV, we need to check that /proc/$pid is not a
+		// bind-mount of some other part of procfs by comparing its mount ID
+		// with our procfs handle.
+		if err := checkSymlinkOvermount(procRoot, pidDir, ""); err != nil {
+			return nil, fmt.Errorf("check safety of /proc/%d: %w", pid, err)
+		}
+	}
+
+	if err := checkSymlinkOvermount(procRoot, pidDir, "root"); err != nil {
+		return nil, fmt.Errorf("check safety of /proc/%d/root magiclink: %w", pid, err)
+	}
+	// Follow the magic-link.
+	fd, err := unix.Openat(int(pidDir.Fd()), "root", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "openat", Path: pidDir.Name() + "/root", Err: err}
+	}
+	return os.NewFile(uintptr(fd), rootPath), nil
+}
+
 func unsafeHostProcRoot() (_ *os.File, Err error) {
 	procRoot, err := os.OpenFile("/proc", unix.O_PATH|unix.O_NOFOLLOW|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
 	if err != nil {
@@ -186,6 +286,9 @@ func doGetProcRoot() (*os.File, error) {
 		// Fall back to using a /proc handle if making a private mount failed.
 		// If we have openat2, at least we can avoid some kinds of over-mount
 		// attacks, but without openat2 there's not much we can do.
+		if Logger != nil {
+			logf(LogLevelWarn, "cannot create private procfs mount, falling back to host /proc", "err", err)
+		}
 		procRoot, err = unsafeHostProcRoot()
 	}
 	return procRoot, err
@@ -259,10 +362,10 @@ func procThreadSelf(procRoot *os.File, subpath string) (_ *os.File, _ procThread
 		// NOTE: We MUST NOT use RESOLVE_IN_ROOT here, as openat2File uses
 		//       procSelfFdReadlink to clean up the returned f.Name() if we use
 		//       RESOLVE_IN_ROOT (which would lead to an infinite recursion).
-		handle, err = openat2File(procRoot, threadSelf+subpath, &unix.OpenHow{
+		handle, err = openat2File(context.Background(), procRoot, threadSelf+subpath, &unix.OpenHow{
 			Flags:   unix.O_PATH | unix.O_NOFOLLOW | unix.O_CLOEXEC,
 			Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_XDEV | unix.RESOLVE_NO_MAGICLINKS,
-		})
+		}, nil)
 		if err != nil {
 			// TODO: Once we bump the minimum Go version to 1.20, we can use
 			// multiple %w verbs for this wrapping. For now we need to use a
@@ -301,17 +404,26 @@ func procThreadSelf(procRoot *os.File, subpath string) (_ *os.File, _ procThread
 // ourselves.
 const STATX_MNT_ID_UNIQUE = 0x4000
 
-var hasStatxMountId = sync_OnceValue(func() bool {
+var probeStatxMountId = sync_OnceValue(func() error {
 	var (
 		stx unix.Statx_t
 		// We don't care which mount ID we get. The kernel will give us the
 		// unique one if it is supported.
 		wantStxMask uint32 = STATX_MNT_ID_UNIQUE | unix.STATX_MNT_ID
 	)
-	err := unix.Statx(-int(unix.EBADF), "/", 0, int(wantStxMask), &stx)
-	return err == nil && stx.Mask&wantStxMask != 0
+	if err := unix.Statx(-int(unix.EBADF), "/", 0, int(wantStxMask), &stx); err != nil {
+		return err
+	}
+	if stx.Mask&wantStxMask == 0 {
+		return unix.ENOTSUP
+	}
+	return nil
 })
 
+var hasStatxMountId = func() bool {
+	return probeStatxMountId() == nil
+}
+
 func getMountId(dir *os.File, path string) (uint64, error) {
 	// If we don't have statx(STATX_MNT_ID*) support, we can't do anything.
 	if !hasStatxMountId() {
@@ -326,7 +438,7 @@ func getMountId(dir *os.File, path string) (uint64, error) {
 	)
 
 	err := unix.Statx(int(dir.Fd()), path, unix.AT_EMPTY_PATH|unix.AT_SYMLINK_NOFOLLOW, int(wantStxMask), &stx)
-	if stx.Mask&wantStxMask == 0 {
+	if err == nil && stx.Mask&wantStxMask == 0 {
 		// It's not a kernel limitation, for some reason we couldn't get a
 		// mount ID. Assume it's some kind of attack.
 		err = fmt.Errorf("%w: could not get mount id", errUnsafeProcfs)
@@ -353,12 +465,16 @@ func checkSymlinkOvermount(procRoot *os.File, dir *os.File, path string) error {
 	// using unsafeHostProcRoot() then an attaker could change this after we
 	// did this check.)
 	if expectedMountId != gotMountId {
+		atomic.AddUint64(&statOvermountsDetected, 1)
+		if Logger != nil {
+			logf(LogLevelWarn, "procfs overmount detected", "path", dir.Name()+"/"+path, "expectedMountId", expectedMountId, "mountId", gotMountId)
+		}
 		return fmt.Errorf("%w: symlink %s/%s has an overmount obscuring the real link (mount ids do not match %d != %d)", errUnsafeProcfs, dir.Name(), path, expectedMountId, gotMountId)
 	}
 	return nil
 }
 
-func doRawProcSelfFdReadlink(procRoot *os.File, fd int) (string, error) {
+func doRawProcSelfFdReadlink(procRoot *os.File, fd int, opts *ResolveOptions) (string, error) {
 	fdPath := fmt.Sprintf("fd/%d", fd)
 	procFdLink, closer, err := procThreadSelf(procRoot, fdPath)
 	if err != nil {
@@ -377,8 +493,10 @@ func doRawProcSelfFdReadlink(procRoot *os.File, fd int) (string, error) {
 	//
 	// [1]: Linux commit ee2e3f50629f ("mount: fix mounting of detached mounts
 	// onto targets that reside on shared mounts").
-	if err := checkSymlinkOvermount(procRoot, procFdLink, ""); err != nil {
-		return "", fmt.Errorf("check safety of /proc/thread-self/fd/%d magiclink: %w", fd, err)
+	if !opts.skipOvermountCheck() {
+		if err := checkSymlinkOvermount(procRoot, procFdLink, ""); err != nil {
+			return "", fmt.Errorf("check safety of /proc/thread-self/fd/%d magiclink: %w", fd, err)
+		}
 	}
 
 	// readlinkat implies AT_EMPTY_PATH since Linux 2.6.39. See Linux commit
@@ -387,23 +505,105 @@ func doRawProcSelfFdReadlink(procRoot *os.File, fd int) (string, error) {
 	return readlinkatFile(procFdLink, "")
 }
 
-func rawProcSelfFdReadlink(fd int) (string, error) {
-	procRoot, err := getProcRoot()
+func rawProcSelfFdReadlink(fd int, opts *ResolveOptions) (string, error) {
+	procRoot, err := opts.procRoot()
 	if err != nil {
 		return "", err
 	}
-	return doRawProcSelfFdReadlink(procRoot, fd)
+	return doRawProcSelfFdReadlink(procRoot, fd, opts)
 }
 
 func procSelfFdReadlink(f *os.File) (string, error) {
-	return rawProcSelfFdReadlink(int(f.Fd()))
+	return rawProcSelfFdReadlink(int(f.Fd()), nil)
 }
 
-var (
-	errPossibleBreakout = errors.New("possible breakout detected")
-	errInvalidDirectory = errors.New("wandered into deleted directory")
-	errDeletedInode     = errors.New("cannot verify path of deleted inode")
-)
+// ListProcSelfFds returns the path of every file descriptor currently open in
+// the process (keyed by file descriptor number), as read from the
+// /proc/thread-self/fd magic-links. This is intended for auditing file
+// descriptor leaks, and is a safer alternative to reading /proc/self/fd
+// directly: the same hardened procfs handle used internally by this package
+// is used, and each magic-link is checked for overmounts before it is read.
+//
+// File descriptors which are closed while ListProcSelfFds is running are
+// omitted. This includes the temporary file descriptor used to read the
+// directory listing (which is closed before the magic-links are read), and
+// the O_PATH handle to /proc/thread-self/fd used internally is skipped
+// explicitly. Any procfs handle cached by this package is still open, and so
+// is included. Note that (as with any listing of file descriptors) the result
+// may be out of date as soon as it is returned.
+func ListProcSelfFds() (map[int]string, error) {
+	fds, err := listProcSelfFds()
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.ListProcSelfFds", Path: "/proc/thread-self/fd", Err: err}
+	}
+	return fds, nil
+}
+
+func listProcSelfFds() (map[int]string, error) {
+	procRoot, err := getProcRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	procFdDir, closer, err := procThreadSelf(procRoot, "fd/")
+	if err != nil {
+		return nil, fmt.Errorf("get safe /proc/thread-self/fd handle: %w", err)
+	}
+	defer procFdDir.Close()
+	defer closer()
+
+	names, err := readDirNames(procFdDir)
+	if err != nil {
+		return nil, err
+	}
+	// readDirNames closes its handle before returning, so we only need to
+	// skip procFdDir itself.
+	ownFd := strconv.Itoa(int(procFdDir.Fd()))
+	fds := make(map[int]string, len(names))
+	for _, name := range names {
+		if name == ownFd {
+			continue
+		}
+		fd, err := strconv.Atoi(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid /proc/thread-self/fd entry %q", errUnsafeProcfs, name)
+		}
+		// The file descriptor may have been closed since we read the
+		// directory, in which case we just skip it.
+		if err := checkSymlinkOvermount(procRoot, procFdDir, name); err != nil {
+			if errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return nil, fmt.Errorf("check safety of /proc/thread-self/fd/%s magiclink: %w", name, err)
+		}
+		target, err := readlinkatFile(procFdDir, name)
+		if err != nil {
+			if errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return nil, err
+		}
+		fds[fd] = target
+	}
+	return fds, nil
+}
+
+// IsDeletedHandle returns whether the inode referenced by f has been deleted
+// (its link count has dropped to zero). This includes anonymous files created
+// with O_TMPFILE which have not yet been linked into the filesystem.
+//
+// This should be used instead of checking whether the /proc/self/fd
+// magic-link of f has a " (deleted)" suffix, because a file can legitimately
+// have a name ending in " (deleted)". Note that if only the hard-link that f
+// was opened through was removed (and the inode has other links), the inode
+// is not considered deleted.
+func IsDeletedHandle(f *os.File) (bool, error) {
+	stat, err := fstat(f)
+	if err != nil {
+		return false, &os.PathError{Op: "securejoin.IsDeletedHandle", Path: f.Name(), Err: err}
+	}
+	return stat.Nlink == 0, nil
+}
 
 func isDeadInode(file *os.File) error {
 	// If the nlink of a file drops to 0, there is an attacker deleting
@@ -414,25 +614,25 @@ func isDeadInode(file *os.File) error {
 		return fmt.Errorf("check for dead inode: %w", err)
 	}
 	if stat.Nlink == 0 {
-		err := errDeletedInode
+		err := ErrDeletedInode
 		if stat.Mode&unix.S_IFMT == unix.S_IFDIR {
-			err = errInvalidDirectory
+			err = ErrInvalidDirectory
 		}
 		return fmt.Errorf("%w %q", err, file.Name())
 	}
 	return nil
 }
 
-func checkProcSelfFdPath(path string, file *os.File) error {
+func checkProcSelfFdPath(path string, file *os.File, opts *ResolveOptions) error {
 	if err := isDeadInode(file); err != nil {
 		return err
 	}
-	actualPath, err := procSelfFdReadlink(file)
+	actualPath, err := rawProcSelfFdReadlink(int(file.Fd()), opts)
 	if err != nil {
 		return fmt.Errorf("get path of handle: %w", err)
 	}
 	if actualPath != path {
-		return fmt.Errorf("%w: handle path %q doesn't match expected path %q", errPossibleBreakout, actualPath, path)
+		return fmt.Errorf("%w: handle path %q doesn't match expected path %q", ErrPossibleBreakout, actualPath, path)
 	}
 	return nil
 }
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path"
 	"runtime"
 	"testing"
@@ -171,11 +172,14 @@ func testProcOvermountSubdir(t *testing.T, procRootFn procRootFunc, expectOvermo
 		assert.ErrorIs(t, err, symlinkOvermountErr, "unexpected /proc/self/exe overmount result")
 
 		// fd no overmount
-		_, err = doRawProcSelfFdReadlink(procRoot, 1)
+		_, err = doRawProcSelfFdReadlink(procRoot, 1, nil)
 		assert.NoError(t, err, "checking /proc/self/fd/1 with no overmount should succeed")
 		// fd overmount
-		link, err := doRawProcSelfFdReadlink(procRoot, 0)
+		link, err := doRawProcSelfFdReadlink(procRoot, 0, nil)
 		assert.ErrorIs(t, err, symlinkOvermountErr, "unexpected /proc/self/fd/0 overmount result: got link %q", link)
+		// fd overmount with the check disabled
+		_, err = doRawProcSelfFdReadlink(procRoot, 0, &ResolveOptions{SkipOvermountCheck: true})
+		assert.NoError(t, err, "/proc/self/fd/0 overmount should not be detected with SkipOvermountCheck")
 	})
 }
 
@@ -319,11 +323,11 @@ func TestProcSelfFdPath(t *testing.T) {
 		defer handle.Close()
 
 		// The check should fail if we expect the symlink path.
-		err = checkProcSelfFdPath(symPath, handle)
-		assert.ErrorIs(t, err, errPossibleBreakout, "checkProcSelfFdPath should fail for wrong path")
+		err = checkProcSelfFdPath(symPath, handle, nil)
+		assert.ErrorIs(t, err, ErrPossibleBreakout, "checkProcSelfFdPath should fail for wrong path")
 
 		// The check should fail if we expect the symlink path.
-		err = checkProcSelfFdPath(filePath, handle)
+		err = checkProcSelfFdPath(filePath, handle, nil)
 		assert.NoError(t, err)
 	})
 }
@@ -338,7 +342,7 @@ func TestProcSelfFdPath_DeadFile(t *testing.T) {
 		defer handle.Close()
 
 		// The path still exists.
-		err = checkProcSelfFdPath(fullPath, handle)
+		err = checkProcSelfFdPath(fullPath, handle, nil)
 		assert.NoError(t, err, "checkProcSelfFdPath should succeed with regular file")
 
 		// Delete the path.
@@ -346,12 +350,12 @@ func TestProcSelfFdPath_DeadFile(t *testing.T) {
 		require.NoError(t, err)
 
 		// The check should fail now.
-		err = checkProcSelfFdPath(fullPath, handle)
-		assert.ErrorIs(t, err, errDeletedInode, "checkProcSelfFdPath should fail after deletion")
+		err = checkProcSelfFdPath(fullPath, handle, nil)
+		assert.ErrorIs(t, err, ErrDeletedInode, "checkProcSelfFdPath should fail after deletion")
 
 		// The check should fail even if the expected path ends with " (deleted)".
-		err = checkProcSelfFdPath(fullPath+" (deleted)", handle)
-		assert.ErrorIs(t, err, errDeletedInode, "checkProcSelfFdPath should fail after deletion even with (deleted) suffix")
+		err = checkProcSelfFdPath(fullPath+" (deleted)", handle, nil)
+		assert.ErrorIs(t, err, ErrDeletedInode, "checkProcSelfFdPath should fail after deletion even with (deleted) suffix")
 	})
 }
 
@@ -368,7 +372,7 @@ func TestProcSelfFdPath_DeadDir(t *testing.T) {
 		defer handle.Close()
 
 		// The path still exists.
-		err = checkProcSelfFdPath(fullPath, handle)
+		err = checkProcSelfFdPath(fullPath, handle, nil)
 		assert.NoError(t, err, "checkProcSelfFdPath should succeed with regular directory")
 
 		// Delete the path.
@@ -376,15 +380,75 @@ func TestProcSelfFdPath_DeadDir(t *testing.T) {
 		require.NoError(t, err)
 
 		// The check should fail now.
-		err = checkProcSelfFdPath(fullPath, handle)
-		assert.ErrorIs(t, err, errInvalidDirectory, "checkProcSelfFdPath should fail after deletion")
+		err = checkProcSelfFdPath(fullPath, handle, nil)
+		assert.ErrorIs(t, err, ErrInvalidDirectory, "checkProcSelfFdPath should fail after deletion")
 
 		// The check should fail even if the expected path ends with " (deleted)".
-		err = checkProcSelfFdPath(fullPath+" (deleted)", handle)
-		assert.ErrorIs(t, err, errInvalidDirectory, "checkProcSelfFdPath should fail after deletion even with (deleted) suffix")
+		err = checkProcSelfFdPath(fullPath+" (deleted)", handle, nil)
+		assert.ErrorIs(t, err, ErrInvalidDirectory, "checkProcSelfFdPath should fail after deletion even with (deleted) suffix")
 	})
 }
 
+func TestProcSelfFdPath_DeletedSuffixName(t *testing.T) {
+	testForceProcThreadSelf(t, func(t *testing.T) {
+		root := t.TempDir()
+
+		// A file whose name legitimately ends in " (deleted)" must not be
+		// treated as having been deleted.
+		fullPath := path.Join(root, "foo (deleted)")
+		handle, err := os.Create(fullPath)
+		require.NoError(t, err)
+		defer handle.Close()
+
+		deleted, err := IsDeletedHandle(handle)
+		require.NoError(t, err)
+		assert.False(t, deleted, "IsDeletedHandle of file named with (deleted) suffix")
+		err = checkProcSelfFdPath(fullPath, handle, nil)
+		assert.NoError(t, err, "checkProcSelfFdPath should succeed with (deleted) suffix in name")
+		err = checkProcSelfFdPath(path.Join(root, "foo"), handle, nil)
+		assert.ErrorIs(t, err, ErrPossibleBreakout, "checkProcSelfFdPath should not strip (deleted) suffix")
+
+		// Delete the path.
+		err = os.Remove(fullPath)
+		require.NoError(t, err)
+
+		deleted, err = IsDeletedHandle(handle)
+		require.NoError(t, err)
+		assert.True(t, deleted, "IsDeletedHandle after deletion")
+		err = checkProcSelfFdPath(fullPath, handle, nil)
+		assert.ErrorIs(t, err, ErrDeletedInode, "checkProcSelfFdPath should fail after deletion")
+	})
+}
+
+func TestIsDeletedHandle(t *testing.T) {
+	root := t.TempDir()
+
+	dir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer dir.Close()
+
+	deleted, err := IsDeletedHandle(dir)
+	require.NoError(t, err)
+	assert.False(t, deleted, "IsDeletedHandle of O_PATH directory")
+
+	tmpfile, err := ReopenTmpfile(dir, unix.O_RDWR, 0o600)
+	if errors.Is(err, ErrUnsupported) {
+		t.Skip("O_TMPFILE not supported")
+	}
+	require.NoError(t, err)
+	defer tmpfile.Close()
+
+	deleted, err = IsDeletedHandle(tmpfile)
+	require.NoError(t, err)
+	assert.True(t, deleted, "IsDeletedHandle of anonymous O_TMPFILE")
+
+	// Once the tmpfile is linked into place, it is no longer deleted.
+	require.NoError(t, LinkFdInRoot(dir, tmpfile, "file"))
+	deleted, err = IsDeletedHandle(tmpfile)
+	require.NoError(t, err)
+	assert.False(t, deleted, "IsDeletedHandle of linked O_TMPFILE")
+}
+
 func testVerifyProcRoot(t *testing.T, procRoot string, expectedErr error, errString string) {
 	fakeProcRoot, err := os.OpenFile(procRoot, unix.O_PATH|unix.O_CLOEXEC, 0)
 	require.NoError(t, err)
@@ -423,3 +487,127 @@ func TestProcfsDummyHooks(t *testing.T) {
 	assert.False(t, hookDummy(), "hookDummy should always return false")
 	assert.False(t, hookDummyFile(nil), "hookDummyFile should always return false")
 }
+
+func TestOpenProcRootStrict(t *testing.T) {
+	if !hasNewMountApi() {
+		t.Skip("test requires fsopen/open_tree support")
+	}
+	procRoot, err := OpenProcRootStrict()
+	require.NoError(t, err)
+	defer procRoot.Close()
+
+	assert.NoError(t, verifyProcRoot(procRoot), "strict proc root should be a procfs root")
+}
+
+func TestOpenProcRootStrict_NoFallback(t *testing.T) {
+	level := forceGetProcRootUnsafe
+	testingForceGetProcRoot = &level
+	defer func() { testingForceGetProcRoot = nil }()
+
+	// If a private procfs cannot be created, we must not fall back to the
+	// host /proc.
+	procRoot, err := OpenProcRootStrict()
+	assert.ErrorIs(t, err, unix.ENOTSUP, "OpenProcRootStrict without private procfs")
+	assert.Nil(t, procRoot, "handle should be nil on error")
+}
+
+func TestListProcSelfFds(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(dir + "/file")
+	require.NoError(t, err)
+	defer f.Close()
+
+	closed, err := os.Create(dir + "/closed")
+	require.NoError(t, err)
+	closedFd := int(closed.Fd())
+	require.NoError(t, closed.Close())
+
+	fds, err := ListProcSelfFds()
+	require.NoError(t, err)
+
+	expectedPath, err := procSelfFdReadlink(f)
+	require.NoError(t, err)
+	assert.Equal(t, expectedPath, fds[int(f.Fd())], "path of open file")
+	assert.Contains(t, fds, 0, "stdin should be listed")
+	if path, ok := fds[closedFd]; ok {
+		// The fd number may have been re-used by the procfs handles.
+		assert.NotEqual(t, dir+"/closed", path, "closed file should not be listed")
+	}
+}
+
+func TestOpenProcPidRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t, "dir a", "file a/file")
+
+		pidRoot, err := OpenProcPidRoot(os.Getpid())
+		require.NoError(t, err)
+		defer pidRoot.Close()
+		assert.Equal(t, fmt.Sprintf("/proc/%d/root", os.Getpid()), pidRoot.Name(), "handle name")
+
+		// Our own root is the host root, so we can resolve the test tree
+		// inside it.
+		handle, err := OpenatInRoot(pidRoot, root+"/a/file")
+		require.NoError(t, err, "lookup inside /proc/self/root")
+		defer handle.Close()
+
+		gotPath, err := procSelfFdReadlink(handle)
+		require.NoError(t, err)
+		file, err := os.Open(root + "/a/file")
+		require.NoError(t, err)
+		defer file.Close()
+		expectedPath, err := procSelfFdReadlink(file)
+		require.NoError(t, err)
+		assert.Equal(t, expectedPath, gotPath, "path of handle inside pid root")
+
+		_, err = OpenProcPidRoot(0)
+		assert.ErrorIs(t, err, unix.EINVAL, "OpenProcPidRoot(0)")
+		_, err = OpenProcPidRoot(-1)
+		assert.ErrorIs(t, err, unix.EINVAL, "OpenProcPidRoot(-1)")
+	})
+}
+
+func TestOpenProcPidRoot_Overmount(t *testing.T) {
+	// We need a process other than ourselves to overmount.
+	cmd := exec.Command("sleep", "infinity")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("could not start helper process: %v", err)
+	}
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		testForceGetProcRoot(t, func(t *testing.T, expectOvermounts bool) {
+			setupMountNamespace(t)
+
+			// Bind-mount our own /proc/$pid on top of the helper's, so that
+			// /proc/$pid/root would point to our root.
+			doMount(t, fmt.Sprintf("/proc/%d", os.Getpid()), fmt.Sprintf("/proc/%d", pid), "", unix.MS_BIND)
+
+			procRoot, err := doGetProcRoot()
+			require.NoError(t, err)
+			defer procRoot.Close()
+
+			pidRoot, err := openProcPidRoot(procRoot, pid, fmt.Sprintf("/proc/%d/root", pid))
+			if expectOvermounts {
+				// With openat2, RESOLVE_NO_XDEV blocks the lookup. Otherwise
+				// the mount ID check of /proc/$pid should catch it.
+				expectedErr := errUnsafeProcfs
+				if hasOpenat2() {
+					expectedErr = ErrPossibleAttack
+				}
+				assert.ErrorIsf(t, err, expectedErr, "should have detected /proc/%d overmount", pid)
+				if !hasOpenat2() {
+					// The overmount should be detected on /proc/$pid itself,
+					// not just on the /proc/$pid/root magic-link.
+					assert.ErrorContainsf(t, err, fmt.Sprintf("check safety of /proc/%d:", pid), "should have detected /proc/%d overmount", pid)
+				}
+				assert.Nil(t, pidRoot, "handle should be nil on error")
+			} else if assert.NoErrorf(t, err, "private procfs should not see /proc/%d overmount", pid) {
+				_ = pidRoot.Close()
+			}
+		})
+	})
+}
@@ -0,0 +1,90 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// DirEntryStat is a directory entry returned by [ReadDirStatInRoot], along
+// with the metadata of the entry.
+type DirEntryStat struct {
+	// Name is the name of the entry inside the directory.
+	Name string
+	// Stat is the result of statx(2) on the entry. Symlinks are not followed,
+	// so for a symlink this describes the symlink itself. Callers should check
+	// Stat.Mask to see which fields were filled by the kernel.
+	Stat unix.Statx_t
+}
+
+// ReadDirStatInRoot reads the directory at unsafePath inside root (resolved in
+// the same way as [OpenatInRoot]) and returns its entries along with their
+// metadata (including the size, owner and timestamps of each entry). As with
+// [os.File.ReadDir], the "." and ".." entries are not included, but the
+// entries are sorted by name.
+//
+// The metadata of each entry is fetched with statx(2) relative to the
+// directory handle that was used to read the directory (with
+// AT_SYMLINK_NOFOLLOW), so this is both cheaper and safer than calling
+// [LstatHandleInRoot] for every entry. Entries that are removed while the
+// directory is being read are skipped. If the kernel does not support
+// statx(2) (Linux 4.11 and later), an error wrapping [ErrUnsupported] is
+// returned.
+func ReadDirStatInRoot(root *os.File, unsafePath string) ([]DirEntryStat, error) {
+	handle, err := OpenatInRoot(root, unsafePath)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	names, err := readDirNames(handle)
+	if err != nil {
+		return nil, &os.PathError{Op: "securejoin.ReadDirStatInRoot", Path: unsafePath, Err: err}
+	}
+	entries := make([]DirEntryStat, 0, len(names))
+	for _, name := range names {
+		var stat unix.Statx_t
+		err := unix.Statx(int(handle.Fd()), name, unix.AT_SYMLINK_NOFOLLOW|unix.AT_NO_AUTOMOUNT,
+			unix.STATX_BASIC_STATS|unix.STATX_BTIME, &stat)
+		if err != nil {
+			// The entry was removed while we were reading the directory.
+			if errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			if errors.Is(err, unix.ENOSYS) {
+				err = wrapBaseError(err, ErrUnsupported)
+			}
+			err = &os.PathError{Op: "statx", Path: handle.Name() + "/" + name, Err: err}
+			return nil, &os.PathError{Op: "securejoin.ReadDirStatInRoot", Path: unsafePath, Err: err}
+		}
+		entries = append(entries, DirEntryStat{Name: name, Stat: stat})
+	}
+	return entries, nil
+}
+
+// statDirEntry returns an [fs.DirEntry] for the entry name inside dir. Unlike
+// the entries returned by [os.File.ReadDir] (whose Info method does an
+// lstat(2) of dir.Name()+"/"+name, which could be swapped by an attacker),
+// the metadata is fetched relative to the dir handle without following
+// symlinks, and so the result always describes an entry inside dir.
+func statDirEntry(dir *os.File, name string) (fs.DirEntry, error) {
+	handle, err := openatFile(dir, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	info, err := handle.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return fs.FileInfoToDirEntry(info), nil
+}
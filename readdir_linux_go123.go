@@ -0,0 +1,80 @@
+//go:build linux && go1.23
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"io"
+	"iter"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// readDirSeqBatchSize is the number of directory entries read from the kernel
+// at a time by ReadDirSeqInRoot.
+const readDirSeqBatchSize = 256
+
+// ReadDirSeqInRoot returns an iterator over the entries of the directory at
+// unsafePath inside root (resolved in the same way as [OpenatInRoot]).
+// Entries are read from the kernel in batches, so very large directories can
+// be scanned without reading every entry into memory at once. As with
+// [os.File.ReadDir], the "." and ".." entries are not included, and entries are
+// returned in directory order. The metadata returned by the Info method of
+// each entry is fetched when the entry is read, relative to the directory
+// handle (without following symlinks) rather than by path. Entries that are
+// removed while the directory is being read are skipped.
+//
+// If the directory cannot be opened or an error occurs while reading it, the
+// error is yielded (with a nil [os.DirEntry]) and iteration stops. The
+// directory is closed once iteration is complete, including if the caller
+// stops iterating early.
+//
+// This function is only available with Go 1.23 or later.
+func ReadDirSeqInRoot(root *os.File, unsafePath string) iter.Seq2[os.DirEntry, error] {
+	return func(yield func(os.DirEntry, error) bool) {
+		handle, err := OpenatInRoot(root, unsafePath)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		dir, err := Reopen(handle, unix.O_RDONLY|unix.O_DIRECTORY)
+		_ = handle.Close()
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer dir.Close()
+
+		for {
+			// We cannot use dir.ReadDir, as the Info method of the returned
+			// entries does a path-based lstat(2) using dir.Name().
+			names, err := dir.Readdirnames(readDirSeqBatchSize)
+			for _, name := range names {
+				entry, err := statDirEntry(dir, name)
+				if err != nil {
+					// The entry was removed while we were reading the
+					// directory.
+					if errors.Is(err, unix.ENOENT) {
+						continue
+					}
+					yield(nil, err)
+					return
+				}
+				if !yield(entry, nil) {
+					return
+				}
+			}
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					yield(nil, err)
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+//go:build linux && go1.23
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestReadDirSeqInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		// Make sure we have more entries than a single batch.
+		tree := []string{"dir a", "symlink link a", "file file"}
+		var expected []string
+		for i := 0; i < readDirSeqBatchSize*2+10; i++ {
+			name := fmt.Sprintf("entry%.4d", i)
+			tree = append(tree, "file a/"+name)
+			expected = append(expected, name)
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		t.Run("full", func(t *testing.T) {
+			var got []string
+			ReadDirSeqInRoot(rootDir, "link")(func(entry os.DirEntry, err error) bool {
+				require.NoError(t, err)
+				got = append(got, entry.Name())
+				return true
+			})
+			sort.Strings(got)
+			assert.Equal(t, expected, got, "ReadDirSeqInRoot entries")
+		})
+
+		t.Run("early-stop", func(t *testing.T) {
+			countFds := func() int {
+				fds, err := os.ReadDir("/proc/self/fd")
+				require.NoError(t, err)
+				return len(fds)
+			}
+
+			fdsBefore := countFds()
+			var got int
+			ReadDirSeqInRoot(rootDir, "a")(func(entry os.DirEntry, err error) bool {
+				require.NoError(t, err)
+				got++
+				return got < 3
+			})
+			assert.Equal(t, 3, got, "ReadDirSeqInRoot should stop iterating")
+			assert.Equal(t, fdsBefore, countFds(), "ReadDirSeqInRoot should not leak fds when stopped early")
+		})
+
+		for name, test := range map[string]struct {
+			unsafePath  string
+			expectedErr error
+		}{
+			"nonexist": {"nonexist", unix.ENOENT},
+			"file":     {"file", unix.ENOTDIR},
+		} {
+			test := test // copy iterator
+			t.Run(name, func(t *testing.T) {
+				var gotErrs []error
+				ReadDirSeqInRoot(rootDir, test.unsafePath)(func(entry os.DirEntry, err error) bool {
+					assert.Nil(t, entry, "entry yielded with an error")
+					gotErrs = append(gotErrs, err)
+					return true
+				})
+				if assert.Len(t, gotErrs, 1, "should get exactly one error") {
+					assert.ErrorIs(t, gotErrs[0], test.expectedErr)
+				}
+			})
+		}
+	})
+}
+
+func TestReadDirSeqInRoot_Info(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t, "dir a", "symlink link a", "file file data")
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		entries := map[string]os.DirEntry{}
+		ReadDirSeqInRoot(rootDir, ".")(func(entry os.DirEntry, err error) bool {
+			require.NoError(t, err)
+			entries[entry.Name()] = entry
+			return true
+		})
+		require.Len(t, entries, 3)
+
+		// Move the root away and put something else in its place. The Info
+		// of each entry must not be looked up using the path of the root.
+		require.NoError(t, os.Rename(root, root+".moved"))
+		defer func() { _ = os.Rename(root+".moved", root) }()
+		require.NoError(t, os.Mkdir(root, 0o755))
+		defer os.Remove(root)
+
+		for name, expectedType := range map[string]fs.FileMode{
+			"a":    fs.ModeDir,
+			"link": fs.ModeSymlink,
+			"file": 0,
+		} {
+			entry := entries[name]
+			if assert.NotNilf(t, entry, "entry %q", name) {
+				assert.Equalf(t, expectedType, entry.Type(), "entry %q type", name)
+				info, err := entry.Info()
+				if assert.NoErrorf(t, err, "entry %q info", name) {
+					assert.Equalf(t, expectedType, info.Mode().Type(), "entry %q info type", name)
+				}
+			}
+		}
+		info, err := entries["file"].Info()
+		require.NoError(t, err)
+		assert.EqualValues(t, len("data"), info.Size(), "file size")
+	})
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestReadDirStatInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/dir ::711",
+			"file a/file hello ::640",
+			"symlink a/link ../target",
+			"file target target-data",
+			"dir empty",
+			"symlink escape ../../../../a",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, unsafePath := range []string{"a", "escape"} {
+			entries, err := ReadDirStatInRoot(rootDir, unsafePath)
+			require.NoErrorf(t, err, "ReadDirStatInRoot(%q)", unsafePath)
+
+			names := make([]string, 0, len(entries))
+			for _, entry := range entries {
+				names = append(names, entry.Name)
+			}
+			require.Equal(t, []string{"dir", "file", "link"}, names, "entry names should be sorted")
+
+			dir, file, link := entries[0].Stat, entries[1].Stat, entries[2].Stat
+			assert.Equal(t, uint16(unix.S_IFDIR|0o711), dir.Mode, "dir mode")
+			assert.Equal(t, uint16(unix.S_IFREG|0o640), file.Mode, "file mode")
+			assert.Equal(t, uint64(len("hello")), file.Size, "file size")
+			assert.Equal(t, uint32(os.Getuid()), file.Uid, "file owner")
+			// Symlinks must not be followed.
+			assert.Equal(t, uint16(unix.S_IFLNK), link.Mode&unix.S_IFMT, "symlink mode")
+			assert.Equal(t, uint64(len("../target")), link.Size, "symlink size")
+		}
+
+		entries, err := ReadDirStatInRoot(rootDir, "empty")
+		require.NoError(t, err)
+		assert.Empty(t, entries, "empty directory")
+
+		_, err = ReadDirStatInRoot(rootDir, "a/file")
+		assert.ErrorIs(t, err, unix.ENOTDIR, "ReadDirStatInRoot of a file")
+		_, err = ReadDirStatInRoot(rootDir, "nonexist")
+		assert.ErrorIs(t, err, unix.ENOENT, "ReadDirStatInRoot of non-existent path")
+	})
+}
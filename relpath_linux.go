@@ -0,0 +1,135 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// rootRelativePath returns the path of handle relative to root, based on the
+// real paths of both handles. Deleted inodes are detected using their link
+// count (rather than the " (deleted)" suffix of the magic-link, which is
+// ambiguous), and result in an error.
+func rootRelativePath(root, handle *os.File) (string, error) {
+	if err := isDeadInode(root); err != nil {
+		return "", err
+	}
+	if err := isDeadInode(handle); err != nil {
+		return "", err
+	}
+	rootPath, err := procSelfFdReadlink(root)
+	if err != nil {
+		return "", fmt.Errorf("get real root path: %w", err)
+	}
+	handlePath, err := procSelfFdReadlink(handle)
+	if err != nil {
+		return "", fmt.Errorf("get real path of %q: %w", handle.Name(), err)
+	}
+	relPath, err := filepath.Rel(rootPath, handlePath)
+	if err != nil {
+		return "", err
+	}
+	if relPath == ".." || strings.HasPrefix(relPath, "../") {
+		return "", fmt.Errorf("%w: %q is outside of root %q", ErrPossibleBreakout, handlePath, rootPath)
+	}
+	return relPath, nil
+}
+
+// RelPathInRoot returns the path of handle relative to rootDir, based on the
+// real paths of both handles (as read from /proc/self/fd using the same
+// hardened procfs handle used internally by this package). The returned path
+// always starts with "/", which refers to rootDir itself. This is intended for
+// logging the location of a handle without leaking the host path of the root.
+//
+// If handle is not inside rootDir, an error wrapping [ErrPossibleBreakout] is
+// returned. If the inode referenced by handle (or rootDir) has been deleted,
+// an error wrapping [ErrDeletedInode] (or [ErrInvalidDirectory] for
+// directories) is returned. This makes RelPathInRoot a cheap sanity check
+// that a handle is still confined to the root, but note that (as with any
+// path-based check) a handle that is moved after RelPathInRoot returns may no
+// longer be inside the root.
+func RelPathInRoot(rootDir, handle *os.File) (string, error) {
+	relPath, err := rootRelativePath(rootDir, handle)
+	if err != nil {
+		return "", &os.PathError{Op: "securejoin.RelPathInRoot", Path: handle.Name(), Err: err}
+	}
+	if relPath == "." {
+		return "/", nil
+	}
+	return "/" + relPath, nil
+}
+
+// ConfirmPath checks that handle still refers to the inode at expectedRelPath
+// inside rootDir, based on the real paths of both handles (in the same way as
+// [RelPathInRoot]). expectedRelPath is interpreted relative to rootDir and is
+// cleaned lexically before the comparison, so "a/b", "/a/b" and "a/./b/" are
+// all equivalent. Note that because the real path of the handle is used,
+// expectedRelPath must not contain any symlinks.
+//
+// If the inode referenced by handle (or rootDir) has been deleted, an error
+// wrapping [ErrDeletedInode] (or [ErrInvalidDirectory] for directories) is
+// returned. If the handle is not at expectedRelPath (such as because it was
+// moved after it was opened), an error wrapping [ErrPossibleBreakout] is
+// returned. This is intended as a cheap re-confirmation before acting on a
+// handle, but (as with any path-based check) the handle could still be moved
+// after ConfirmPath returns.
+func ConfirmPath(rootDir, handle *os.File, expectedRelPath string) error {
+	if err := confirmPath(rootDir, handle, expectedRelPath); err != nil {
+		return &os.PathError{Op: "securejoin.ConfirmPath", Path: expectedRelPath, Err: err}
+	}
+	return nil
+}
+
+func confirmPath(rootDir, handle *os.File, expectedRelPath string) error {
+	relPath, err := rootRelativePath(rootDir, handle)
+	if err != nil {
+		return err
+	}
+	gotPath := path.Join("/", relPath)
+	expectedPath := path.Join("/", filepath.ToSlash(expectedRelPath))
+	if gotPath != expectedPath {
+		return fmt.Errorf("%w: handle path %q doesn't match expected path %q", ErrPossibleBreakout, gotPath, expectedPath)
+	}
+	return nil
+}
+
+// UnsafeRealPath resolves unsafePath inside rootDir (in the same way as
+// [OpenatInRoot]) and returns the absolute path of the resolved inode on the
+// host, as read from /proc/self/fd using the same hardened procfs handle used
+// internally by this package. unsafePath must exist. This is intended only
+// for callers which must pass a path to something that cannot accept a file
+// handle (such as an external program).
+//
+// WARNING: As the name suggests, using the returned path is unsafe. The
+// resolution itself is done safely, but the returned string is just a path
+// and so any use of it re-introduces the time-of-check-time-of-use races
+// that the rest of this package protects against (an attacker could replace
+// any component of the path with a symlink after UnsafeRealPath returns). If
+// at all possible, use the handle-based APIs in this package (or pass a
+// /proc/self/fd/$n path for a handle from [OpenatInRoot]) instead.
+func UnsafeRealPath(rootDir *os.File, unsafePath string) (string, error) {
+	handle, err := OpenatInRoot(rootDir, unsafePath)
+	if err != nil {
+		return "", err
+	}
+	defer handle.Close()
+
+	// If the inode was deleted, the magic-link has a " (deleted)" suffix
+	// which would make the path wrong.
+	if err := isDeadInode(handle); err != nil {
+		return "", &os.PathError{Op: "securejoin.UnsafeRealPath", Path: unsafePath, Err: err}
+	}
+	realPath, err := procSelfFdReadlink(handle)
+	if err != nil {
+		return "", &os.PathError{Op: "securejoin.UnsafeRealPath", Path: unsafePath, Err: fmt.Errorf("get real path of %q: %w", handle.Name(), err)}
+	}
+	return realPath, nil
+}
@@ -0,0 +1,137 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestRelPathInRoot(t *testing.T) {
+	base := createTree(t, "dir root/a/b/c", "file root/a/b/file", "symlink root/link a/b", "dir root-sibling")
+	root := filepath.Join(base, "root")
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	for _, test := range []struct {
+		unsafePath, expected string
+	}{
+		{"/", "/"},
+		{"a", "/a"},
+		{"a/b/c", "/a/b/c"},
+		{"a/b/file", "/a/b/file"},
+		{"link/c/../file", "/a/b/file"},
+	} {
+		handle, err := OpenatInRoot(rootDir, test.unsafePath)
+		require.NoErrorf(t, err, "OpenatInRoot(%q)", test.unsafePath)
+
+		relPath, err := RelPathInRoot(rootDir, handle)
+		_ = handle.Close()
+		if assert.NoErrorf(t, err, "RelPathInRoot(%q)", test.unsafePath) {
+			assert.Equalf(t, test.expected, relPath, "RelPathInRoot(%q)", test.unsafePath)
+		}
+	}
+
+	// Handles outside of the root (including ones which share a prefix with
+	// the root path) must be rejected.
+	for _, outsidePath := range []string{base, filepath.Join(base, "root-sibling")} {
+		handle, err := os.OpenFile(outsidePath, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+
+		relPath, err := RelPathInRoot(rootDir, handle)
+		_ = handle.Close()
+		assert.ErrorIsf(t, err, ErrPossibleBreakout, "RelPathInRoot(%q)", outsidePath)
+		assert.Emptyf(t, relPath, "RelPathInRoot(%q)", outsidePath)
+	}
+}
+
+func TestConfirmPath(t *testing.T) {
+	root := createTree(t, "dir a/b", "file a/b/file", "dir a/empty", "symlink link a/b")
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	handle, err := OpenatInRoot(rootDir, "link/file")
+	require.NoError(t, err)
+	defer handle.Close()
+
+	for _, expectedPath := range []string{"a/b/file", "/a/b/file", "a/./b//file/"} {
+		assert.NoErrorf(t, ConfirmPath(rootDir, handle, expectedPath), "ConfirmPath(%q)", expectedPath)
+	}
+	for _, expectedPath := range []string{"a/b", "/", "link/file", "a/b/file/.."} {
+		assert.ErrorIsf(t, ConfirmPath(rootDir, handle, expectedPath), ErrPossibleBreakout, "ConfirmPath(%q)", expectedPath)
+	}
+
+	rootHandle, err := OpenatInRoot(rootDir, "/")
+	require.NoError(t, err)
+	defer rootHandle.Close()
+	assert.NoError(t, ConfirmPath(rootDir, rootHandle, "/"), "ConfirmPath of root")
+
+	// Moving the handle changes its path.
+	require.NoError(t, os.Rename(filepath.Join(root, "a/b"), filepath.Join(root, "a/c")))
+	assert.ErrorIs(t, ConfirmPath(rootDir, handle, "a/b/file"), ErrPossibleBreakout, "ConfirmPath after rename")
+	assert.NoError(t, ConfirmPath(rootDir, handle, "a/c/file"), "ConfirmPath of new path after rename")
+
+	// Deleted inodes cannot be confirmed.
+	require.NoError(t, os.Remove(filepath.Join(root, "a/c/file")))
+	assert.ErrorIs(t, ConfirmPath(rootDir, handle, "a/c/file"), ErrDeletedInode, "ConfirmPath of deleted file")
+
+	dirHandle, err := OpenatInRoot(rootDir, "a/empty")
+	require.NoError(t, err)
+	defer dirHandle.Close()
+	require.NoError(t, os.Remove(filepath.Join(root, "a/empty")))
+	assert.ErrorIs(t, ConfirmPath(rootDir, dirHandle, "a/empty"), ErrInvalidDirectory, "ConfirmPath of deleted directory")
+}
+
+func TestUnsafeRealPath(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/file",
+			"symlink a/link b",
+			"symlink escape ../../../../a",
+		}
+		root := createTree(t, tree...)
+
+		realRoot, err := filepath.EvalSymlinks(root)
+		require.NoError(t, err)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			unsafePath   string
+			expectedPath string
+			expectedErr  error
+		}{
+			{"", "", nil},
+			{"a/b/file", "/a/b/file", nil},
+			{"a/link/file", "/a/b/file", nil},
+			{"escape/link/../b", "/a/b", nil},
+			{"a/nonexist", "", unix.ENOENT},
+		} {
+			realPath, err := UnsafeRealPath(rootDir, test.unsafePath)
+			if test.expectedErr != nil {
+				assert.ErrorIsf(t, err, test.expectedErr, "UnsafeRealPath(%q)", test.unsafePath)
+				assert.Emptyf(t, realPath, "UnsafeRealPath(%q) should return an empty path on error", test.unsafePath)
+				continue
+			}
+			if assert.NoErrorf(t, err, "UnsafeRealPath(%q)", test.unsafePath) {
+				assert.Equalf(t, realRoot+test.expectedPath, realPath, "UnsafeRealPath(%q)", test.unsafePath)
+			}
+		}
+	})
+}
@@ -0,0 +1,138 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"golang.org/x/sys/unix"
+)
+
+// RemoveAllInRoot removes the inode at unsafePath (resolved inside root) and
+// any children it contains, in the same way as [os.RemoveAll]. The parent
+// directory of unsafePath is resolved inside root, and the tree is removed
+// entirely using file handles to each directory. Symlinks are never followed
+// (including a trailing symlink in unsafePath, which is removed rather than
+// its target), so an attacker cannot trick RemoveAllInRoot into removing
+// anything outside of the tree.
+//
+// As with [os.RemoveAll], if unsafePath does not exist then nil is returned.
+// The root itself (or a path with a final "." or ".." component) cannot be
+// removed, and an error wrapping EBUSY is returned in that case.
+func RemoveAllInRoot(root *os.File, unsafePath string) error {
+	_, err := removeAllInRoot("securejoin.RemoveAllInRoot", root, unsafePath, false)
+	return err
+}
+
+// RemoveAllInRootVerbose is equivalent to [RemoveAllInRoot], except that it
+// also returns the paths of every inode that was removed. The paths are
+// relative to the root and are based on the actual directories that were
+// walked (so any symlinks in the parent path of unsafePath are resolved). The
+// paths are returned in post-order (the children of a directory are listed
+// before the directory itself).
+//
+// If an error occurs, the paths of the inodes that were removed before the
+// error are still returned.
+func RemoveAllInRootVerbose(root *os.File, unsafePath string) ([]string, error) {
+	return removeAllInRoot("securejoin.RemoveAllInRootVerbose", root, unsafePath, true)
+}
+
+func removeAllInRoot(op string, root *os.File, unsafePath string, verbose bool) ([]string, error) {
+	parent, name, err := openParentInRoot(root, unsafePath)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil, nil
+		}
+		return nil, &os.PathError{Op: op, Path: unsafePath, Err: err}
+	}
+	defer parent.Close()
+
+	switch name {
+	case "", ".", "..":
+		// The root and "." or ".." components cannot be removed.
+		return nil, &os.PathError{Op: op, Path: unsafePath, Err: unix.EBUSY}
+	}
+
+	r := &treeRemover{verbose: verbose}
+	relPath := name
+	if verbose {
+		parentPath, err := rootRelativePath(root, parent)
+		if err != nil {
+			return nil, &os.PathError{Op: op, Path: unsafePath, Err: err}
+		}
+		relPath = path.Join(parentPath, name)
+	}
+	if err := r.removeAt(parent, name, relPath); err != nil && !errors.Is(err, unix.ENOENT) {
+		return r.removed, &os.PathError{Op: op, Path: unsafePath, Err: err}
+	}
+	return r.removed, nil
+}
+
+// treeRemover contains the state of a single RemoveAllInRoot operation.
+type treeRemover struct {
+	verbose bool
+	removed []string
+}
+
+// removeAt removes the inode name in dir (and all of its children, if it is a
+// directory). relPath is the path reported for name.
+func (r *treeRemover) removeAt(dir *os.File, name, relPath string) error {
+	// Most inodes are not directories, so try to unlink it first.
+	err := unix.Unlinkat(int(dir.Fd()), name, 0)
+	if err == nil {
+		r.record(relPath)
+		return nil
+	}
+	// Linux returns EISDIR for unlink(2) on directories, but POSIX specifies
+	// EPERM.
+	if !errors.Is(err, unix.EISDIR) && !errors.Is(err, unix.EPERM) {
+		return &os.PathError{Op: "unlinkat", Path: dir.Name() + "/" + name, Err: err}
+	}
+	unlinkErr := err
+
+	child, err := openatFile(dir, name, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, unix.ENOTDIR) {
+			// It wasn't a directory, so return the original error.
+			return &os.PathError{Op: "unlinkat", Path: dir.Name() + "/" + name, Err: unlinkErr}
+		}
+		return err
+	}
+	defer child.Close()
+
+	// Keep removing the contents of the directory until it is empty, in case
+	// entries are being added while we remove it.
+	for {
+		names, err := readDirNames(child)
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			break
+		}
+		for _, childName := range names {
+			err := r.removeAt(child, childName, path.Join(relPath, childName))
+			if err != nil && !errors.Is(err, unix.ENOENT) {
+				return err
+			}
+		}
+	}
+
+	if err := unix.Unlinkat(int(dir.Fd()), name, unix.AT_REMOVEDIR); err != nil {
+		return &os.PathError{Op: "unlinkat", Path: dir.Name() + "/" + name, Err: err}
+	}
+	r.record(relPath)
+	return nil
+}
+
+func (r *treeRemover) record(relPath string) {
+	if r.verbose {
+		r.removed = append(r.removed, relPath)
+	}
+}
@@ -0,0 +1,99 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestRemoveAllInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b/c",
+			"file a/b/c/file",
+			"file a/b/file",
+			"dir a/empty",
+			"fifo a/fifo",
+			"symlink a/b/outside /outside",
+			"symlink a/b/dotdot ../../../../outside",
+			"dir outside",
+			"file outside/file",
+			"symlink link-a /a",
+			"symlink link-outside outside",
+		}
+
+		for _, test := range []struct {
+			name, unsafePath string
+			expectedRemoved  []string
+			expectedErr      error
+		}{
+			{"tree", "a", []string{
+				"a/b/c/file", "a/b/c", "a/b/dotdot", "a/b/file", "a/b/outside", "a/b",
+				"a/empty", "a/fifo", "a",
+			}, nil},
+			{"subtree", "a/b/c", []string{"a/b/c/file", "a/b/c"}, nil},
+			{"file", "a/b/file", []string{"a/b/file"}, nil},
+			{"symlink-parent", "link-a/b/c", []string{"a/b/c/file", "a/b/c"}, nil},
+			{"escape", "../../../a/b/c/", []string{"a/b/c/file", "a/b/c"}, nil},
+			// Trailing symlinks are removed, not their targets.
+			{"trailing-symlink", "link-outside", []string{"link-outside"}, nil},
+			{"trailing-symlink-dir", "link-a", []string{"link-a"}, nil},
+			// Missing paths are not an error.
+			{"nonexistent", "a/nope", nil, nil},
+			{"nonexistent-parent", "a/nope/foo", nil, nil},
+			{"root", "/", nil, unix.EBUSY},
+			{"dot", "a/.", nil, unix.EBUSY},
+			{"dotdot", "a/b/..", nil, unix.EBUSY},
+			{"file-parent", "a/b/file/foo", nil, unix.ENOTDIR},
+		} {
+			test := test // copy iterator
+			t.Run(test.name, func(t *testing.T) {
+				root := createTree(t, tree...)
+
+				rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+				require.NoError(t, err)
+				defer rootDir.Close()
+
+				removed, err := RemoveAllInRootVerbose(rootDir, test.unsafePath)
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+				} else {
+					require.NoError(t, err)
+				}
+				assert.Equal(t, test.expectedRemoved, removed, "removed paths")
+
+				for _, path := range removed {
+					_, err := os.Lstat(filepath.Join(root, path))
+					assert.ErrorIsf(t, err, os.ErrNotExist, "%q should have been removed", path)
+				}
+				// Nothing outside of the tree should be touched.
+				_, err = os.Lstat(filepath.Join(root, "outside/file"))
+				assert.NoError(t, err, "outside/file should not be removed")
+			})
+		}
+	})
+}
+
+func TestRemoveAllInRoot_NonVerbose(t *testing.T) {
+	root := createTree(t, "dir a/b/c", "file a/b/c/file", "symlink a/link /")
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	require.NoError(t, RemoveAllInRoot(rootDir, "a"))
+	_, err = os.Lstat(filepath.Join(root, "a"))
+	assert.ErrorIs(t, err, os.ErrNotExist, "a should have been removed")
+	_, err = os.Lstat(root)
+	assert.NoError(t, err, "root should not be removed")
+}
@@ -0,0 +1,151 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// renameat2InRoot resolves the parent directories of oldPath and newPath
+// inside root, and then calls renameat2(2) with the provided flags on the
+// final components. As with rename(2), trailing symlinks are not followed.
+func renameat2InRoot(op string, root *os.File, oldPath, newPath string, flags uint) error {
+	oldParent, oldName, err := openParentInRoot(root, oldPath)
+	if err != nil {
+		return &os.LinkError{Op: op, Old: oldPath, New: newPath, Err: err}
+	}
+	defer oldParent.Close()
+
+	newParent, newName, err := openParentInRoot(root, newPath)
+	if err != nil {
+		return &os.LinkError{Op: op, Old: oldPath, New: newPath, Err: err}
+	}
+	defer newParent.Close()
+
+	for _, name := range []string{oldName, newName} {
+		switch name {
+		case "", ".", "..":
+			// The root and "." or ".." components cannot be renamed.
+			return &os.LinkError{Op: op, Old: oldPath, New: newPath, Err: unix.EBUSY}
+		}
+	}
+
+	err = unix.Renameat2(int(oldParent.Fd()), oldName, int(newParent.Fd()), newName, flags)
+	if err != nil {
+		// Older kernels do not have renameat2(2) at all. EINVAL is also
+		// returned for invalid renames (such as moving a directory inside
+		// itself), so we cannot treat it as meaning the flags are
+		// unsupported.
+		if errors.Is(err, unix.ENOSYS) {
+			err = wrapBaseError(err, ErrUnsupported)
+		}
+		return &os.LinkError{Op: op, Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
+
+// ExchangeInRoot atomically exchanges the inodes at unsafePathA and
+// unsafePathB inside root, using renameat2(2) with RENAME_EXCHANGE. Both
+// paths are resolved inside root (their parent directories must exist), and
+// as with rename(2), trailing symlinks are not followed (the symlinks
+// themselves are exchanged).
+//
+// If the kernel does not support renameat2(2), an error wrapping
+// [ErrUnsupported] is returned. Filesystems which do not support
+// RENAME_EXCHANGE return EINVAL (as with other invalid renames).
+func ExchangeInRoot(root *os.File, unsafePathA, unsafePathB string) error {
+	return renameat2InRoot("securejoin.ExchangeInRoot", root, unsafePathA, unsafePathB, unix.RENAME_EXCHANGE)
+}
+
+// RenameNoReplaceInRoot renames unsafeOldPath to unsafeNewPath inside root
+// using renameat2(2) with RENAME_NOREPLACE, so that an existing inode at
+// unsafeNewPath is never replaced (an error wrapping EEXIST is returned
+// instead). Unlike checking whether unsafeNewPath exists before calling
+// rename(2), this is not subject to any time-of-check-to-time-of-use races.
+// Both paths are resolved inside root in the same way as [ExchangeInRoot].
+//
+// If the kernel does not support renameat2(2), an error wrapping
+// [ErrUnsupported] is returned. Filesystems which do not support
+// RENAME_NOREPLACE return EINVAL. We never fall back to a plain rename(2), as
+// that could silently replace unsafeNewPath.
+func RenameNoReplaceInRoot(root *os.File, unsafeOldPath, unsafeNewPath string) error {
+	return renameat2InRoot("securejoin.RenameNoReplaceInRoot", root, unsafeOldPath, unsafeNewPath, unix.RENAME_NOREPLACE)
+}
+
+// linkHandle creates a new hard-link to the inode referenced by handle at name
+// inside parent.
+func linkHandle(handle, parent *os.File, name string) error {
+	err := unix.Linkat(int(handle.Fd()), "", int(parent.Fd()), name, unix.AT_EMPTY_PATH)
+	if !errors.Is(err, unix.ENOENT) {
+		if err != nil {
+			return &os.LinkError{Op: "linkat", Old: handle.Name(), New: parent.Name() + "/" + name, Err: err}
+		}
+		return nil
+	}
+
+	// Without CAP_DAC_READ_SEARCH, linkat(AT_EMPTY_PATH) fails with ENOENT
+	// (Linux 6.10 relaxed this for handles opened by the caller, but older
+	// kernels do not). So fall back to linking the /proc/thread-self/fd/$n
+	// magic-link (which always refers to the exact inode of the handle), as
+	// with faccessHandle.
+	procRoot, err := getProcRoot()
+	if err != nil {
+		return err
+	}
+
+	procFdDir, closer, err := procThreadSelf(procRoot, "fd/")
+	if err != nil {
+		return fmt.Errorf("get safe /proc/thread-self/fd handle: %w", err)
+	}
+	defer procFdDir.Close()
+	defer closer()
+
+	fdStr := strconv.Itoa(int(handle.Fd()))
+	if err := checkSymlinkOvermount(procRoot, procFdDir, fdStr); err != nil {
+		return fmt.Errorf("check safety of /proc/thread-self/fd/%s magiclink: %w", fdStr, err)
+	}
+	if err := unix.Linkat(int(procFdDir.Fd()), fdStr, int(parent.Fd()), name, unix.AT_SYMLINK_FOLLOW); err != nil {
+		return &os.LinkError{Op: "linkat", Old: handle.Name(), New: parent.Name() + "/" + name, Err: err}
+	}
+	return nil
+}
+
+// LinkFdInRoot creates a new hard-link to the inode referenced by src at
+// unsafeDstPath inside root. The parent directory of unsafeDstPath is resolved
+// inside root (and must already exist), and as with link(2), an existing
+// inode at unsafeDstPath is never replaced (an error wrapping EEXIST is
+// returned instead).
+//
+// This is intended to be the final step of atomically creating a file, by
+// linking an anonymous file created with [ReopenTmpfile] (without O_EXCL)
+// into place once it has been fully written. src may also be a handle to an
+// existing (non-directory) file. If the caller does not have
+// CAP_DAC_READ_SEARCH, the link is created through the /proc/thread-self/fd
+// magic-link of src, using the same hardened procfs handle used internally
+// by this package.
+func LinkFdInRoot(root, src *os.File, unsafeDstPath string) error {
+	parent, name, err := openParentInRoot(root, unsafeDstPath)
+	if err != nil {
+		return &os.LinkError{Op: "securejoin.LinkFdInRoot", Old: src.Name(), New: unsafeDstPath, Err: err}
+	}
+	defer parent.Close()
+
+	switch name {
+	case "", ".", "..":
+		// The root and "." or ".." components always exist.
+		return &os.LinkError{Op: "securejoin.LinkFdInRoot", Old: src.Name(), New: unsafeDstPath, Err: unix.EEXIST}
+	}
+	if err := linkHandle(src, parent, name); err != nil {
+		return &os.LinkError{Op: "securejoin.LinkFdInRoot", Old: src.Name(), New: unsafeDstPath, Err: err}
+	}
+	return nil
+}
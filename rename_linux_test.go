@@ -0,0 +1,198 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// checkFileContent makes sure that the file at path (which must not be a
+// symlink) contains the expected content.
+func checkFileContent(t *testing.T, path, expected string) {
+	fi, err := os.Lstat(path)
+	require.NoError(t, err)
+	require.Truef(t, fi.Mode().IsRegular(), "%q should be a regular file", path)
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equalf(t, expected, string(content), "content of %q", path)
+}
+
+func TestExchangeInRoot(t *testing.T) {
+	if !hasRenameExchange() {
+		t.Skip("test requires RENAME_EXCHANGE support")
+	}
+
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a",
+			"file a/file A",
+			"dir b",
+			"file b/file B",
+			"symlink b/link file",
+			"symlink link-a /a",
+		}
+
+		for _, test := range []struct {
+			name, pathA, pathB string
+			expectedErr        error
+		}{
+			{"files", "a/file", "b/file", nil},
+			{"dirs", "a", "b", nil},
+			{"symlink-parent", "link-a/file", "../../b/file", nil},
+			{"symlink-final", "b/link", "a/file", nil},
+			{"nonexistent", "a/file", "b/nope", unix.ENOENT},
+			{"nonexistent-parent", "a/file", "c/file", unix.ENOENT},
+			{"root", "/", "a", unix.EBUSY},
+			{"dotdot", "a/..", "b/file", unix.EBUSY},
+		} {
+			test := test // copy iterator
+			t.Run(test.name, func(t *testing.T) {
+				root := createTree(t, tree...)
+
+				rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+				require.NoError(t, err)
+				defer rootDir.Close()
+
+				err = ExchangeInRoot(rootDir, test.pathA, test.pathB)
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+					// Nothing should've changed.
+					checkFileContent(t, filepath.Join(root, "a/file"), "A")
+					checkFileContent(t, filepath.Join(root, "b/file"), "B")
+					return
+				}
+				require.NoError(t, err)
+
+				switch test.name {
+				case "files", "symlink-parent":
+					checkFileContent(t, filepath.Join(root, "a/file"), "B")
+					checkFileContent(t, filepath.Join(root, "b/file"), "A")
+				case "dirs":
+					checkFileContent(t, filepath.Join(root, "a/file"), "B")
+					checkFileContent(t, filepath.Join(root, "b/file"), "A")
+					fi, err := os.Lstat(filepath.Join(root, "a/link"))
+					require.NoError(t, err)
+					assert.Equal(t, os.ModeSymlink, fi.Mode()&os.ModeType, "a/link should be a symlink")
+				case "symlink-final":
+					// The symlink itself (not its target) should be swapped.
+					checkFileContent(t, filepath.Join(root, "b/link"), "A")
+					target, err := os.Readlink(filepath.Join(root, "a/file"))
+					require.NoError(t, err)
+					assert.Equal(t, "file", target, "a/file should now be the symlink")
+					checkFileContent(t, filepath.Join(root, "b/file"), "B")
+				}
+			})
+		}
+	})
+}
+
+func TestRenameNoReplaceInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a",
+			"file a/file A",
+			"dir b",
+			"file b/file B",
+			"symlink b/dangling nope",
+			"symlink link-b /b",
+		}
+
+		for _, test := range []struct {
+			name, oldPath, newPath string
+			expectedPath           string
+			expectedErr            error
+		}{
+			{"new", "a/file", "b/new", "b/new", nil},
+			{"symlink-parent", "a/file", "link-b/new", "b/new", nil},
+			{"escape", "../../a/file", "../../../b/new", "b/new", nil},
+			{"existing", "a/file", "b/file", "", unix.EEXIST},
+			{"existing-dir", "a/file", "b", "", unix.EEXIST},
+			{"dangling-symlink", "a/file", "b/dangling", "", unix.EEXIST},
+			{"nonexistent", "a/nope", "b/new", "", unix.ENOENT},
+			{"nonexistent-parent", "a/file", "c/new", "", unix.ENOENT},
+			{"dir-inside-itself", "a", "a/new", "", unix.EINVAL},
+		} {
+			test := test // copy iterator
+			t.Run(test.name, func(t *testing.T) {
+				root := createTree(t, tree...)
+
+				rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+				require.NoError(t, err)
+				defer rootDir.Close()
+
+				err = RenameNoReplaceInRoot(rootDir, test.oldPath, test.newPath)
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+					assert.NotErrorIs(t, err, ErrUnsupported)
+					// Nothing should've changed.
+					checkFileContent(t, filepath.Join(root, "a/file"), "A")
+					checkFileContent(t, filepath.Join(root, "b/file"), "B")
+					return
+				}
+				require.NoError(t, err)
+
+				checkFileContent(t, filepath.Join(root, test.expectedPath), "A")
+				_, err = os.Lstat(filepath.Join(root, "a/file"))
+				assert.ErrorIs(t, err, os.ErrNotExist, "old path should no longer exist")
+			})
+		}
+	})
+}
+
+func TestLinkFdInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t, "dir a", "file a/existing data", "symlink escape ../../../../a")
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		dirHandle, err := OpenatInRoot(rootDir, "a")
+		require.NoError(t, err)
+		defer dirHandle.Close()
+
+		tmpfile, err := ReopenTmpfile(dirHandle, unix.O_RDWR, 0o644)
+		if errors.Is(err, ErrUnsupported) {
+			t.Skip("O_TMPFILE not supported")
+		}
+		require.NoError(t, err)
+		defer tmpfile.Close()
+		_, err = tmpfile.WriteString("tmpfile data")
+		require.NoError(t, err)
+
+		// Link the anonymous file into place (through a symlink that would
+		// escape the root if it wasn't resolved inside the root).
+		err = LinkFdInRoot(rootDir, tmpfile, "escape/new")
+		require.NoError(t, err, "link tmpfile into root")
+		checkFileContent(t, filepath.Join(root, "a/new"), "tmpfile data")
+
+		// Existing paths are never replaced.
+		for _, unsafePath := range []string{"a/existing", "a/new", "", "a/.."} {
+			err = LinkFdInRoot(rootDir, tmpfile, unsafePath)
+			assert.ErrorIsf(t, err, unix.EEXIST, "LinkFdInRoot(%q)", unsafePath)
+		}
+		checkFileContent(t, filepath.Join(root, "a/existing"), "data")
+
+		// Non-anonymous files can also be linked.
+		existing, err := OpenatInRoot(rootDir, "a/existing")
+		require.NoError(t, err)
+		defer existing.Close()
+		err = LinkFdInRoot(rootDir, existing, "link")
+		require.NoError(t, err, "link existing file")
+		checkFileContent(t, filepath.Join(root, "link"), "data")
+
+		err = LinkFdInRoot(rootDir, tmpfile, "nonexist/new")
+		assert.ErrorIs(t, err, unix.ENOENT, "LinkFdInRoot with missing parent")
+	})
+}
@@ -0,0 +1,374 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ResolveAction describes what was done during a single step of a path
+// resolution, as reported to [ResolveOptions.Trace].
+type ResolveAction int
+
+const (
+	// ResolveActionOpen indicates that a regular path component was opened
+	// and walked into.
+	ResolveActionOpen ResolveAction = iota
+	// ResolveActionSymlink indicates that a symlink component was found, and
+	// that its target (stored in [ResolveStep.Target]) will be walked next.
+	ResolveActionSymlink
+	// ResolveActionDotDot indicates that a ".." component was walked.
+	ResolveActionDotDot
+	// ResolveActionRetry indicates that an openat2(2) lookup failed
+	// spuriously (with the error stored in [ResolveStep.Err]) and will be
+	// retried. This can indicate that an attacker is racing against the
+	// lookup.
+	ResolveActionRetry
+)
+
+func (a ResolveAction) String() string {
+	switch a {
+	case ResolveActionOpen:
+		return "open"
+	case ResolveActionSymlink:
+		return "symlink"
+	case ResolveActionDotDot:
+		return "dotdot"
+	case ResolveActionRetry:
+		return "retry"
+	default:
+		return "unknown"
+	}
+}
+
+// ResolveStep describes a single step of a path resolution.
+type ResolveStep struct {
+	// Component is the path component which was handled by this step. For
+	// [ResolveActionRetry], this is the whole path that is being looked up.
+	Component string
+	// Action is the action that was taken for this step.
+	Action ResolveAction
+	// Path is the real path (as seen from the host) of the current directory
+	// after this step has completed. This is empty for [ResolveActionRetry].
+	Path string
+	// Target is the contents of the symlink for [ResolveActionSymlink].
+	Target string
+	// Err is the error which caused the retry for [ResolveActionRetry].
+	Err error
+}
+
+// FallbackReason describes why the emulated resolver was used for a lookup
+// instead of openat2(2), as reported in [ResolveInfo].
+type FallbackReason int
+
+const (
+	// ReasonNone indicates that openat2(2) was used for the lookup (or that
+	// no lookup was needed).
+	ReasonNone FallbackReason = iota
+	// ReasonNoOpenat2 indicates that the running kernel does not support
+	// openat2(2) (it was added in Linux 5.6).
+	ReasonNoOpenat2
+	// ReasonFlagUnsupported indicates that one of the requested
+	// [ResolveOptions] (such as [ResolveOptions.RejectDotDot]) cannot be
+	// implemented using openat2(2).
+	ReasonFlagUnsupported
+	// ReasonForcedEmulated indicates that openat2(2) is supported, but the
+	// use of the emulated resolver was forced (such as by a testing hook).
+	ReasonForcedEmulated
+)
+
+func (r FallbackReason) String() string {
+	switch r {
+	case ReasonNone:
+		return "none"
+	case ReasonNoOpenat2:
+		return "no-openat2"
+	case ReasonFlagUnsupported:
+		return "flag-unsupported"
+	case ReasonForcedEmulated:
+		return "forced-emulated"
+	default:
+		return "unknown"
+	}
+}
+
+// ResolveInfo contains information about how a lookup was done, as filled in
+// by [OpenatInRootWithOptions] if [ResolveOptions.Info] is set.
+type ResolveInfo struct {
+	// Fallback is the reason the emulated resolver was used instead of
+	// openat2(2), or [ReasonNone] if openat2(2) was used.
+	Fallback FallbackReason
+}
+
+// ResolveOptions contains optional settings for path resolution functions such
+// as [OpenatInRootWithOptions]. The zero value (or a nil *ResolveOptions) is
+// equivalent to the default behaviour of [OpenatInRoot].
+type ResolveOptions struct {
+	// Trace, if non-nil, is called for each step of the resolution. This is
+	// purely observational and is intended for debugging why a path resolved
+	// the way it did.
+	//
+	// Note that when openat2(2) is used, the kernel does the resolution
+	// in one step and so only [ResolveActionRetry] steps will be reported.
+	Trace func(step ResolveStep)
+
+	// NoFollowTrailing causes the final component of the path to not be
+	// followed if it is a symlink (like O_NOFOLLOW), so that the returned
+	// handle refers to the symlink itself rather than its target. Symlinks in
+	// any other component of the path are still resolved as usual (within the
+	// root). If the path has a trailing slash, the final component must be a
+	// directory and so a trailing symlink is always followed.
+	NoFollowTrailing bool
+
+	// RequireOpenat2 causes the lookup to fail with an error wrapping
+	// [ErrUnsupported] if openat2(2) is not supported by the running kernel,
+	// rather than falling back to the emulated (userspace) resolver. The
+	// emulated resolver is designed to be safe against attacks, but callers
+	// that want the strongest guarantees provided by the kernel can use this
+	// to abort instead.
+	RequireOpenat2 bool
+
+	// SkipOvermountCheck disables the checks for mounts on top of the procfs
+	// magic-links used internally (such as /proc/thread-self/fd/$n), saving a
+	// statx(2) call for each check. This is only used by the emulated
+	// resolver and [ReopenWithOptions].
+	//
+	// WARNING: The overmount checks are a security measure against attackers
+	// that can configure mounts on top of /proc (such as a malicious container
+	// image). Only set this if you fully control the mount namespace (and
+	// procfs mount) that this process is running in, and no untrusted process
+	// can create mounts inside it.
+	SkipOvermountCheck bool
+
+	// RequireDir causes the lookup to fail with an error wrapping ENOTDIR if
+	// the final component of the path is not a directory. When openat2(2) is
+	// used, this is enforced by the kernel (by passing O_DIRECTORY) and so
+	// does not need an extra fstat(2) call. RequireDir cannot be combined
+	// with RequireNonDir.
+	RequireDir bool
+
+	// RequireNonDir causes the lookup to fail with an error wrapping EISDIR
+	// if the final component of the path is a directory. Combined with
+	// NoFollowTrailing, this makes sure that the returned handle refers to a
+	// non-directory inode which is the final component itself (rather than
+	// the target of a trailing symlink). RequireNonDir cannot be combined with
+	// RequireDir.
+	RequireNonDir bool
+
+	// RejectDotDot causes the lookup to fail with an error wrapping
+	// [ErrForbiddenDotDot] if a ".." component is found in the path or in the
+	// target of any symlink walked during the lookup. Unlike RESOLVE_BENEATH,
+	// this also forbids ".." components that would stay inside the root.
+	//
+	// Because openat2(2) does not let us check the contents of symlinks, the
+	// emulated resolver is always used when RejectDotDot is set, and so it
+	// cannot be combined with RequireOpenat2.
+	RejectDotDot bool
+
+	// MaxComponents and MaxTotalLen limit the total number of (non-empty)
+	// path components and the total length (in bytes) of the path being
+	// resolved, including the targets of every symlink walked during the
+	// lookup. If either limit is exceeded, the lookup fails with an error
+	// wrapping [ErrPathTooComplex] before any further syscalls are done. This
+	// allows callers to bound the work done for adversarial paths (such as a
+	// short path which expands into a very long path through symlinks). A
+	// value of zero means that there is no limit.
+	//
+	// As with RejectDotDot, the emulated resolver is always used if either
+	// limit is set, and so they cannot be combined with RequireOpenat2.
+	MaxComponents int
+	MaxTotalLen   int
+
+	// TryCached causes openat2(2) lookups to first be attempted with
+	// RESOLVE_CACHED, which only succeeds if the lookup can be completed
+	// entirely using the kernel's dentry cache. If the cached attempt fails
+	// with EAGAIN (or the kernel does not support RESOLVE_CACHED, which was
+	// added in Linux 5.12), the lookup is retried without RESOLVE_CACHED.
+	// This can reduce the latency of lookups of hot paths. TryCached has no
+	// effect when the emulated resolver is used.
+	TryCached bool
+
+	// SymlinkPolicy, if set, is called each time a symlink is about to be
+	// followed during the lookup, with the path of the symlink (relative to
+	// the root, starting with "/") and the contents of the symlink. If it
+	// returns a non-nil error, the lookup is aborted and the returned error
+	// wraps the error from SymlinkPolicy. This allows callers to decide which
+	// symlinks may be followed (such as only permitting relative symlinks).
+	// SymlinkPolicy is not called for a trailing symlink that is not followed
+	// due to NoFollowTrailing.
+	//
+	// As with RejectDotDot, the emulated resolver is always used when
+	// SymlinkPolicy is set, and so it cannot be combined with RequireOpenat2.
+	SymlinkPolicy func(linkPath, target string) error
+
+	// ProcRoot, if set, is a handle to the root of a procfs mount which is
+	// used for the internal /proc/thread-self/fd lookups (and associated
+	// overmount checks) done during the lookup and by [ReopenWithOptions],
+	// instead of the procfs handle that is cached internally by this package.
+	// This allows callers to share a single procfs handle (such as one
+	// returned by [OpenProcRootStrict]) and control its lifetime. The handle
+	// must remain open for the duration of the operation, and is verified to
+	// be the root of a procfs mount before it is used. ProcRoot is not closed
+	// by this package.
+	ProcRoot *os.File
+
+	// VerifyRootMount causes the mount ID of the root handle to be recorded
+	// at the start of the lookup, and re-checked against the mount ID of the
+	// path of the root once the lookup has completed. If they differ (such
+	// as because the root is a bind-mount that was replaced, overmounted or
+	// unmounted during the lookup), the lookup fails with an error wrapping
+	// [ErrPossibleBreakout]. This allows callers that later operate on the
+	// root by path to detect that the whole root was swapped. The path of the
+	// root is read from /proc/self/fd rather than using root.Name(), which
+	// need not be a real path.
+	//
+	// The check requires statx(2) support for STATX_MNT_ID (added in Linux
+	// 5.8), and is a no-op on older kernels.
+	VerifyRootMount bool
+
+	// Info, if non-nil, is filled in with information about how the lookup
+	// was done (such as why the emulated resolver was used instead of
+	// openat2(2)). This is purely observational, and is intended to help
+	// diagnose differences in performance or behaviour between hosts. Info
+	// is reset at the start of each lookup, so a single ResolveOptions with
+	// Info set must not be used for concurrent lookups.
+	Info *ResolveInfo
+
+	// StayOnRootFilesystem causes the device ID (st_dev) of the root to be
+	// recorded at the start of the lookup, and the lookup to fail with an
+	// error wrapping EXDEV if any component resolved during the lookup
+	// (including symlinks that are followed) has a different device ID. This
+	// can be used to refuse to walk into nested mounts of other filesystems
+	// inside the root (such as a tmpfs mounted inside the root by an
+	// attacker).
+	//
+	// Unlike RESOLVE_NO_XDEV, this only checks the device ID and so walking
+	// into a bind-mount of the same filesystem is permitted. openat2(2) has
+	// no equivalent of this check, so (as with RejectDotDot) the emulated
+	// resolver is always used when StayOnRootFilesystem is set, and so it
+	// cannot be combined with RequireOpenat2. In this case [ResolveInfo]
+	// reports [ReasonFlagUnsupported].
+	StayOnRootFilesystem bool
+}
+
+// tracing returns whether opts.Trace should be called. Callers should check
+// this before constructing a ResolveStep, to avoid needless allocations.
+func (opts *ResolveOptions) tracing() bool {
+	return opts != nil && opts.Trace != nil
+}
+
+// noFollowTrailing returns whether opts.NoFollowTrailing is set.
+func (opts *ResolveOptions) noFollowTrailing() bool {
+	return opts != nil && opts.NoFollowTrailing
+}
+
+// requireOpenat2 returns whether opts.RequireOpenat2 is set.
+func (opts *ResolveOptions) requireOpenat2() bool {
+	return opts != nil && opts.RequireOpenat2
+}
+
+// skipOvermountCheck returns whether opts.SkipOvermountCheck is set.
+func (opts *ResolveOptions) skipOvermountCheck() bool {
+	return opts != nil && opts.SkipOvermountCheck
+}
+
+// requireDir returns whether opts.RequireDir is set.
+func (opts *ResolveOptions) requireDir() bool {
+	return opts != nil && opts.RequireDir
+}
+
+// requireNonDir returns whether opts.RequireNonDir is set.
+func (opts *ResolveOptions) requireNonDir() bool {
+	return opts != nil && opts.RequireNonDir
+}
+
+// tryCached returns whether opts.TryCached is set.
+func (opts *ResolveOptions) tryCached() bool {
+	return opts != nil && opts.TryCached
+}
+
+// rejectDotDot returns whether opts.RejectDotDot is set.
+func (opts *ResolveOptions) rejectDotDot() bool {
+	return opts != nil && opts.RejectDotDot
+}
+
+// hasPathLimits returns whether opts.MaxComponents or opts.MaxTotalLen is set.
+func (opts *ResolveOptions) hasPathLimits() bool {
+	return opts != nil && (opts.MaxComponents > 0 || opts.MaxTotalLen > 0)
+}
+
+// needsEmulatedResolver returns whether opts contains any options which
+// require the emulated resolver (because openat2(2) does not let us inspect
+// the contents of symlinks or the components walked during the lookup).
+func (opts *ResolveOptions) needsEmulatedResolver() bool {
+	return opts.rejectDotDot() || opts.hasPathLimits() || opts.hasSymlinkPolicy() || opts.stayOnRootFilesystem()
+}
+
+// hasSymlinkPolicy returns whether opts.SymlinkPolicy is set.
+func (opts *ResolveOptions) hasSymlinkPolicy() bool {
+	return opts != nil && opts.SymlinkPolicy != nil
+}
+
+// stayOnRootFilesystem returns whether opts.StayOnRootFilesystem is set.
+func (opts *ResolveOptions) stayOnRootFilesystem() bool {
+	return opts != nil && opts.StayOnRootFilesystem
+}
+
+// setFallback records reason in opts.Info, if it is set.
+func (opts *ResolveOptions) setFallback(reason FallbackReason) {
+	if opts != nil && opts.Info != nil {
+		opts.Info.Fallback = reason
+	}
+}
+
+// verifyRootMount returns whether opts.VerifyRootMount is set.
+func (opts *ResolveOptions) verifyRootMount() bool {
+	return opts != nil && opts.VerifyRootMount
+}
+
+// procRoot returns opts.ProcRoot if it is set, otherwise the procfs handle
+// cached internally by this package.
+func (opts *ResolveOptions) procRoot() (*os.File, error) {
+	if opts == nil || opts.ProcRoot == nil {
+		return getProcRoot()
+	}
+	if err := verifyProcRoot(opts.ProcRoot); err != nil {
+		return nil, fmt.Errorf("verify ProcRoot: %w", err)
+	}
+	return opts.ProcRoot, nil
+}
+
+// pathBudget tracks the total size of a path being resolved (including the
+// targets of any symlinks walked) for ResolveOptions.MaxComponents and
+// ResolveOptions.MaxTotalLen.
+type pathBudget struct {
+	components, length int
+}
+
+// add accounts for p (either the path being resolved, or the target of a
+// symlink) in the budget, returning an error wrapping ErrPathTooComplex if
+// the limits in opts have been exceeded.
+func (b *pathBudget) add(opts *ResolveOptions, p string) error {
+	if !opts.hasPathLimits() {
+		return nil
+	}
+	b.length += len(p)
+	for _, part := range strings.Split(p, "/") {
+		if part != "" {
+			b.components++
+		}
+	}
+	if opts.MaxComponents > 0 && b.components > opts.MaxComponents {
+		return fmt.Errorf("%w: more than %d path components", ErrPathTooComplex, opts.MaxComponents)
+	}
+	if opts.MaxTotalLen > 0 && b.length > opts.MaxTotalLen {
+		return fmt.Errorf("%w: longer than %d bytes", ErrPathTooComplex, opts.MaxTotalLen)
+	}
+	return nil
+}
@@ -0,0 +1,814 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenInRootWithOptions_Trace(t *testing.T) {
+	withWithoutOpenat2(t, false, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/c",
+			"symlink link ../a/b",
+		}
+		root := createTree(t, tree...)
+
+		realRoot, err := filepath.EvalSymlinks(root)
+		require.NoError(t, err)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			unsafePath string
+			expected   []ResolveStep
+		}{
+			{"a/b/c", []ResolveStep{
+				{Component: "a", Action: ResolveActionOpen, Path: realRoot + "/a"},
+				{Component: "b", Action: ResolveActionOpen, Path: realRoot + "/a/b"},
+				{Component: "c", Action: ResolveActionOpen, Path: realRoot + "/a/b/c"},
+			}},
+			{"a/b/../b/c", []ResolveStep{
+				{Component: "a", Action: ResolveActionOpen, Path: realRoot + "/a"},
+				{Component: "b", Action: ResolveActionOpen, Path: realRoot + "/a/b"},
+				{Component: "..", Action: ResolveActionDotDot, Path: realRoot + "/a"},
+				{Component: "b", Action: ResolveActionOpen, Path: realRoot + "/a/b"},
+				{Component: "c", Action: ResolveActionOpen, Path: realRoot + "/a/b/c"},
+			}},
+			{"link/c", []ResolveStep{
+				{Component: "link", Action: ResolveActionSymlink, Path: realRoot, Target: "../a/b"},
+				{Component: "..", Action: ResolveActionDotDot, Path: realRoot},
+				{Component: "a", Action: ResolveActionOpen, Path: realRoot + "/a"},
+				{Component: "b", Action: ResolveActionOpen, Path: realRoot + "/a/b"},
+				{Component: "c", Action: ResolveActionOpen, Path: realRoot + "/a/b/c"},
+			}},
+		} {
+			test := test // copy iterator
+			t.Run(test.unsafePath, func(t *testing.T) {
+				var steps []ResolveStep
+				handle, err := OpenatInRootWithOptions(context.Background(), rootDir, test.unsafePath, &ResolveOptions{
+					Trace: func(step ResolveStep) { steps = append(steps, step) },
+				})
+				require.NoError(t, err)
+				_ = handle.Close()
+
+				if hasOpenat2() {
+					// openat2 only reports retries, which shouldn't happen
+					// during the test.
+					assert.Empty(t, steps, "openat2 trace steps")
+				} else {
+					assert.Equal(t, test.expected, steps, "emulated trace steps")
+				}
+			})
+		}
+	})
+}
+
+func TestOpenInRootWithOptions_NoFollowTrailing(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/c",
+			"symlink link a/b/c",
+			"symlink a/uplink ../link",
+			"symlink dirlink a/b",
+			"symlink dangling nope",
+		}
+		root := createTree(t, tree...)
+
+		realRoot, err := filepath.EvalSymlinks(root)
+		require.NoError(t, err)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			unsafePath   string
+			expectedPath string
+			expectedLink string // "" if the handle is not a symlink
+			expectedErr  error
+		}{
+			// Trailing symlinks are not followed.
+			{"link", "/link", "a/b/c", nil},
+			{"a/uplink", "/a/uplink", "../link", nil},
+			{"dangling", "/dangling", "nope", nil},
+			{"a/../dangling", "/dangling", "nope", nil},
+			// Non-trailing symlinks are still followed.
+			{"dirlink/c", "/a/b/c", "", nil},
+			{"dirlink/../../dangling", "/dangling", "nope", nil},
+			// A trailing slash requires the symlink to be followed.
+			{"dirlink/", "/a/b", "", nil},
+			{"link/", "", "", unix.ENOTDIR},
+			// Regular lookups are unaffected.
+			{"a/b/c", "/a/b/c", "", nil},
+			{"a/b/d", "", "", unix.ENOENT},
+		} {
+			test := test // copy iterator
+			t.Run(test.unsafePath, func(t *testing.T) {
+				handle, err := OpenatInRootWithOptions(context.Background(), rootDir, test.unsafePath, &ResolveOptions{
+					NoFollowTrailing: true,
+				})
+				if test.expectedErr != nil {
+					if !assert.ErrorIs(t, err, test.expectedErr) {
+						_ = handle.Close()
+					}
+					return
+				}
+				require.NoError(t, err)
+				defer handle.Close()
+
+				handlePath, err := procSelfFdReadlink(handle)
+				require.NoError(t, err, "get real path of handle")
+				assert.Equal(t, realRoot+test.expectedPath, handlePath, "handle path")
+
+				st, err := handle.Stat()
+				require.NoError(t, err, "stat handle")
+				if test.expectedLink == "" {
+					assert.NotEqual(t, os.ModeSymlink, st.Mode()&os.ModeType, "handle should not be a symlink")
+				} else {
+					assert.Equal(t, os.ModeSymlink, st.Mode()&os.ModeType, "handle should be a symlink")
+					target, err := readlinkatFile(handle, "")
+					require.NoError(t, err, "readlink handle")
+					assert.Equal(t, test.expectedLink, target, "symlink target")
+				}
+			})
+		}
+	})
+}
+
+func TestOpenInRootWithOptions_RequireOpenat2(t *testing.T) {
+	withWithoutOpenat2(t, false, func(t *testing.T) {
+		root := createTree(t, "dir a/b", "file a/b/c")
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		handle, err := OpenatInRootWithOptions(context.Background(), rootDir, "a/b/c", &ResolveOptions{
+			RequireOpenat2: true,
+		})
+		if hasOpenat2() {
+			require.NoError(t, err, "lookup with openat2")
+			_ = handle.Close()
+		} else {
+			assert.ErrorIs(t, err, ErrUnsupported, "lookup without openat2")
+			assert.Nil(t, handle, "handle should be nil on error")
+		}
+	})
+}
+
+func TestOpenInRootWithOptions_SkipOvermountCheck(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t, "dir a/b", "file a/b/c hello", "symlink link a/b/../b/c")
+
+		realRoot, err := filepath.EvalSymlinks(root)
+		require.NoError(t, err)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		opts := &ResolveOptions{SkipOvermountCheck: true}
+		for _, unsafePath := range []string{"a/b/c", "a/./b/c", "link"} {
+			handle, err := OpenatInRootWithOptions(context.Background(), rootDir, unsafePath, opts)
+			require.NoErrorf(t, err, "OpenatInRootWithOptions(%q)", unsafePath)
+
+			handlePath, err := procSelfFdReadlink(handle)
+			require.NoError(t, err, "get real path of handle")
+			assert.Equal(t, realRoot+"/a/b/c", handlePath, "handle path")
+
+			file, err := ReopenWithOptions(handle, unix.O_RDONLY, &ReopenOptions{ResolveOptions: opts})
+			_ = handle.Close()
+			require.NoError(t, err, "ReopenWithOptions")
+			content, err := io.ReadAll(file)
+			_ = file.Close()
+			require.NoError(t, err)
+			assert.Equal(t, "hello", string(content), "reopened file content")
+		}
+	})
+}
+
+func TestOpenInRootWithOptions_RequireFileType(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/c",
+			"symlink dirlink a/b",
+			"symlink filelink a/b/c",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for name, test := range map[string]struct {
+			unsafePath  string
+			opts        ResolveOptions
+			expectedErr error
+		}{
+			"dir-root":             {"/", ResolveOptions{RequireDir: true}, nil},
+			"dir-dir":              {"a/b", ResolveOptions{RequireDir: true}, nil},
+			"dir-file":             {"a/b/c", ResolveOptions{RequireDir: true}, unix.ENOTDIR},
+			"dir-dirlink":          {"dirlink", ResolveOptions{RequireDir: true}, nil},
+			"dir-filelink":         {"filelink", ResolveOptions{RequireDir: true}, unix.ENOTDIR},
+			"dir-dirlink-nofollow": {"dirlink", ResolveOptions{RequireDir: true, NoFollowTrailing: true}, unix.ENOTDIR},
+			"dir-nonexist":         {"a/b/d", ResolveOptions{RequireDir: true}, unix.ENOENT},
+			"nondir-root":          {"/", ResolveOptions{RequireNonDir: true}, unix.EISDIR},
+			"nondir-dir":           {"a/b", ResolveOptions{RequireNonDir: true}, unix.EISDIR},
+			"nondir-file":          {"a/b/c", ResolveOptions{RequireNonDir: true}, nil},
+			"nondir-dirlink":       {"dirlink", ResolveOptions{RequireNonDir: true}, unix.EISDIR},
+			"nondir-filelink":      {"filelink", ResolveOptions{RequireNonDir: true}, nil},
+			"nondir-link-nofollow": {"dirlink", ResolveOptions{RequireNonDir: true, NoFollowTrailing: true}, nil},
+			"both":                 {"a/b", ResolveOptions{RequireDir: true, RequireNonDir: true}, unix.EINVAL},
+			// The emulated resolver is used with RejectDotDot even if openat2
+			// is supported, so make sure the file type is still checked.
+			"dir-file-rejectdotdot":     {"a/b/c", ResolveOptions{RequireDir: true, RejectDotDot: true}, unix.ENOTDIR},
+			"dir-filelink-rejectdotdot": {"filelink", ResolveOptions{RequireDir: true, RejectDotDot: true}, unix.ENOTDIR},
+			"dir-dir-rejectdotdot":      {"a/b", ResolveOptions{RequireDir: true, RejectDotDot: true}, nil},
+		} {
+			test := test // copy iterator
+			t.Run(name, func(t *testing.T) {
+				handle, err := OpenatInRootWithOptions(context.Background(), rootDir, test.unsafePath, &test.opts)
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+					assert.Nil(t, handle, "handle should be nil on error")
+					return
+				}
+				require.NoError(t, err)
+				_ = handle.Close()
+			})
+		}
+	})
+}
+
+func TestOpenInRootWithOptions_RejectDotDot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/c",
+			"symlink link a/b/c",
+			"symlink abslink /a/b",
+			"symlink dotdotlink a/b/../b/c",
+			"symlink a/uplink ../link",
+			"symlink a/indirect ../dotdotlink",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			unsafePath  string
+			expectedErr error
+		}{
+			// Paths without any ".." components.
+			{"a/b/c", nil},
+			{"./a/./b/c", nil},
+			{"link", nil},
+			{"abslink/c", nil},
+			{"a/b/..c", unix.ENOENT},
+			// ".." components in the path.
+			{"..", ErrForbiddenDotDot},
+			{"a/b/../b/c", ErrForbiddenDotDot},
+			{"a/b/c/..", ErrForbiddenDotDot},
+			{"/../a/b/c", ErrForbiddenDotDot},
+			// ".." components in symlink targets.
+			{"dotdotlink", ErrForbiddenDotDot},
+			{"a/uplink", ErrForbiddenDotDot},
+			{"a/indirect", ErrForbiddenDotDot},
+		} {
+			test := test // copy iterator
+			t.Run(test.unsafePath, func(t *testing.T) {
+				handle, err := OpenatInRootWithOptions(context.Background(), rootDir, test.unsafePath, &ResolveOptions{
+					RejectDotDot: true,
+				})
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+					assert.Nil(t, handle, "handle should be nil on error")
+					return
+				}
+				require.NoError(t, err)
+				_ = handle.Close()
+			})
+		}
+
+		_, err = OpenatInRootWithOptions(context.Background(), rootDir, "a/b/c", &ResolveOptions{
+			RejectDotDot:   true,
+			RequireOpenat2: true,
+		})
+		assert.ErrorIs(t, err, unix.EINVAL, "RejectDotDot with RequireOpenat2")
+	})
+}
+
+func TestOpenInRootWithOptions_PathLimits(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/c",
+			"symlink link a/b/c",
+			"symlink link2 link",
+			"symlink loop loop",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			name                       string
+			maxComponents, maxTotalLen int
+			unsafePath                 string
+			expectedErr                error
+		}{
+			{"NoLimits", 0, 0, "link2", nil},
+			// MaxComponents.
+			{"MaxComponents-Ok", 4, 0, "a/./b/c", nil},
+			{"MaxComponents-Path", 4, 0, "a/b/c/../c", ErrPathTooComplex},
+			{"MaxComponents-EmptyComponents", 3, 0, "//a///b//c", nil},
+			{"MaxComponents-Symlink", 4, 0, "link", nil},
+			{"MaxComponents-SymlinkChain", 4, 0, "link2", ErrPathTooComplex},
+			{"MaxComponents-Loop", 100, 0, "loop", ErrPathTooComplex},
+			// MaxTotalLen.
+			{"MaxTotalLen-Ok", 0, 10, "a/b/c", nil},
+			{"MaxTotalLen-Path", 0, 10, "a/b/c/./././", ErrPathTooComplex},
+			{"MaxTotalLen-Symlink", 0, 10, "link", nil},
+			{"MaxTotalLen-SymlinkChain", 0, 10, "link2", ErrPathTooComplex},
+			// Errors from the lookup itself are returned if the limits are
+			// not exceeded.
+			{"Loop", 0, 0, "loop", unix.ELOOP},
+			{"NonExistent", 4, 10, "a/b/d", unix.ENOENT},
+		} {
+			test := test // copy iterator
+			t.Run(test.name, func(t *testing.T) {
+				handle, err := OpenatInRootWithOptions(context.Background(), rootDir, test.unsafePath, &ResolveOptions{
+					MaxComponents: test.maxComponents,
+					MaxTotalLen:   test.maxTotalLen,
+				})
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+					assert.Nil(t, handle, "handle should be nil on error")
+					return
+				}
+				require.NoError(t, err)
+				_ = handle.Close()
+			})
+		}
+
+		_, err = OpenatInRootWithOptions(context.Background(), rootDir, "a/b/c", &ResolveOptions{
+			MaxComponents:  10,
+			RequireOpenat2: true,
+		})
+		assert.ErrorIs(t, err, unix.EINVAL, "MaxComponents with RequireOpenat2")
+	})
+}
+
+func TestOpenInRootWithOptions_PathLimits_ResolveError(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t, "dir a/b", "file a/b/c", "symlink link a/b/c", "symlink link2 link")
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		cancelledCtx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		for _, test := range []struct {
+			name              string
+			ctx               context.Context
+			opts              ResolveOptions
+			unsafePath        string
+			expectedErr       error
+			expectedComponent string
+		}{
+			// The path itself is checked before the walk starts, so the error
+			// is not attributed to any component.
+			{"Path", context.Background(), ResolveOptions{MaxComponents: 2}, "a/b/c", ErrPathTooComplex, ""},
+			// Symlink targets are checked while walking the symlink.
+			{"Symlink", context.Background(), ResolveOptions{MaxComponents: 4}, "link2", ErrPathTooComplex, "link"},
+			// Forbidden ".." components in the path are also rejected up-front.
+			{"DotDot", context.Background(), ResolveOptions{RejectDotDot: true}, "a/../a/b/c", ErrForbiddenDotDot, ""},
+			{"Cancelled", cancelledCtx, ResolveOptions{RejectDotDot: true}, "a/b/c", context.Canceled, ""},
+		} {
+			test := test // copy iterator
+			t.Run(test.name, func(t *testing.T) {
+				handle, err := OpenatInRootWithOptions(test.ctx, rootDir, test.unsafePath, &test.opts)
+				require.ErrorIs(t, err, test.expectedErr)
+				assert.Nil(t, handle, "handle should be nil on error")
+
+				var resolveErr *ResolveError
+				require.ErrorAs(t, err, &resolveErr)
+				assert.Equal(t, test.expectedComponent, resolveErr.Component, "ResolveError.Component")
+			})
+		}
+	})
+}
+
+func TestOpenInRootWithOptions_TryCached(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b/c",
+			"file a/b/c/file",
+			"symlink link a/b",
+			"symlink escape ../../../../a",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			unsafePath, expectedPath string
+			expectedErr              error
+		}{
+			{"a/b/c/file", "/a/b/c/file", nil},
+			{"link/c", "/a/b/c", nil},
+			{"escape/b/../b/c", "/a/b/c", nil},
+			{"a/b/nonexist", "", unix.ENOENT},
+			{"a/b/c/file/foo", "", unix.ENOTDIR},
+		} {
+			// Do the lookup twice, so that the second lookup is done with a
+			// warm dentry cache.
+			for i := 0; i < 2; i++ {
+				handle, err := OpenatInRootWithOptions(context.Background(), rootDir, test.unsafePath, &ResolveOptions{TryCached: true})
+				if test.expectedErr != nil {
+					assert.ErrorIsf(t, err, test.expectedErr, "OpenatInRootWithOptions(%q, TryCached)", test.unsafePath)
+					continue
+				}
+				if assert.NoErrorf(t, err, "OpenatInRootWithOptions(%q, TryCached)", test.unsafePath) {
+					assert.Equalf(t, root+test.expectedPath, handle.Name(), "OpenatInRootWithOptions(%q, TryCached)", test.unsafePath)
+					_ = handle.Close()
+				}
+			}
+		}
+	})
+}
+
+func TestOpenInRootWithOptions_SymlinkPolicy(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/file",
+			"symlink a/rel b",
+			"symlink abs /a/b",
+			"symlink a/b/chain ../rel",
+			"symlink a/b/abschain ../../abs",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		errAbsSymlink := errors.New("absolute symlinks are forbidden")
+
+		type policyCall struct{ linkPath, target string }
+		for _, test := range []struct {
+			unsafePath       string
+			noFollowTrailing bool
+			expectedCalls    []policyCall
+			expectedErr      error
+		}{
+			{unsafePath: "a/b/file"},
+			{unsafePath: "a/rel/file", expectedCalls: []policyCall{{"/a/rel", "b"}}},
+			{unsafePath: "a/b/chain/file", expectedCalls: []policyCall{{"/a/b/chain", "../rel"}, {"/a/rel", "b"}}},
+			{unsafePath: "abs/file", expectedCalls: []policyCall{{"/abs", "/a/b"}}, expectedErr: errAbsSymlink},
+			{unsafePath: "a/b/abschain", expectedCalls: []policyCall{{"/a/b/abschain", "../../abs"}, {"/abs", "/a/b"}}, expectedErr: errAbsSymlink},
+			// A trailing symlink that is not followed is not checked.
+			{unsafePath: "abs", noFollowTrailing: true},
+		} {
+			test := test // copy iterator
+			t.Run(test.unsafePath, func(t *testing.T) {
+				var calls []policyCall
+				handle, err := OpenatInRootWithOptions(context.Background(), rootDir, test.unsafePath, &ResolveOptions{
+					NoFollowTrailing: test.noFollowTrailing,
+					SymlinkPolicy: func(linkPath, target string) error {
+						calls = append(calls, policyCall{linkPath, target})
+						if path.IsAbs(target) {
+							return errAbsSymlink
+						}
+						return nil
+					},
+				})
+				assert.Equal(t, test.expectedCalls, calls, "SymlinkPolicy calls")
+				if test.expectedErr != nil {
+					assert.ErrorIs(t, err, test.expectedErr)
+					assert.Nil(t, handle, "handle should be nil on error")
+					return
+				}
+				require.NoError(t, err)
+				_ = handle.Close()
+			})
+		}
+
+		_, err = OpenatInRootWithOptions(context.Background(), rootDir, "a/b", &ResolveOptions{
+			SymlinkPolicy:  func(string, string) error { return nil },
+			RequireOpenat2: true,
+		})
+		assert.ErrorIs(t, err, unix.EINVAL, "SymlinkPolicy with RequireOpenat2")
+	})
+}
+
+func BenchmarkOpenInRoot_TryCached(b *testing.B) {
+	if !hasOpenat2() {
+		b.Skip("TryCached requires openat2")
+	}
+
+	root := createTree(b, "dir a/b/c/d/e/f/g/h/i/j", "file a/b/c/d/e/f/g/h/i/j/file")
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(b, err)
+	defer rootDir.Close()
+
+	for _, test := range []struct {
+		name string
+		opts *ResolveOptions
+	}{
+		{"uncached", nil},
+		{"cached", &ResolveOptions{TryCached: true}},
+	} {
+		test := test // copy iterator
+		b.Run(test.name, func(b *testing.B) {
+			// Warm up the dentry cache.
+			handle, err := OpenatInRootWithOptions(context.Background(), rootDir, "a/b/c/d/e/f/g/h/i/j/file", test.opts)
+			require.NoError(b, err)
+			_ = handle.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				handle, err := OpenatInRootWithOptions(context.Background(), rootDir, "a/b/c/d/e/f/g/h/i/j/file", test.opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = handle.Close()
+			}
+		})
+	}
+}
+
+func TestOpenInRootWithOptions_ProcRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t, "dir a/b", "file a/b/file")
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		procRoot, err := os.OpenFile("/proc", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer procRoot.Close()
+
+		opts := &ResolveOptions{ProcRoot: procRoot}
+		handle, err := OpenatInRootWithOptions(context.Background(), rootDir, "a/../a/b/file", opts)
+		require.NoError(t, err, "lookup with ProcRoot")
+		defer handle.Close()
+		assert.Equal(t, filepath.Join(root, "a/b/file"), handle.Name(), "handle name")
+
+		reopened, err := ReopenWithOptions(handle, unix.O_RDONLY|unix.O_CLOEXEC, &ReopenOptions{ResolveOptions: opts})
+		require.NoError(t, err, "reopen with ProcRoot")
+		_ = reopened.Close()
+
+		// A ProcRoot which is not the root of a procfs mount must be
+		// rejected rather than used.
+		notProc, err := os.OpenFile(t.TempDir(), unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer notProc.Close()
+
+		badOpts := &ResolveOptions{ProcRoot: notProc}
+		_, err = ReopenWithOptions(handle, unix.O_RDONLY|unix.O_CLOEXEC, &ReopenOptions{ResolveOptions: badOpts})
+		assert.ErrorIs(t, err, errUnsafeProcfs, "reopen with non-procfs ProcRoot")
+		if !hasOpenat2() {
+			// The emulated resolver always needs to use procfs.
+			_, err = OpenatInRootWithOptions(context.Background(), rootDir, "a/b/file", badOpts)
+			assert.ErrorIs(t, err, errUnsafeProcfs, "lookup with non-procfs ProcRoot")
+		}
+	})
+}
+
+func TestOpenInRootWithOptions_VerifyRootMount(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t, "dir a/b", "file a/b/file")
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		handle, err := OpenatInRootWithOptions(context.Background(), rootDir, "a/b/file", &ResolveOptions{VerifyRootMount: true})
+		require.NoError(t, err, "lookup with unchanged root mount")
+		_ = handle.Close()
+
+		// The name of the root handle need not be a real path.
+		rootFd, err := unix.Dup(int(rootDir.Fd()))
+		require.NoError(t, err)
+		namedRoot := os.NewFile(uintptr(rootFd), "fd:"+strconv.Itoa(rootFd))
+		defer namedRoot.Close()
+
+		handle, err = OpenatInRootWithOptions(context.Background(), namedRoot, "a/b/file", &ResolveOptions{VerifyRootMount: true})
+		require.NoError(t, err, "lookup with non-path root name")
+		_ = handle.Close()
+	})
+}
+
+func TestOpenInRootWithOptions_VerifyRootMount_Swapped(t *testing.T) {
+	if !hasStatxMountId() {
+		t.Skip("statx(STATX_MNT_ID) not supported")
+	}
+	setupMountNamespace(t)
+
+	root := t.TempDir()
+	err := unix.Mount("tmpfs", root, "tmpfs", 0, "")
+	require.NoError(t, err, "mount tmpfs root")
+	defer func() { _ = unix.Unmount(root, unix.MNT_DETACH) }()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "file"), nil, 0o644))
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	// Replace the root with a different mount. The old mount is still
+	// reachable through rootDir.
+	err = unix.Mount("tmpfs", root, "tmpfs", 0, "")
+	require.NoError(t, err, "mount tmpfs on top of root")
+	defer func() { _ = unix.Unmount(root, unix.MNT_DETACH) }()
+
+	handle, err := OpenatInRootWithOptions(context.Background(), rootDir, "file", nil)
+	require.NoError(t, err, "lookup without VerifyRootMount")
+	_ = handle.Close()
+
+	handle, err = OpenatInRootWithOptions(context.Background(), rootDir, "file", &ResolveOptions{VerifyRootMount: true})
+	assert.True(t, errors.Is(err, ErrPossibleBreakout), "lookup with swapped root mount should fail with ErrPossibleBreakout: %v", err)
+	assert.Nil(t, handle, "handle should be nil on error")
+}
+
+func BenchmarkOpenInRoot_SkipOvermountCheck(b *testing.B) {
+	origHasOpenat2 := hasOpenat2
+	hasOpenat2 = func() bool { return false }
+	defer func() { hasOpenat2 = origHasOpenat2 }()
+
+	root := createTree(b, "dir a/b/c/d/e/f/g/h/i/j", "file a/b/c/d/e/f/g/h/i/j/file")
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(b, err)
+	defer rootDir.Close()
+
+	for _, test := range []struct {
+		name string
+		opts *ResolveOptions
+	}{
+		// Each component of the walk requires a check of the
+		// /proc/thread-self/fd/$n magic-link, including a statx(2) call
+		// for the overmount check.
+		{"check", nil},
+		{"skip", &ResolveOptions{SkipOvermountCheck: true}},
+	} {
+		test := test // copy iterator
+		b.Run(test.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				// The "." component forces the full component-by-component walk.
+				handle, err := OpenatInRootWithOptions(context.Background(), rootDir, "a/b/c/d/e/f/g/h/i/j/./file", test.opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = handle.Close()
+			}
+		})
+	}
+}
+
+func TestOpenInRootWithOptions_InfoFallback(t *testing.T) {
+	withWithoutOpenat2(t, false, func(t *testing.T) {
+		root := createTree(t, "dir a/b", "file a/b/file")
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			name     string
+			opts     ResolveOptions
+			expected FallbackReason
+		}{
+			{"Default", ResolveOptions{}, ReasonNone},
+			{"RejectDotDot", ResolveOptions{RejectDotDot: true}, ReasonFlagUnsupported},
+			{"StayOnRootFilesystem", ResolveOptions{StayOnRootFilesystem: true}, ReasonFlagUnsupported},
+		} {
+			test := test // copy iterator
+			t.Run(test.name, func(t *testing.T) {
+				expected := test.expected
+				if !hasOpenat2() {
+					expected = ReasonForcedEmulated
+				}
+
+				// Make sure Info is reset by the lookup.
+				info := ResolveInfo{Fallback: FallbackReason(-1)}
+				opts := test.opts
+				opts.Info = &info
+
+				handle, err := OpenatInRootWithOptions(context.Background(), rootDir, "a/b/file", &opts)
+				require.NoError(t, err)
+				_ = handle.Close()
+				assert.Equal(t, expected, info.Fallback, "fallback reason (%s)", info.Fallback)
+			})
+		}
+	})
+}
+
+func TestOpenInRootWithOptions_InfoFallback_NoOpenat2(t *testing.T) {
+	origHasOpenat2, origProbeOpenat2 := hasOpenat2, probeOpenat2
+	hasOpenat2 = func() bool { return false }
+	probeOpenat2 = func() error { return unix.ENOSYS }
+	defer func() { hasOpenat2, probeOpenat2 = origHasOpenat2, origProbeOpenat2 }()
+
+	root := createTree(t, "file file")
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	var info ResolveInfo
+	handle, err := OpenatInRootWithOptions(context.Background(), rootDir, "file", &ResolveOptions{Info: &info})
+	require.NoError(t, err)
+	_ = handle.Close()
+	assert.Equal(t, ReasonNoOpenat2, info.Fallback, "fallback reason (%s)", info.Fallback)
+}
+
+func TestOpenInRootWithOptions_StayOnRootFilesystem(t *testing.T) {
+	setupMountNamespace(t)
+
+	root := createTree(t,
+		"dir a", "file a/file",
+		"dir sub", "dir bind",
+		"symlink link-sub sub/file",
+		"symlink link-bind bind/file",
+	)
+	subDir := filepath.Join(root, "sub")
+	require.NoError(t, unix.Mount("tmpfs", subDir, "tmpfs", 0, ""), "mount tmpfs on sub")
+	defer func() { _ = unix.Unmount(subDir, unix.MNT_DETACH) }()
+	require.NoError(t, os.WriteFile(filepath.Join(subDir, "file"), nil, 0o644))
+	// A bind-mount of the same filesystem is still on the same device.
+	bindDir := filepath.Join(root, "bind")
+	require.NoError(t, unix.Mount(filepath.Join(root, "a"), bindDir, "", unix.MS_BIND, ""), "bind-mount a on bind")
+	defer func() { _ = unix.Unmount(bindDir, unix.MNT_DETACH) }()
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	withWithoutOpenat2(t, false, func(t *testing.T) {
+		for _, test := range []struct {
+			unsafePath string
+			expectErr  error
+		}{
+			{"a/file", nil},
+			{"bind/file", nil},
+			{"link-bind", nil},
+			{"sub", unix.EXDEV},
+			{"sub/file", unix.EXDEV},
+			{"a/../sub/file", unix.EXDEV},
+			{"link-sub", unix.EXDEV},
+		} {
+			test := test // copy iterator
+			t.Run(test.unsafePath, func(t *testing.T) {
+				// Without StayOnRootFilesystem, all of the paths can be resolved.
+				handle, err := OpenatInRootWithOptions(context.Background(), rootDir, test.unsafePath, nil)
+				require.NoError(t, err, "lookup without StayOnRootFilesystem")
+				_ = handle.Close()
+
+				handle, err = OpenatInRootWithOptions(context.Background(), rootDir, test.unsafePath, &ResolveOptions{StayOnRootFilesystem: true})
+				if test.expectErr != nil {
+					require.ErrorIs(t, err, test.expectErr, "lookup with StayOnRootFilesystem")
+					assert.Nil(t, handle)
+				} else {
+					require.NoError(t, err, "lookup with StayOnRootFilesystem")
+					_ = handle.Close()
+				}
+			})
+		}
+	})
+
+	t.Run("RequireOpenat2", func(t *testing.T) {
+		_, err := OpenatInRootWithOptions(context.Background(), rootDir, "a/file", &ResolveOptions{StayOnRootFilesystem: true, RequireOpenat2: true})
+		require.ErrorIs(t, err, unix.EINVAL)
+	})
+}
@@ -0,0 +1,52 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"sync/atomic"
+)
+
+// These counters must only be accessed using sync/atomic.
+//
+// TODO: Switch to atomic.Uint64 once we switch to Go 1.19.
+var (
+	statOpenat2Fallbacks   uint64
+	statOpenat2Retries     uint64
+	statEmulatedLookups    uint64
+	statOvermountsDetected uint64
+)
+
+// StatsSnapshot is a point-in-time copy of the counters maintained by this
+// package, as returned by [Stats].
+type StatsSnapshot struct {
+	// Openat2Fallbacks is the number of lookups which used the emulated
+	// (userspace) resolver because openat2(2) is not supported.
+	Openat2Fallbacks uint64
+	// Openat2Retries is the number of times an openat2(2) lookup failed with
+	// -EAGAIN or -EXDEV and had to be retried. A high number of retries can
+	// indicate that an attacker is racing against lookups.
+	Openat2Retries uint64
+	// EmulatedLookups is the number of lookups which used the emulated
+	// (userspace) resolver, for any reason.
+	EmulatedLookups uint64
+	// OvermountsDetected is the number of times an overmount on top of a
+	// procfs magic-link was detected.
+	OvermountsDetected uint64
+}
+
+// Stats returns a snapshot of the package-wide counters, which can be used
+// to export metrics about how lookups are being done. The counters are only
+// ever incremented, so callers should compute the difference between
+// successive snapshots if they want rates.
+func Stats() StatsSnapshot {
+	return StatsSnapshot{
+		Openat2Fallbacks:   atomic.LoadUint64(&statOpenat2Fallbacks),
+		Openat2Retries:     atomic.LoadUint64(&statOpenat2Retries),
+		EmulatedLookups:    atomic.LoadUint64(&statEmulatedLookups),
+		OvermountsDetected: atomic.LoadUint64(&statOvermountsDetected),
+	}
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats_EmulatedLookups(t *testing.T) {
+	withWithoutOpenat2(t, false, func(t *testing.T) {
+		root := createTree(t, "dir a/b", "file a/b/c")
+
+		before := Stats()
+		handle, err := OpenInRoot(root, "a/b/c")
+		require.NoError(t, err)
+		_ = handle.Close()
+		after := Stats()
+
+		if hasOpenat2() {
+			assert.Equal(t, before.EmulatedLookups, after.EmulatedLookups, "openat2 lookups should not count as emulated")
+		} else {
+			assert.Equal(t, before.EmulatedLookups+1, after.EmulatedLookups, "emulated lookups should be counted")
+			assert.Equal(t, before.Openat2Fallbacks+1, after.Openat2Fallbacks, "openat2 fallbacks should be counted")
+		}
+	})
+}
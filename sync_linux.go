@@ -0,0 +1,93 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// syncInRoot opens unsafePath inside root with flags and syncs it to disk with
+// syncFn (either unix.Fsync or unix.Fdatasync), using syncOp as the name of
+// syncFn in errors.
+func syncInRoot(root *os.File, unsafePath string, flags int, syncOp string, syncFn func(int) error) error {
+	handle, err := OpenatInRoot(root, unsafePath)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	// Only regular files and directories can be synced. Re-opening other
+	// inodes could block (for FIFOs) or have other side-effects (for
+	// devices), so reject them before re-opening.
+	st, err := fstat(handle)
+	if err != nil {
+		return err
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFREG, unix.S_IFDIR:
+		// ok
+	default:
+		if flags&unix.O_DIRECTORY != 0 {
+			return unix.ENOTDIR
+		}
+		return unix.EINVAL
+	}
+
+	// fsync(2) does not work on O_PATH handles, so we need to re-open the
+	// handle.
+	file, err := Reopen(handle, flags)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := syncFn(int(file.Fd())); err != nil {
+		return &os.PathError{Op: syncOp, Path: file.Name(), Err: err}
+	}
+	return nil
+}
+
+// FsyncInRoot flushes the contents and metadata of the file at unsafePath
+// (resolved inside root) to disk, in the same way as fsync(2). This allows
+// callers to guarantee the durability of files after a batch of writes
+// without needing to keep a handle to every file open. As with
+// [OpenatInRoot], a trailing symlink in unsafePath is followed (inside root).
+//
+// The file is opened with O_RDONLY, so the caller must have read access to
+// the file. Only regular files and directories can be synced, for any other
+// kind of inode (such as a FIFO or device) an error wrapping EINVAL is
+// returned without opening it.
+func FsyncInRoot(root *os.File, unsafePath string) error {
+	if err := syncInRoot(root, unsafePath, unix.O_RDONLY, "fsync", unix.Fsync); err != nil {
+		return &os.PathError{Op: "securejoin.FsyncInRoot", Path: unsafePath, Err: err}
+	}
+	return nil
+}
+
+// FdatasyncInRoot is equivalent to [FsyncInRoot] except that fdatasync(2) is
+// used, and so metadata that is not needed to read the file contents (such
+// as the modification time) may not be flushed.
+func FdatasyncInRoot(root *os.File, unsafePath string) error {
+	if err := syncInRoot(root, unsafePath, unix.O_RDONLY, "fdatasync", unix.Fdatasync); err != nil {
+		return &os.PathError{Op: "securejoin.FdatasyncInRoot", Path: unsafePath, Err: err}
+	}
+	return nil
+}
+
+// FsyncDirInRoot flushes the directory at unsafePath (resolved inside root)
+// to disk, in the same way as calling fsync(2) on the directory. This is
+// necessary to guarantee the durability of directory entries (such as newly
+// created, renamed or removed files) in the directory. If unsafePath is not a
+// directory, an error wrapping ENOTDIR is returned.
+func FsyncDirInRoot(root *os.File, unsafePath string) error {
+	if err := syncInRoot(root, unsafePath, unix.O_DIRECTORY|unix.O_RDONLY, "fsync", unix.Fsync); err != nil {
+		return &os.PathError{Op: "securejoin.FsyncDirInRoot", Path: unsafePath, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestFsyncInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b",
+			"file a/b/file data",
+			"symlink link a/b/file",
+			"symlink dirlink a/b",
+			"symlink escape ../../../../a",
+			"fifo a/b/fifo",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for name, syncFn := range map[string]func(*os.File, string) error{
+			"FsyncInRoot":     FsyncInRoot,
+			"FdatasyncInRoot": FdatasyncInRoot,
+		} {
+			for _, test := range []struct {
+				unsafePath  string
+				expectedErr error
+			}{
+				{"a/b/file", nil},
+				{"link", nil},
+				{"a/b", nil},
+				{"escape/b/file", nil},
+				{"a/b/nonexist", unix.ENOENT},
+				// Re-opening a FIFO would block forever.
+				{"a/b/fifo", unix.EINVAL},
+			} {
+				err := syncFn(rootDir, test.unsafePath)
+				if test.expectedErr != nil {
+					assert.ErrorIsf(t, err, test.expectedErr, "%s(%q)", name, test.unsafePath)
+				} else {
+					assert.NoErrorf(t, err, "%s(%q)", name, test.unsafePath)
+				}
+			}
+		}
+
+		for _, test := range []struct {
+			unsafePath  string
+			expectedErr error
+		}{
+			{".", nil},
+			{"a/b", nil},
+			{"dirlink", nil},
+			{"escape", nil},
+			{"a/b/file", unix.ENOTDIR},
+			{"link", unix.ENOTDIR},
+			{"a/b/fifo", unix.ENOTDIR},
+			{"nonexist", unix.ENOENT},
+		} {
+			err := FsyncDirInRoot(rootDir, test.unsafePath)
+			if test.expectedErr != nil {
+				assert.ErrorIsf(t, err, test.expectedErr, "FsyncDirInRoot(%q)", test.unsafePath)
+				var pathErr *os.PathError
+				if assert.ErrorAs(t, err, &pathErr) {
+					assert.Equal(t, "securejoin.FsyncDirInRoot", pathErr.Op, "*os.PathError op")
+				}
+			} else {
+				assert.NoErrorf(t, err, "FsyncDirInRoot(%q)", test.unsafePath)
+			}
+		}
+	})
+}
@@ -26,6 +26,38 @@ func requireRoot(t *testing.T) {
 	}
 }
 
+// withoutDACOverride runs fn on a thread without CAP_DAC_OVERRIDE and
+// CAP_DAC_READ_SEARCH, so that permission checks apply even when running as
+// root. fn must not call t.FailNow (or require.*), as it is not run on the
+// test goroutine.
+func withoutDACOverride(t *testing.T, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// Capabilities are per-thread. The thread is never unlocked, so the
+		// runtime will kill it once this goroutine exits rather than re-using
+		// a thread with reduced capabilities.
+		runtime.LockOSThread()
+
+		hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+		var data [2]unix.CapUserData
+		if err := unix.Capget(&hdr, &data[0]); err != nil {
+			t.Errorf("capget: %v", err)
+			return
+		}
+		for _, capability := range []uint{unix.CAP_DAC_OVERRIDE, unix.CAP_DAC_READ_SEARCH} {
+			data[capability/32].Effective &^= 1 << (capability % 32)
+		}
+		if err := unix.Capset(&hdr, &data[0]); err != nil {
+			t.Errorf("capset: %v", err)
+			return
+		}
+		fn()
+	}()
+	<-done
+}
+
 func withWithoutOpenat2(t *testing.T, doAuto bool, testFn func(t *testing.T)) {
 	if doAuto {
 		t.Run("openat2=auto", testFn)
@@ -128,7 +160,7 @@ func doRenameExchangeLoop(pauseCh chan struct{}, exitCh <-chan struct{}, dir *os
 //	block <name> <major> <minor> <?uid:gid:mode>
 //	fifo <name> <?uid:gid:mode>
 //	sock <name> <?uid:gid:mode>
-func createInTree(t *testing.T, root, spec string) {
+func createInTree(t testing.TB, root, spec string) {
 	f := strings.Fields(spec)
 	if len(f) < 2 {
 		t.Fatalf("invalid spec %q", spec)
@@ -222,7 +254,7 @@ func createInTree(t *testing.T, root, spec string) {
 	}
 }
 
-func createTree(t *testing.T, specs ...string) string {
+func createTree(t testing.TB, specs ...string) string {
 	root := t.TempDir()
 
 	// Put the root in a subdir.
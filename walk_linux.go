@@ -0,0 +1,180 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// walkInRootFunc is called by walkInRoot for each inode in the tree. handle is
+// an O_PATH handle to the inode (symlinks are never followed, so handle may be
+// a handle to a symlink) which is closed after the callback returns, and
+// subPath is the path of the inode relative to the top of the walk ("." for
+// the top-level inode itself). As with [fs.WalkDirFunc], returning
+// [fs.SkipDir] for a directory causes its contents to be skipped, and
+// returning it for a non-directory causes the remaining entries in the parent
+// directory to be skipped.
+type walkInRootFunc func(handle *os.File, subPath string, info os.FileInfo) error
+
+// walkReadDirErrFunc is called by walkHandle if the contents of the directory
+// at subPath could not be read. If it returns nil, the walk continues with the
+// next entry of the parent directory. If it is nil, the error is returned.
+type walkReadDirErrFunc func(subPath string, info os.FileInfo, err error) error
+
+// inodeKey uniquely identifies an inode on the system.
+type inodeKey struct {
+	dev, ino uint64
+}
+
+// getStat returns the underlying stat(2) information from info (which must
+// have been returned by a stat of an *os.File or path).
+func getStat(info os.FileInfo) (*syscall.Stat_t, error) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, fmt.Errorf("stat %q: unexpected stat type %T", info.Name(), info.Sys())
+	}
+	return st, nil
+}
+
+// getInodeKey returns the inodeKey for the inode described by info (which must
+// have been returned by a stat of an *os.File or path).
+func getInodeKey(info os.FileInfo) (inodeKey, error) {
+	st, err := getStat(info)
+	if err != nil {
+		return inodeKey{}, err
+	}
+	return inodeKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}, nil
+}
+
+// openNoFollowInRoot is like [OpenatInRoot] except that the final component of
+// unsafePath is not followed if it is a symlink.
+func openNoFollowInRoot(root *os.File, unsafePath string) (*os.File, error) {
+	parent, finalComponent, err := openParentInRoot(root, unsafePath)
+	if err != nil {
+		return nil, err
+	}
+	defer parent.Close()
+
+	switch finalComponent {
+	case "", ".", "..":
+		// These cannot be symlinks, so just do a regular lookup.
+		return OpenatInRoot(root, unsafePath)
+	}
+	return openatFile(parent, finalComponent, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+}
+
+// walkInRoot does a depth-first walk of the tree at unsafePath inside root
+// (directories are visited before their contents, and the entries of each
+// directory are visited in lexical order). The walk is done entirely using
+// file handles and symlinks are never followed (including a trailing symlink
+// in unsafePath), so the walk cannot leave the tree.
+func walkInRoot(root *os.File, unsafePath string, fn walkInRootFunc) error {
+	handle, err := openNoFollowInRoot(root, unsafePath)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	if err := walkHandle(handle, ".", fn, nil); err != nil && !errors.Is(err, fs.SkipDir) {
+		return err
+	}
+	return nil
+}
+
+func walkHandle(handle *os.File, subPath string, fn walkInRootFunc, readDirErrFn walkReadDirErrFunc) error {
+	info, err := handle.Stat()
+	if err != nil {
+		return err
+	}
+	if err := fn(handle, subPath, info); err != nil {
+		if info.IsDir() && errors.Is(err, fs.SkipDir) {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+
+	names, err := readDirNames(handle)
+	if err != nil {
+		if readDirErrFn == nil {
+			return err
+		}
+		if err := readDirErrFn(subPath, info, err); err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				return nil
+			}
+			return err
+		}
+		return nil
+	}
+
+	for _, name := range names {
+		child, err := openatFile(handle, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			// The entry was removed while we were walking.
+			if errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return err
+		}
+		err = walkHandle(child, path.Join(subPath, name), fn, readDirErrFn)
+		_ = child.Close()
+		if err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				// Skip the rest of this directory.
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkDirInRoot is a safe equivalent of [filepath.WalkDir] for the tree at
+// unsafePath inside root. The walk is done entirely using file handles, and
+// symlinks are never followed (including a trailing symlink in unsafePath),
+// so the walk cannot leave the tree even if it is being modified
+// concurrently. As with [filepath.WalkDir], directories are visited before
+// their contents and the entries of each directory are visited in lexical
+// order.
+//
+// fn is called with the path of each inode (unsafePath joined with the path
+// of the inode relative to the top of the walk) and an [fs.DirEntry] whose
+// Info method returns the result of an fstat(2) of the inode itself, so no
+// further (unsafe) path-based stat is needed. [fs.SkipDir] and [fs.SkipAll]
+// are handled in the same way as [filepath.WalkDir]. If unsafePath cannot be
+// opened, fn is called once with a nil entry and the error. If a directory
+// cannot be read, fn is called a second time for that directory with the
+// error (as with [filepath.WalkDir]), and the walk continues if fn returns
+// nil. Any other error encountered during the walk causes the walk to stop
+// and is returned.
+func WalkDirInRoot(root *os.File, unsafePath string, fn fs.WalkDirFunc) error {
+	handle, err := openNoFollowInRoot(root, unsafePath)
+	if err != nil {
+		err = fn(unsafePath, nil, err)
+	} else {
+		defer handle.Close()
+		err = walkHandle(handle, ".", func(_ *os.File, subPath string, info os.FileInfo) error {
+			return fn(path.Join(unsafePath, subPath), fs.FileInfoToDirEntry(info), nil)
+		}, func(subPath string, info os.FileInfo, err error) error {
+			return fn(path.Join(unsafePath, subPath), fs.FileInfoToDirEntry(info), err)
+		})
+	}
+	if errors.Is(err, fs.SkipDir) || errors.Is(err, errSkipAll) {
+		return nil
+	}
+	return err
+}
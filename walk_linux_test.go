@@ -0,0 +1,218 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+type walkDirEntry struct {
+	path string
+	mode fs.FileMode
+	size int64
+}
+
+func walkDirCollect(t *testing.T, walkFn func(fs.WalkDirFunc) error, prefix string, skip func(path string, d fs.DirEntry) error) []walkDirEntry {
+	var entries []walkDirEntry
+	err := walkFn(func(path string, d fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		info, err := d.Info()
+		require.NoError(t, err)
+		assert.Equal(t, d.Type(), info.Mode().Type(), "DirEntry.Type should match Info")
+		assert.Equal(t, d.IsDir(), info.IsDir(), "DirEntry.IsDir should match Info")
+		var size int64
+		if info.Mode().IsRegular() {
+			size = info.Size()
+		}
+		entries = append(entries, walkDirEntry{
+			path: "/" + strings.TrimLeft(strings.TrimPrefix(path, prefix), "/"),
+			mode: info.Mode(),
+			size: size,
+		})
+		if skip != nil {
+			return skip(path, d)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return entries
+}
+
+func TestWalkDirInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		tree := []string{
+			"dir a/b/c",
+			"file a/b/c/file data",
+			"file a/file1 abc",
+			"file a/file2",
+			"dir a/d ::0700",
+			"symlink a/link ../../../../etc",
+			"fifo a/fifo",
+			"dir z",
+			"file z/file",
+		}
+		root := createTree(t, tree...)
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		for _, test := range []struct {
+			name string
+			skip func(path string, d fs.DirEntry) error
+		}{
+			{"full", nil},
+			{"SkipDir-dir", func(path string, _ fs.DirEntry) error {
+				if filepath.Base(path) == "b" {
+					return fs.SkipDir
+				}
+				return nil
+			}},
+			{"SkipDir-file", func(path string, _ fs.DirEntry) error {
+				if filepath.Base(path) == "file1" {
+					return fs.SkipDir
+				}
+				return nil
+			}},
+		} {
+			test := test // copy iterator
+			t.Run(test.name, func(t *testing.T) {
+				// Without any concurrent modifications, we should get the
+				// same result as filepath.WalkDir.
+				expected := walkDirCollect(t, func(fn fs.WalkDirFunc) error {
+					return filepath.WalkDir(root, fn)
+				}, root, test.skip)
+				got := walkDirCollect(t, func(fn fs.WalkDirFunc) error {
+					return WalkDirInRoot(rootDir, "/", fn)
+				}, "/", test.skip)
+				assert.Equal(t, expected, got, "WalkDirInRoot should match filepath.WalkDir")
+			})
+		}
+
+		// Subtrees (reached through symlinks inside the root).
+		var paths []string
+		err = WalkDirInRoot(rootDir, "a/b", func(path string, _ fs.DirEntry, err error) error {
+			require.NoError(t, err)
+			paths = append(paths, path)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a/b", "a/b/c", "a/b/c/file"}, paths, "WalkDirInRoot of subtree")
+
+		// A trailing symlink is not followed.
+		paths = nil
+		err = WalkDirInRoot(rootDir, "a/link", func(path string, d fs.DirEntry, err error) error {
+			require.NoError(t, err)
+			assert.Equal(t, fs.ModeSymlink, d.Type(), "trailing symlink should not be followed")
+			paths = append(paths, path)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a/link"}, paths, "WalkDirInRoot of symlink")
+	})
+}
+
+func TestWalkDirInRoot_SkipAll(t *testing.T) {
+	root := createTree(t, "dir a/b", "file a/b/file", "dir c", "file c/file")
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	var paths []string
+	err = WalkDirInRoot(rootDir, ".", func(path string, _ fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		paths = append(paths, path)
+		if path == "a/b/file" {
+			return errSkipAll
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{".", "a", "a/b", "a/b/file"}, paths, "walk should stop after SkipAll")
+}
+
+func TestWalkDirInRoot_ReadDirError(t *testing.T) {
+	root := createTree(t, "dir a/b", "file a/b/file", "dir a/unreadable", "file a/z")
+	require.NoError(t, os.Chmod(filepath.Join(root, "a/unreadable"), 0o300))
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	type walkCall struct {
+		path string
+		err  bool
+	}
+
+	withoutDACOverride(t, func() {
+		// As with filepath.WalkDir, fn is called a second time for the
+		// unreadable directory and the walk continues if fn returns nil.
+		var calls []walkCall
+		err := WalkDirInRoot(rootDir, ".", func(path string, d fs.DirEntry, err error) error {
+			calls = append(calls, walkCall{path, err != nil})
+			if err != nil {
+				assert.ErrorIs(t, err, unix.EACCES, "read of unreadable directory")
+				if assert.NotNil(t, d, "entry should be set for unreadable directory") {
+					assert.True(t, d.IsDir(), "entry should be a directory")
+				}
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []walkCall{
+			{".", false},
+			{"a", false},
+			{"a/b", false},
+			{"a/b/file", false},
+			{"a/unreadable", false},
+			{"a/unreadable", true},
+			{"a/z", false},
+		}, calls, "WalkDirInRoot calls")
+
+		// Returning the error stops the walk.
+		var paths []string
+		err = WalkDirInRoot(rootDir, ".", func(path string, _ fs.DirEntry, err error) error {
+			paths = append(paths, path)
+			return err
+		})
+		assert.ErrorIs(t, err, unix.EACCES, "error returned by fn")
+		assert.Equal(t, []string{".", "a", "a/b", "a/b/file", "a/unreadable", "a/unreadable"}, paths, "walk should stop after error")
+	})
+}
+
+func TestWalkDirInRoot_Error(t *testing.T) {
+	root := createTree(t, "dir a")
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	var called int
+	err = WalkDirInRoot(rootDir, "nonexist", func(path string, d fs.DirEntry, err error) error {
+		called++
+		assert.Equal(t, "nonexist", path)
+		assert.Nil(t, d, "entry should be nil on error")
+		assert.ErrorIs(t, err, unix.ENOENT)
+		return err
+	})
+	assert.ErrorIs(t, err, unix.ENOENT, "error returned by fn")
+	assert.Equal(t, 1, called, "fn should be called once")
+
+	err = WalkDirInRoot(rootDir, "nonexist", func(string, fs.DirEntry, error) error {
+		return fs.SkipDir
+	})
+	assert.NoError(t, err, "SkipDir from error callback")
+}
@@ -0,0 +1,46 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// StripXattrsInRoot removes the extended attribute name (such as
+// "security.capability") from every regular file and directory in the tree at
+// unsafePath inside root (including unsafePath itself). Inodes which do not
+// have the extended attribute are ignored.
+//
+// The tree is walked using file handles and symlinks are never followed
+// (including a trailing symlink in unsafePath). The attribute is removed
+// using fremovexattr(2) on a handle to each inode, so the operation cannot be
+// redirected outside of the tree. As with [CopyOptions.PreserveXattrs], only
+// regular files and directories are modified, because getting a usable handle
+// to other inode types would require opening them (which can have side
+// effects for devices and fifos).
+func StripXattrsInRoot(root *os.File, unsafePath, name string) error {
+	err := walkInRoot(root, unsafePath, func(handle *os.File, _ string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		// We need a proper handle to use fremovexattr(2).
+		return withReadableHandle(handle, func(f *os.File) error {
+			err := unix.Fremovexattr(int(f.Fd()), name)
+			if err != nil && !errors.Is(err, unix.ENODATA) {
+				return &os.PathError{Op: "fremovexattr " + name, Path: f.Name(), Err: err}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return &os.PathError{Op: "securejoin.StripXattrsInRoot", Path: unsafePath, Err: err}
+	}
+	return nil
+}
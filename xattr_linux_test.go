@@ -0,0 +1,125 @@
+//go:build linux
+
+// Copyright (C) 2025 SUSE LLC. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package securejoin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// getxattr returns the value of the extended attribute name of the inode at
+// path (without following symlinks).
+func getxattr(path, name string) ([]byte, error) {
+	buf := make([]byte, 256)
+	n, err := unix.Lgetxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func TestStripXattrsInRoot(t *testing.T) {
+	withWithoutOpenat2(t, true, func(t *testing.T) {
+		root := createTree(t,
+			"dir a/b",
+			"file a/b/file data",
+			"file a/noxattr data",
+			"fifo a/fifo",
+			"symlink a/link ../outside",
+			"file outside data",
+		)
+		for _, subPath := range []string{"a", "a/b", "a/b/file", "outside"} {
+			err := unix.Setxattr(filepath.Join(root, subPath), "user.strip", []byte("strip"), 0)
+			if errors.Is(err, unix.ENOTSUP) {
+				t.Skip("user xattrs not supported on test filesystem")
+			}
+			require.NoError(t, err)
+			require.NoError(t, unix.Setxattr(filepath.Join(root, subPath), "user.keep", []byte("keep"), 0))
+		}
+
+		rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		require.NoError(t, err)
+		defer rootDir.Close()
+
+		err = StripXattrsInRoot(rootDir, "a", "user.strip")
+		require.NoError(t, err, "StripXattrsInRoot")
+
+		for _, subPath := range []string{"a", "a/b", "a/b/file"} {
+			_, err := getxattr(filepath.Join(root, subPath), "user.strip")
+			assert.ErrorIsf(t, err, unix.ENODATA, "user.strip xattr of %q should be removed", subPath)
+			value, err := getxattr(filepath.Join(root, subPath), "user.keep")
+			if assert.NoErrorf(t, err, "get user.keep xattr of %q", subPath) {
+				assert.Equalf(t, "keep", string(value), "user.keep xattr of %q", subPath)
+			}
+		}
+
+		// Symlinks must not be followed.
+		value, err := getxattr(filepath.Join(root, "outside"), "user.strip")
+		if assert.NoError(t, err, "symlink target outside the tree should not be modified") {
+			assert.Equal(t, "strip", string(value), "user.strip xattr of symlink target")
+		}
+
+		err = StripXattrsInRoot(rootDir, "nonexist", "user.strip")
+		assert.ErrorIs(t, err, unix.ENOENT, "StripXattrsInRoot of non-existent path")
+	})
+}
+
+func TestCopyTreeInRoot_PreserveCapabilities(t *testing.T) {
+	requireRoot(t) // security.capability requires CAP_SETFCAP
+
+	root := createTree(t,
+		"dir src",
+		"file src/bin data ::755",
+	)
+	// A VFS_CAP_REVISION_2 capability set with CAP_NET_BIND_SERVICE in the
+	// permitted and effective sets.
+	capData := []byte{
+		0x01, 0x00, 0x00, 0x02, // magic_etc (VFS_CAP_REVISION_2 | VFS_CAP_FLAGS_EFFECTIVE)
+		0x00, 0x04, 0x00, 0x00, // permitted (low)
+		0x00, 0x00, 0x00, 0x00, // inheritable (low)
+		0x00, 0x00, 0x00, 0x00, // permitted (high)
+		0x00, 0x00, 0x00, 0x00, // inheritable (high)
+	}
+	err := unix.Setxattr(filepath.Join(root, "src/bin"), "security.capability", capData, 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip("security.capability xattrs not supported on test filesystem")
+	}
+	require.NoError(t, err)
+	srcCaps, err := getxattr(filepath.Join(root, "src/bin"), "security.capability")
+	require.NoError(t, err)
+
+	rootDir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	require.NoError(t, err)
+	defer rootDir.Close()
+
+	// Copying the owner and data would clear security.capability if it was
+	// set before them.
+	err = CopyTreeInRoot(rootDir, "src", "dst", CopyOptions{
+		PreserveOwner:  true,
+		PreserveMode:   true,
+		PreserveXattrs: true,
+	})
+	require.NoError(t, err, "CopyTreeInRoot")
+
+	dstCaps, err := getxattr(filepath.Join(root, "dst/bin"), "security.capability")
+	if assert.NoError(t, err, "get security.capability of copied file") {
+		assert.Equal(t, srcCaps, dstCaps, "security.capability of copied file")
+	}
+
+	err = StripXattrsInRoot(rootDir, "dst", "security.capability")
+	require.NoError(t, err, "StripXattrsInRoot")
+	_, err = getxattr(filepath.Join(root, "dst/bin"), "security.capability")
+	assert.ErrorIs(t, err, unix.ENODATA, "security.capability should be removed")
+	_, err = getxattr(filepath.Join(root, "src/bin"), "security.capability")
+	assert.NoError(t, err, "source security.capability should not be removed")
+}